@@ -0,0 +1,432 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	s "github.com/shinku721/shadowsocks-go-ng/shadowsocks"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// FileServer is an entry of the servers list in the config file.
+type FileServer struct {
+	Host       string
+	Port       int
+	Password   string
+	Key        string
+	Method     string
+	Plugin     string
+	PluginOpts string
+	Remarks    string
+}
+
+// KeyReader returns the key source of the server, the raw key if it
+// is set, or the password otherwise.
+func (server FileServer) KeyReader() (io.Reader, error) {
+	if server.Key != "" {
+		return s.NewRawKeyReader(server.Method, server.Key)
+	}
+	return s.NewKeyReader(server.Method, server.Password)
+}
+
+// FileConfig is the config file in the JSON format of
+// shadowsocks-libev and shadowsocks-rust. The fields absent from the
+// file are nil.
+type FileConfig struct {
+	Server       []string
+	ServerPort   *int
+	PortPassword map[uint16]string
+	LocalAddress *string
+	LocalPort    *int
+	Password     *string
+	Key          *string
+	Method       *string
+	Timeout      *int
+	FastOpen     *bool
+	Mode         *string
+	Plugin       *string
+	PluginOpts   *string
+	Nameserver   *string
+	ReusePort    *bool
+	V4Only       *bool
+	Strategy     *string
+	Servers      []FileServer
+}
+
+// Servers returns the servers configured, either the servers list of
+// shadowsocks-rust, or the servers on each host, with the password of
+// each port in port_password if it is set.
+func (config Config) Servers() (servers []FileServer) {
+	if len(config.servers) > 0 {
+		return config.servers
+	}
+	for _, host := range config.serverHost {
+		server := FileServer{
+			Host:       host,
+			Port:       config.serverPort,
+			Password:   config.password,
+			Key:        config.key,
+			Method:     config.encryptMethod,
+			Plugin:     config.plugin,
+			PluginOpts: config.pluginOpts,
+		}
+		if config.portPassword == nil {
+			servers = append(servers, server)
+			continue
+		}
+		// the password of each port is used instead of the key
+		server.Key = ""
+		for port, password := range config.portPassword {
+			server.Port, server.Password = int(port), password
+			servers = append(servers, server)
+		}
+	}
+	return
+}
+
+// objectDecoder decodes the fields of a JSON object one by one, so
+// that errors tell the path of the field. Only the first error is
+// kept.
+type objectDecoder struct {
+	path   string
+	fields map[string]json.RawMessage
+	err    error
+}
+
+func newObjectDecoder(path string, data []byte) (*objectDecoder, error) {
+	d := &objectDecoder{path: path}
+	if err := json.Unmarshal(data, &d.fields); err != nil {
+		return nil, d.errorf(path, "expected an object")
+	}
+	return d, nil
+}
+
+func (d *objectDecoder) fieldPath(name string) string {
+	if d.path == "" {
+		return name
+	}
+	return d.path + "." + name
+}
+
+func (d *objectDecoder) errorf(path, format string, a ...interface{}) error {
+	return fmt.Errorf("%s: %s", path, fmt.Sprintf(format, a...))
+}
+
+// field returns the raw value of field name, or nil if it is absent,
+// null, or an error has occurred.
+func (d *objectDecoder) field(name string) json.RawMessage {
+	raw, ok := d.fields[name]
+	delete(d.fields, name)
+	if !ok || d.err != nil || string(raw) == "null" {
+		return nil
+	}
+	return raw
+}
+
+func (d *objectDecoder) String(name string, dst **string) {
+	if raw := d.field(name); raw != nil {
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			d.err = d.errorf(d.fieldPath(name), "expected a string, got %s", raw)
+			return
+		}
+		*dst = &v
+	}
+}
+
+func (d *objectDecoder) Bool(name string, dst **bool) {
+	if raw := d.field(name); raw != nil {
+		var v bool
+		if err := json.Unmarshal(raw, &v); err != nil {
+			d.err = d.errorf(d.fieldPath(name), "expected a boolean, got %s", raw)
+			return
+		}
+		*dst = &v
+	}
+}
+
+// parseInt parses a JSON integer, or a string of an integer as
+// accepted by shadowsocks-libev.
+func parseInt(raw json.RawMessage) (int, bool) {
+	var v interface{}
+	if json.Unmarshal(raw, &v) != nil {
+		return 0, false
+	}
+	switch v := v.(type) {
+	case float64:
+		if v != math.Trunc(v) || math.Abs(v) > math.MaxInt32 {
+			return 0, false
+		}
+		return int(v), true
+	case string:
+		n, err := strconv.Atoi(v)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+func (d *objectDecoder) Int(name string, dst **int) {
+	if raw := d.field(name); raw != nil {
+		v, ok := parseInt(raw)
+		if !ok || v < 0 {
+			d.err = d.errorf(d.fieldPath(name), "expected a non-negative integer, got %s", raw)
+			return
+		}
+		*dst = &v
+	}
+}
+
+func (d *objectDecoder) Port(name string, dst **int) {
+	if raw := d.field(name); raw != nil {
+		v, ok := parseInt(raw)
+		if !ok || v <= 0 || v > 65535 {
+			d.err = d.errorf(d.fieldPath(name), "expected a port number, got %s", raw)
+			return
+		}
+		*dst = &v
+	}
+}
+
+// Strings decodes a string or an array of strings.
+func (d *objectDecoder) Strings(name string, dst *[]string) {
+	if raw := d.field(name); raw != nil {
+		var v string
+		if json.Unmarshal(raw, &v) == nil {
+			*dst = []string{v}
+			return
+		}
+		var vs []string
+		if err := json.Unmarshal(raw, &vs); err != nil || len(vs) == 0 {
+			d.err = d.errorf(d.fieldPath(name), "expected a string or an array of strings, got %s", raw)
+			return
+		}
+		*dst = vs
+	}
+}
+
+// Done returns the first error, and logs the fields not decoded.
+func (d *objectDecoder) Done() error {
+	if d.err != nil {
+		return d.err
+	}
+	names := make([]string, 0, len(d.fields))
+	for name := range d.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		log.Printf("Ignoring unsupported field %s in config file", d.fieldPath(name))
+	}
+	return nil
+}
+
+func (d *objectDecoder) portPassword(name string, dst *map[uint16]string) {
+	raw := d.field(name)
+	if raw == nil {
+		return
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &m); err != nil {
+		d.err = d.errorf(d.fieldPath(name), "expected an object of ports and passwords")
+		return
+	}
+	*dst = make(map[uint16]string, len(m))
+	for sport, rpass := range m {
+		path := d.fieldPath(name) + "." + sport
+		port, err := strconv.Atoi(sport)
+		if err != nil || port <= 0 || port > 65535 {
+			d.err = d.errorf(path, "expected a port number as the key")
+			return
+		}
+		var password string
+		if err = json.Unmarshal(rpass, &password); err != nil {
+			d.err = d.errorf(path, "expected a string, got %s", rpass)
+			return
+		}
+		(*dst)[uint16(port)] = password
+	}
+}
+
+func (d *objectDecoder) servers(name string, dst *[]FileServer) {
+	raw := d.field(name)
+	if raw == nil {
+		return
+	}
+	var list []json.RawMessage
+	if err := json.Unmarshal(raw, &list); err != nil {
+		d.err = d.errorf(d.fieldPath(name), "expected an array of servers")
+		return
+	}
+	for i, rserver := range list {
+		path := fmt.Sprintf("%s[%d]", d.fieldPath(name), i)
+		var sd *objectDecoder
+		if sd, d.err = newObjectDecoder(path, rserver); d.err != nil {
+			return
+		}
+		var host, password, key, method, plugin, pluginOpts, remarks *string
+		var port *int
+		sd.String("server", &host)
+		sd.Port("server_port", &port)
+		sd.String("password", &password)
+		sd.String("key", &key)
+		sd.String("method", &method)
+		sd.String("plugin", &plugin)
+		sd.String("plugin_opts", &pluginOpts)
+		sd.String("remarks", &remarks)
+		if d.err = sd.Done(); d.err != nil {
+			return
+		}
+		if host == nil || port == nil || method == nil {
+			d.err = d.errorf(path, "server, server_port and method are required")
+			return
+		}
+		server := FileServer{Host: *host, Port: *port, Method: *method}
+		for _, f := range []struct {
+			dst *string
+			src *string
+		}{
+			{&server.Password, password}, {&server.Key, key}, {&server.Plugin, plugin},
+			{&server.PluginOpts, pluginOpts}, {&server.Remarks, remarks},
+		} {
+			if f.src != nil {
+				*f.dst = *f.src
+			}
+		}
+		*dst = append(*dst, server)
+	}
+}
+
+// jsonErrorPosition returns the line and column of a syntax error.
+func jsonErrorPosition(data []byte, err error) string {
+	e, ok := err.(*json.SyntaxError)
+	if !ok {
+		return ""
+	}
+	// the offset is 0 for an empty file
+	offset := int(e.Offset)
+	if offset > len(data) {
+		offset = len(data)
+	}
+	if offset < 1 {
+		offset = 1
+	}
+	line, col := 1, 1
+	for _, c := range data[:offset-1] {
+		if c == '\n' {
+			line, col = line+1, 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Sprintf(":%d:%d", line, col)
+}
+
+// ParseConfigFile parses a config file of shadowsocks-libev or
+// shadowsocks-rust. Errors tell the path of the invalid field.
+// Unsupported fields are logged and ignored.
+func ParseConfigFile(filename string) (config *FileConfig, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(filename); err != nil {
+		return
+	}
+	var raw json.RawMessage
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s%s: %v", filename, jsonErrorPosition(data, err), err)
+	}
+	var d *objectDecoder
+	if d, err = newObjectDecoder("", data); err != nil {
+		return nil, fmt.Errorf("%s: expected an object", filename)
+	}
+	config = &FileConfig{}
+	d.Strings("server", &config.Server)
+	d.Port("server_port", &config.ServerPort)
+	d.portPassword("port_password", &config.PortPassword)
+	d.String("local_address", &config.LocalAddress)
+	d.Port("local_port", &config.LocalPort)
+	d.String("password", &config.Password)
+	d.String("key", &config.Key)
+	d.String("method", &config.Method)
+	d.Int("timeout", &config.Timeout)
+	d.Bool("fast_open", &config.FastOpen)
+	d.String("mode", &config.Mode)
+	d.String("plugin", &config.Plugin)
+	d.String("plugin_opts", &config.PluginOpts)
+	d.String("nameserver", &config.Nameserver)
+	d.Bool("reuse_port", &config.ReusePort)
+	d.Bool("v4only", &config.V4Only)
+	d.String("strategy", &config.Strategy)
+	d.servers("servers", &config.Servers)
+	if err = d.Done(); err == nil && config.Mode != nil {
+		switch *config.Mode {
+		case "tcp_only", "tcp_and_udp":
+		case "udp_only":
+			log.Printf("TCP relay can't be disabled, relaying both TCP and UDP in mode udp_only")
+		default:
+			err = d.errorf("mode", "expected tcp_only, tcp_and_udp or udp_only, got %q", *config.Mode)
+		}
+	}
+	if err == nil && config.Strategy != nil {
+		if _, e := s.ParseBalanceStrategy(*config.Strategy); e != nil {
+			err = d.errorf("strategy", "%v", e)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return
+}
+
+// Apply sets the fields of config present in the file, except those
+// whose command-line flags are changed, so that flags take
+// precedence over the file.
+func (f *FileConfig) Apply(config *Config, changed func(flag string) bool) {
+	setString := func(flag string, dst *string, src *string) {
+		if src != nil && !changed(flag) {
+			*dst = *src
+		}
+	}
+	setInt := func(flag string, dst *int, src *int) {
+		if src != nil && !changed(flag) {
+			*dst = *src
+		}
+	}
+	setBool := func(flag string, dst *bool, src *bool) {
+		if src != nil && !changed(flag) {
+			*dst = *src
+		}
+	}
+	if f.Server != nil && !changed("server_host") {
+		config.serverHost = f.Server
+	}
+	setInt("server_port", &config.serverPort, f.ServerPort)
+	if f.PortPassword != nil {
+		config.portPassword = f.PortPassword
+	}
+	setString("local_host", &config.localHost, f.LocalAddress)
+	setInt("local_port", &config.localPort, f.LocalPort)
+	setString("password", &config.password, f.Password)
+	setString("key", &config.key, f.Key)
+	setString("encrypt_method", &config.encryptMethod, f.Method)
+	setInt("timeout", &config.timeout, f.Timeout)
+	if f.FastOpen != nil {
+		config.fastOpen = *f.FastOpen
+	}
+	if f.Mode != nil && !changed("udp_relay") {
+		config.udpRelay = *f.Mode != "tcp_only"
+	}
+	setString("plugin", &config.plugin, f.Plugin)
+	setString("plugin_opts", &config.pluginOpts, f.PluginOpts)
+	setString("nameserver", &config.nameserver, f.Nameserver)
+	if f.ReusePort != nil {
+		config.reusePort = *f.ReusePort
+	}
+	setBool("v4only", &config.v4only, f.V4Only)
+	setString("strategy", &config.strategy, f.Strategy)
+	if f.Servers != nil {
+		config.servers = f.Servers
+	}
+}
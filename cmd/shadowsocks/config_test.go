@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseEmptyConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, content := range []string{"", " \n\t"} {
+		path := filepath.Join(dir, "config.json")
+		if err = ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ParseConfigFile(path); err == nil || !strings.HasPrefix(err.Error(), path+":") {
+			t.Fatalf("Wrong error of %q: %v", content, err)
+		}
+	}
+}
+
+func TestPortPasswordServers(t *testing.T) {
+	c := DefaultConfig()
+	c.key = "key"
+	c.portPassword = map[uint16]string{8381: "password"}
+	servers := c.Servers()
+	if len(servers) != 1 || servers[0].Port != 8381 || servers[0].Password != "password" || servers[0].Key != "" {
+		t.Fatalf("Wrong servers: %+v", servers)
+	}
+}
+
+func TestParseStrategy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	if err = ioutil.WriteFile(path, []byte(`{"strategy": "lowest-latency"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := ParseConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := DefaultConfig()
+	f.Apply(&c, func(string) bool { return false })
+	if c.strategy != "lowest-latency" {
+		t.Fatal("Wrong strategy:", c.strategy)
+	}
+	if err = ioutil.WriteFile(path, []byte(`{"strategy": "random"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseConfigFile(path); err == nil {
+		t.Fatal("Unknown strategy is parsed")
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	parse := func(content string) (*FileConfig, error) {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return ParseConfigFile(path)
+	}
+
+	for _, c := range []struct{ content, err string }{
+		{`{"server_port": "x"}`, `server_port: expected a port number, got "x"`},
+		{`{"server_port": 65536}`, "server_port: expected a port number, got 65536"},
+		{`{"timeout": -1}`, "timeout: expected a non-negative integer, got -1"},
+		{`{"fast_open": "yes"}`, `fast_open: expected a boolean, got "yes"`},
+		{`{"server": 1}`, "server: expected a string or an array of strings, got 1"},
+		{`{"server": []}`, "server: expected a string or an array of strings, got []"},
+		{`{"mode": "none"}`, `mode: expected tcp_only, tcp_and_udp or udp_only, got "none"`},
+		{`{"port_password": {"x": "password"}}`, "port_password.x: expected a port number as the key"},
+		{`{"servers": {}}`, "servers: expected an array of servers"},
+		{`{"servers": [1]}`, "servers[0]: expected an object"},
+		{`{"servers": [{"server": "127.0.0.1", "server_port": 8388}]}`, "servers[0]: server, server_port and method are required"},
+		{`{"servers": [{"server": "127.0.0.1", "server_port": 0, "method": "aes-128-gcm"}]}`, "servers[0].server_port: expected a port number, got 0"},
+	} {
+		if _, err = parse(c.content); err == nil || err.Error() != path+": "+c.err {
+			t.Fatalf("Wrong error of %s: %v", c.content, err)
+		}
+	}
+
+	for _, c := range []struct {
+		content string
+		server  []string
+	}{
+		{`{"server": "127.0.0.1"}`, []string{"127.0.0.1"}},
+		{`{"server": ["127.0.0.1", "::1"]}`, []string{"127.0.0.1", "::1"}},
+	} {
+		f, err := parse(c.content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(f.Server, ",") != strings.Join(c.server, ",") {
+			t.Fatalf("Wrong server of %s: %v", c.content, f.Server)
+		}
+	}
+
+	f, err := parse(`{"servers": [
+		{"server": "127.0.0.1", "server_port": 8388, "method": "aes-128-gcm", "password": "password", "remarks": "a"},
+		{"server": "::1", "server_port": "8389", "method": "aes-256-gcm", "key": "key", "plugin": "obfs-local", "plugin_opts": "obfs=http"}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := []FileServer{
+		{Host: "127.0.0.1", Port: 8388, Method: "aes-128-gcm", Password: "password", Remarks: "a"},
+		{Host: "::1", Port: 8389, Method: "aes-256-gcm", Key: "key", Plugin: "obfs-local", PluginOpts: "obfs=http"},
+	}
+	if len(f.Servers) != len(servers) || f.Servers[0] != servers[0] || f.Servers[1] != servers[1] {
+		t.Fatalf("Wrong servers: %+v", f.Servers)
+	}
+	c := DefaultConfig()
+	f.Apply(&c, func(string) bool { return false })
+	if len(c.Servers()) != len(servers) || c.Servers()[1] != servers[1] {
+		t.Fatalf("Wrong servers of config: %+v", c.Servers())
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	for _, c := range []struct {
+		mode     string
+		udpRelay bool
+	}{
+		{"tcp_only", false},
+		{"tcp_and_udp", true},
+		{"udp_only", true},
+	} {
+		if err = ioutil.WriteFile(path, []byte(`{"mode": "`+c.mode+`"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := ParseConfigFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := DefaultConfig()
+		config.udpRelay = !c.udpRelay
+		f.Apply(&config, func(string) bool { return false })
+		if config.udpRelay != c.udpRelay {
+			t.Fatal("Wrong UDP relay of mode", c.mode)
+		}
+	}
+}
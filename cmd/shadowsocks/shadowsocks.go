@@ -1,31 +1,73 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	s "github.com/shinku721/shadowsocks-go-ng/shadowsocks"
 	flag "github.com/spf13/pflag"
-	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
 )
 
 type Config struct {
-	serverHost    string
-	serverPort    int
-	portPassword  map[uint16]string
-	localHost     string
-	localPort     int
-	password      string
-	key           string
-	encryptMethod string
-	timeout       int
-	v4only        bool
+	serverHost     []string
+	serverPort     int
+	portPassword   map[uint16]string
+	localHost      string
+	localPort      int
+	password       string
+	key            string
+	encryptMethod  string
+	timeout        int
+	v4only         bool
+	udpRelay       bool
+	fastOpen       bool
+	reusePort      bool
+	plugin         string
+	pluginOpts     string
+	nameserver     string
+	servers        []FileServer
+	banThreshold   int
+	banWindow      int
+	banDuration    int
+	banFile        string
+	fallback       string
+	fallbackDecoy  string
+	fallbackDelay  int
+	uploadRate     int64
+	downloadRate   int64
+	rateBurst      int64
+	portMaxConns   int
+	ipMaxConns     int
+	denyPrivate    bool
+	allowIP        []string
+	denyIP         []string
+	allowPort      []string
+	denyPort       []string
+	aclFile        string
+	strategy       string
+	serverCooldown int
+	connectTimeout int
+	healthProbe    string
+	healthInterval int
+	healthListen   string
+	subscription   string
+	subInterval    int
+	tunnels        []string
+	dnsListen      string
+	dnsRemote      string
+	dnsLocal       string
+	dnsLocalDomain []string
+	tproxyListen   string
+	fakeIP         bool
+	fakeIPRange    string
+	fakeIP6Range   string
+	fakeIPFile     string
+	fakeIPEntries  int
 }
 
 var (
@@ -34,6 +76,8 @@ var (
 	pidFile        string
 	configFile     string
 	managerAddress string
+	serverURI      string
+	printQRCode    bool
 	verbose        bool
 	help           bool
 	maxConn        int
@@ -42,16 +86,30 @@ var (
 
 func DefaultConfig() Config {
 	return Config{
-		serverHost:    "0.0.0.0",
-		serverPort:    8388,
-		portPassword:  nil,
-		localHost:     "127.0.0.1",
-		localPort:     1080,
-		password:      "",
-		key:           "",
-		encryptMethod: "chacha20-ietf-poly1305",
-		timeout:       120,
-		v4only:        false,
+		serverHost:     []string{"0.0.0.0"},
+		serverPort:     8388,
+		portPassword:   nil,
+		localHost:      "127.0.0.1",
+		localPort:      1080,
+		password:       "",
+		key:            "",
+		encryptMethod:  "chacha20-ietf-poly1305",
+		timeout:        120,
+		v4only:         false,
+		udpRelay:       true,
+		banThreshold:   0,
+		banWindow:      int(s.DEFAULT_BAN_WINDOW / time.Second),
+		banDuration:    int(s.DEFAULT_BAN_DURATION / time.Second),
+		banFile:        "",
+		fallback:       "drain",
+		fallbackDecoy:  "",
+		fallbackDelay:  int(s.DEFAULT_FALLBACK_DELAY / time.Second),
+		denyPrivate:    true,
+		strategy:       s.BALANCE_ROUND_ROBIN.String(),
+		serverCooldown: int(s.DEFAULT_SERVER_COOLDOWN / time.Second),
+		connectTimeout: int(s.DefaultConfig().ConnectTimeout / time.Second),
+		healthInterval: int(s.DEFAULT_HEALTH_INTERVAL / time.Second),
+		subInterval:    int(s.DEFAULT_SUBSCRIPTION_INTERVAL / time.Second),
 	}
 }
 
@@ -61,15 +119,58 @@ func init() {
 		cmd = os.Args[1]
 	}
 	flags := flag.CommandLine
-	flags.StringVarP(&config.serverHost, "server_host", "s", config.serverHost, "Server host name or IP address")
+	flags.StringSliceVarP(&config.serverHost, "server_host", "s", config.serverHost, "Server host names or IP addresses")
 	flags.IntVarP(&config.serverPort, "server_port", "p", 8388, "Server port number")
 	flags.StringVarP(&config.localHost, "local_host", "b", "127.0.0.1", "Client bind host or IP")
 	flags.IntVarP(&config.localPort, "local_port", "l", 1080, "Client listenning port")
-	flags.StringVarP(&config.password, "password", "k", "", "Password of your server")
-	flags.StringVar(&config.key, "key", "", "Key of your server, in base64")
+	flags.StringVarP(&config.password, "password", "k", "", "Password of your server (base64 key for 2022-blake3-* methods)")
+	flags.StringVar(&config.key, "key", "", "Key of your server in base64, instead of the password (see the genkey command)")
 	flags.StringVarP(&config.encryptMethod, "encrypt_method", "m", "chacha20-ietf-poly1305", "Encryption method")
+	flags.StringVar(&config.plugin, "plugin", "", "SIP003 plugin executable, e.g. obfs-server or obfs-local")
+	flags.StringVar(&config.pluginOpts, "plugin_opts", "", "Options of the plugin, e.g. obfs=http")
 	flags.IntVarP(&config.timeout, "timeout", "t", 120, "Socket timeout in seconds")
 	flags.BoolVar(&config.v4only, "v4only", false, "Make server to proxy IPv4 only (server can still listen on IPv6)")
+	flags.BoolVarP(&config.udpRelay, "udp_relay", "u", true, "Relay UDP packets (socks5 UDP ASSOCIATE on the client)")
+	flags.IntVar(&config.banThreshold, "ban_threshold", 0, "Ban a source failing authentication this many times within the ban window, 0 to disable")
+	flags.IntVar(&config.banWindow, "ban_window", config.banWindow, "Ban window in seconds")
+	flags.IntVar(&config.banDuration, "ban_duration", config.banDuration, "Ban duration in seconds")
+	flags.StringVar(&config.banFile, "ban_file", "", "The path to persist bans across restarts")
+	flags.StringVar(&config.fallback, "fallback", "drain", "Handling of connections failing authentication: drain, close (after a random delay) or decoy")
+	flags.StringVar(&config.fallbackDecoy, "fallback_decoy", "", "Decoy server address of the decoy fallback, e.g. 127.0.0.1:80")
+	flags.IntVar(&config.fallbackDelay, "fallback_delay", config.fallbackDelay, "Maximum delay in seconds of the close fallback")
+	flags.Int64Var(&config.uploadRate, "upload_rate", 0, "Upload rate limit of each server port in bytes per second, 0 for unlimited")
+	flags.Int64Var(&config.downloadRate, "download_rate", 0, "Download rate limit of each server port in bytes per second, 0 for unlimited")
+	flags.Int64Var(&config.rateBurst, "rate_burst", 0, "Bytes a server port may transfer at once beyond its rate limits, 0 for the bytes of one second")
+	flags.IntVar(&config.portMaxConns, "port_max_conns", 0, "Maximum simultaneous connections of each server port, 0 for unlimited")
+	flags.IntVar(&config.ipMaxConns, "ip_max_conns", 0, "Maximum simultaneous connections to a server port from each IP address, 0 for unlimited")
+	flags.StringVar(&config.nameserver, "nameserver", "", "DNS server the server resolves destinations with, e.g. 8.8.8.8")
+	flags.BoolVar(&config.denyPrivate, "deny_private", true, "Make server deny loopback, private and link-local destinations")
+	flags.StringSliceVar(&config.allowIP, "allow_ip", nil, "Destination networks the server may connect to, in CIDR notation")
+	flags.StringSliceVar(&config.denyIP, "deny_ip", nil, "Destination networks the server may not connect to, in CIDR notation")
+	flags.StringSliceVar(&config.allowPort, "allow_port", nil, "Destination ports the server may connect to, e.g. 80,443,8000-9000")
+	flags.StringSliceVar(&config.denyPort, "deny_port", nil, "Destination ports the server may not connect to, e.g. 25")
+	flags.StringVar(&config.aclFile, "acl", "", "Client rule file deciding to connect through the server, directly or not at all (shadowsocks-libev format if ending with .acl)")
+	flags.StringVar(&config.strategy, "strategy", config.strategy, "Client strategy choosing among the servers: round-robin, least-connections or lowest-latency")
+	flags.IntVar(&config.serverCooldown, "server_cooldown", config.serverCooldown, "Seconds a client avoids a failed server for")
+	flags.IntVar(&config.connectTimeout, "connect_timeout", config.connectTimeout, "Timeout in seconds of connecting to servers and destinations")
+	flags.StringVar(&config.healthProbe, "health_probe", "", "Client health check target requested through each server, an HTTP URL or the host:port of a server speaking first, like SSH")
+	flags.IntVar(&config.healthInterval, "health_interval", config.healthInterval, "Interval in seconds of client health checks")
+	flags.StringVar(&config.healthListen, "health_listen", "", "Address to serve the health status of the servers in JSON over HTTP, e.g. 127.0.0.1:1081")
+	flags.StringVar(&config.subscription, "subscription", "", "Client SIP008 online config to fetch the servers from, an HTTP(S) URL or a file path")
+	flags.IntVar(&config.subInterval, "subscription_interval", config.subInterval, "Interval in seconds of fetching the client subscription")
+	flags.StringSliceVarP(&config.tunnels, "tunnel", "L", nil, "Local ports the tunnel command forwards through the server, e.g. 5353:8.8.8.8:53")
+	flags.StringVar(&config.dnsListen, "dns_listen", "", "Client DNS listener address resolving through the server, e.g. 127.0.0.1:5353")
+	flags.StringVar(&config.dnsRemote, "dns_remote", s.DEFAULT_DNS_REMOTE, "DNS resolver queried through the server")
+	flags.StringVar(&config.dnsLocal, "dns_local", "", "DNS resolver of the local domains, queried directly, e.g. 192.168.1.1:53")
+	flags.StringSliceVar(&config.dnsLocalDomain, "dns_local_domain", nil, "Domains resolved by the local DNS resolver, including their subdomains")
+	flags.StringVar(&config.tproxyListen, "tproxy_listen", "", "Client TPROXY listener address of TCP and UDP on linux, e.g. [::]:1081")
+	flags.BoolVar(&config.fakeIP, "fake_ip", false, "Answer client DNS queries with fake addresses, which redirected connections are forwarded to the domains of")
+	flags.StringVar(&config.fakeIPRange, "fake_ip_range", s.DEFAULT_FAKE_IP_RANGE, "IPv4 range of the fake addresses, empty to disable")
+	flags.StringVar(&config.fakeIP6Range, "fake_ip6_range", s.DEFAULT_FAKE_IP6_RANGE, "IPv6 range of the fake addresses, empty to disable")
+	flags.StringVar(&config.fakeIPFile, "fake_ip_file", "", "The path to persist the fake addresses across restarts")
+	flags.IntVar(&config.fakeIPEntries, "fake_ip_entries", s.DEFAULT_FAKE_IP_ENTRIES, "Maximum number of domains mapped to fake addresses")
+	flags.StringVar(&serverURI, "url", "", "Server URI (SIP002 ss://), overriding the server options")
+	flags.BoolVar(&printQRCode, "qrcode", false, "Print the QR codes of the URIs with the uri command")
 	flags.StringVarP(&pidFile, "pid_file", "f", "", "The pid file path")
 	flags.StringVarP(&configFile, "config_file", "c", "", "The path to config file")
 	flags.StringVar(&managerAddress, "manager_address", "", "Manager API address, either a unix socket or net address")
@@ -81,11 +182,11 @@ func init() {
 }
 
 func PrintHelp() {
-	if strings.HasSuffix(basename, "-server") || strings.HasSuffix(basename, "-local") {
+	if strings.HasSuffix(basename, "-server") || strings.HasSuffix(basename, "-local") || strings.HasSuffix(basename, "-tunnel") {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
 	} else {
 		fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "Command can be 'server' or 'local'.\n")
+		fmt.Fprintf(os.Stderr, "Command can be 'server', 'local', 'tunnel', 'uri' or 'genkey'.\n")
 	}
 	fmt.Fprintf(os.Stderr, "\nOptions:\n")
 	flag.PrintDefaults()
@@ -100,104 +201,32 @@ func PrintHelp() {
 	}
 }
 
-func ParseConfigFile(filename string) (config Config, err error) {
-	config = DefaultConfig()
-	var configData []byte
-	configData, err = ioutil.ReadFile(filename)
-	if err != nil {
-		return
-	}
-	var configJson map[string]interface{}
-	err = json.Unmarshal(configData, &configJson)
-	if err != nil {
-		return
-	}
-	if s, ok := configJson["server"]; ok {
-		/*if config.serverHost, ok = s.([]string); !ok {
-		      if serverHost, ok := s.(string); ok {
-		          config.serverHost = []string{serverHost}
-		      } else {
-		          err = fmt.Errorf("Invalid server host in config file %s", filename)
-		          return
-		      }
-		  }
-		*/
-		if config.serverHost, ok = s.(string); !ok {
-			err = fmt.Errorf("Invalid server host in config file %s", filename)
-			return
-		}
-	}
-	if s, ok := configJson["server_port"]; ok {
-		var p float64
-		if p, ok = s.(float64); !ok || p >= 65536 || p <= 0 {
-			err = fmt.Errorf("Invalid server port in config file %s", filename)
-			return
-		}
-		config.serverPort = int(p)
+// NewDestPolicy creates the destination policy of the server.
+func NewDestPolicy(config Config) (policy *s.DestPolicy, err error) {
+	policy = s.NewDestPolicy()
+	if config.denyPrivate {
+		policy.DenyPrivate()
 	}
-	if pp, ok := configJson["port_password"]; ok {
-		m, ok := pp.(map[string]string)
-		if !ok {
-			err = fmt.Errorf("Invalid port_password in config file %s", filename)
+	for _, cidr := range config.allowIP {
+		if err = policy.AllowNet(cidr); err != nil {
 			return
 		}
-		config.portPassword = make(map[uint16]string)
-		for sport, pass := range m {
-			var port int
-			port, err = strconv.Atoi(sport)
-			if err != nil {
-				return
-			}
-			if port > 65535 || port <= 0 {
-				err = fmt.Errorf("Port %d out of range in config file %s", port, filename)
-				return
-			}
-			config.portPassword[uint16(port)] = pass
-		}
 	}
-	if s, ok := configJson["local_address"]; ok {
-		if config.localHost, ok = s.(string); !ok {
-			err = fmt.Errorf("Invalid local_host in config file %s", filename)
+	for _, cidr := range config.denyIP {
+		if err = policy.DenyNet(cidr); err != nil {
 			return
 		}
 	}
-	if s, ok := configJson["local_port"]; ok {
-		var p float64
-		if p, ok = s.(float64); !ok || p >= 65536 || p <= 0 {
-			err = fmt.Errorf("Invalid local_port in config file %s", filename)
+	for _, port := range config.allowPort {
+		if err = policy.AllowPort(port); err != nil {
 			return
 		}
-		config.localPort = int(p)
 	}
-	if s, ok := configJson["password"]; ok {
-		if config.password, ok = s.(string); !ok {
-			err = fmt.Errorf("Invalid password in config file %s", filename)
+	for _, port := range config.denyPort {
+		if err = policy.DenyPort(port); err != nil {
 			return
 		}
 	}
-	if s, ok := configJson["key"]; ok {
-		if config.localHost, ok = s.(string); !ok {
-			err = fmt.Errorf("Invalid key in config file %s", filename)
-			return
-		}
-	}
-	if s, ok := configJson["timeout"]; ok {
-		var t float64
-		if t, ok = s.(float64); !ok || int(t) < 0 {
-			err = fmt.Errorf("Invalid timeout in config file %s", filename)
-			return
-		}
-		config.timeout = int(t)
-	}
-	if s, ok := configJson["method"]; ok {
-		if config.encryptMethod, ok = s.(string); !ok {
-			err = fmt.Errorf("Invalid encrypt method in config file %s", filename)
-			return
-		}
-	}
-	if s, ok := configJson["v4only"]; ok {
-		config.v4only, _ = s.(bool)
-	}
 	return
 }
 
@@ -213,46 +242,102 @@ func main() {
 		PrintHelp()
 		return
 	}
-	var serverMode bool
+	var serverMode, tunnelMode, uriMode, genkeyMode bool
 	if strings.HasSuffix(basename, "-server") {
 		serverMode = true
 	} else if strings.HasSuffix(basename, "-local") {
 		serverMode = false
+	} else if strings.HasSuffix(basename, "-tunnel") {
+		tunnelMode = true
 	} else if cmd == "server" {
 		serverMode = true
 	} else if cmd == "local" {
 		serverMode = false
+	} else if cmd == "tunnel" {
+		tunnelMode = true
+	} else if cmd == "uri" {
+		uriMode = true
+	} else if cmd == "genkey" {
+		genkeyMode = true
 	} else {
 		PrintHelp()
 		return
 	}
+	if genkeyMode {
+		var key string
+		if key, err = s.GenerateKey(config.encryptMethod); err == nil {
+			fmt.Println(key)
+		}
+		return
+	}
 	if configFile != "" {
-		config, err = ParseConfigFile(configFile)
-		if err != nil {
+		var fileConfig *FileConfig
+		if fileConfig, err = ParseConfigFile(configFile); err != nil {
+			return
+		}
+		fileConfig.Apply(&config, flag.CommandLine.Changed)
+	}
+	if serverURI != "" {
+		var server FileServer
+		if server, err = ParseServerURI(serverURI); err != nil {
 			return
 		}
+		config.servers = []FileServer{server}
+	}
+	if uriMode {
+		err = PrintURIs(config.Servers(), printQRCode)
+		return
+	}
+	if config.fastOpen {
+		log.Print("TCP fast open is not supported, ignoring fast_open")
+	}
+	if config.reusePort {
+		log.Print("SO_REUSEPORT is not supported, ignoring reuse_port")
 	}
 	s.FDSetMax(maxConn)
 	if serverMode { // server
 		serverConfig := s.Config{
-			ServerHost:    config.serverHost,
-			Method:        config.encryptMethod,
-			ConnectV4Only: config.v4only,
-			Timeout:       time.Duration(config.timeout) * time.Second,
+			ConnectV4Only:  config.v4only,
+			ConnectTimeout: time.Duration(config.connectTimeout) * time.Second,
+			Timeout:        time.Duration(config.timeout) * time.Second,
+			UDPRelay:       config.udpRelay,
+			UDPTimeout:     time.Duration(config.timeout) * time.Second,
+			FallbackDecoy:  config.fallbackDecoy,
+			FallbackDelay:  time.Duration(config.fallbackDelay) * time.Second,
+			UploadRate:     config.uploadRate,
+			DownloadRate:   config.downloadRate,
+			RateBurst:      config.rateBurst,
+			MaxConns:       config.portMaxConns,
+			MaxConnsPerIP:  config.ipMaxConns,
+			Nameserver:     config.nameserver,
+		}
+		if serverConfig.Fallback, err = s.ParseFallbackMode(config.fallback); err != nil {
+			return
+		}
+		if serverConfig.DestPolicy, err = NewDestPolicy(config); err != nil {
+			return
 		}
-		manager := s.NewServerManager()
-		if config.portPassword != nil { // multiuser mode
-			for port, password := range config.portPassword {
-				serverConfig.ServerPort = uint16(port)
-				serverConfig.KeyDeriver = s.NewKeyDeriver([]byte(password))
-				err = manager.Add(serverConfig)
-				if err != nil {
+		if config.banThreshold > 0 {
+			serverConfig.BanList = s.NewBanList(config.banThreshold,
+				time.Duration(config.banWindow)*time.Second,
+				time.Duration(config.banDuration)*time.Second)
+			if config.banFile != "" {
+				if err = serverConfig.BanList.Load(config.banFile); err != nil {
 					return
 				}
 			}
-		} else {
-			serverConfig.ServerPort = uint16(config.serverPort)
-			serverConfig.KeyDeriver = s.NewKeyDeriver([]byte(config.password))
+		}
+		manager := s.NewServerManager(serverConfig)
+		for _, server := range config.Servers() {
+			serverConfig.ServerHost = server.Host
+			serverConfig.ServerPort = uint16(server.Port)
+			serverConfig.Method = server.Method
+			serverConfig.Plugin = server.Plugin
+			serverConfig.PluginOpts = server.PluginOpts
+			serverConfig.KeyDeriver, err = server.KeyReader()
+			if err != nil {
+				return
+			}
 			err = manager.Add(serverConfig)
 			if err != nil {
 				return
@@ -267,19 +352,76 @@ func main() {
 		}
 	} else { // client
 		clientConfig := s.Config{
-			ServerHost: config.serverHost,
-			ServerPort: uint16(config.serverPort),
-			LocalHost:  config.localHost,
-			LocalPort:  uint16(config.localPort),
-			Method:     config.encryptMethod,
-			KeyDeriver: s.NewKeyDeriver([]byte(config.password)),
-			Timeout:    time.Duration(config.timeout) * time.Second,
+			LocalHost:            config.localHost,
+			LocalPort:            uint16(config.localPort),
+			Timeout:              time.Duration(config.timeout) * time.Second,
+			ConnectTimeout:       time.Duration(config.connectTimeout) * time.Second,
+			ServerCooldown:       time.Duration(config.serverCooldown) * time.Second,
+			UDPRelay:             config.udpRelay,
+			HealthProbe:          config.healthProbe,
+			HealthInterval:       time.Duration(config.healthInterval) * time.Second,
+			Subscription:         config.subscription,
+			SubscriptionInterval: time.Duration(config.subInterval) * time.Second,
+			DNSListen:            config.dnsListen,
+			DNSRemote:            config.dnsRemote,
+			DNSLocal:             config.dnsLocal,
+			DNSLocalDomains:      config.dnsLocalDomain,
+			TProxyListen:         config.tproxyListen,
+			FakeIP:               config.fakeIP,
+			FakeIPRange:          config.fakeIPRange,
+			FakeIP6Range:         config.fakeIP6Range,
+			FakeIPFile:           config.fakeIPFile,
+			FakeIPEntries:        config.fakeIPEntries,
+		}
+		if clientConfig.Strategy, err = s.ParseBalanceStrategy(config.strategy); err != nil {
+			return
+		}
+		servers := config.Servers()
+		if config.subscription != "" { // fetched by the client
+			servers = nil
+		}
+		for _, server := range servers {
+			serverConfig := s.ServerConfig{
+				Name:       server.Remarks,
+				Host:       server.Host,
+				Port:       uint16(server.Port),
+				Method:     server.Method,
+				Plugin:     server.Plugin,
+				PluginOpts: server.PluginOpts,
+			}
+			if serverConfig.KeyDeriver, err = server.KeyReader(); err != nil {
+				return
+			}
+			clientConfig.Servers = append(clientConfig.Servers, serverConfig)
+		}
+		if tunnelMode {
+			if len(config.tunnels) == 0 {
+				err = fmt.Errorf("No tunnel is configured, e.g. -L 5353:8.8.8.8:53")
+				return
+			}
+			for _, spec := range config.tunnels {
+				var tunnel s.Tunnel
+				if tunnel, err = s.ParseTunnel(spec); err != nil {
+					return
+				}
+				clientConfig.Tunnels = append(clientConfig.Tunnels, tunnel)
+			}
+		}
+		if config.aclFile != "" {
+			if clientConfig.ACL, err = s.LoadACLFile(config.aclFile); err != nil {
+				return
+			}
 		}
 		client, err := s.NewClientContext(clientConfig)
 		if err != nil {
 			log.Panic(err)
 		}
 		go client.Run()
+		if config.healthListen != "" {
+			go func() {
+				log.Print(http.ListenAndServe(config.healthListen, client.Servers()))
+			}()
+		}
 		log.Print(client.Wait())
 	}
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	s "github.com/shinku721/shadowsocks-go-ng/shadowsocks"
+	"io"
+	"os"
+	"rsc.io/qr"
+	"strings"
+)
+
+// ParseServerURI parses a SIP002 URI into a server.
+func ParseServerURI(uri string) (server FileServer, err error) {
+	var config s.Config
+	if config, err = s.ParseURI(uri); err != nil {
+		return
+	}
+	return FileServer{
+		Host:       config.ServerHost,
+		Port:       int(config.ServerPort),
+		Password:   config.Password,
+		Method:     config.Method,
+		Plugin:     config.Plugin,
+		PluginOpts: config.PluginOpts,
+		Remarks:    config.Remarks,
+	}, nil
+}
+
+// PrintURIs prints the SIP002 URI of each server, followed by its QR
+// code if qrcode is set. URIs only carry passwords, which are the keys
+// of 2022-blake3-* methods.
+func PrintURIs(servers []FileServer, qrcode bool) error {
+	for _, server := range servers {
+		password := server.Password
+		if server.Key != "" {
+			if !strings.HasPrefix(server.Method, "2022-") {
+				return fmt.Errorf("Raw key of %s cannot be put in URIs", server.Method)
+			}
+			password = server.Key
+		}
+		uri, err := s.FormatURI(s.Config{
+			ServerHost: server.Host,
+			ServerPort: uint16(server.Port),
+			Method:     server.Method,
+			Password:   password,
+			Plugin:     server.Plugin,
+			PluginOpts: server.PluginOpts,
+			Remarks:    server.Remarks,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println(uri)
+		if qrcode {
+			code, err := qr.Encode(uri, qr.M)
+			if err != nil {
+				return err
+			}
+			PrintQRCode(os.Stdout, code)
+		}
+	}
+	return nil
+}
+
+// PrintQRCode prints a QR code with half blocks, two rows of modules
+// per line. The light modules are drawn, so that the code is read on
+// terminals with dark backgrounds.
+func PrintQRCode(w io.Writer, code *qr.Code) {
+	const quiet = 2 // modules around the code
+	light := func(x, y int) bool {
+		x, y = x-quiet, y-quiet
+		return x < 0 || y < 0 || x >= code.Size || y >= code.Size || !code.Black(x, y)
+	}
+	size := code.Size + 2*quiet
+	var b strings.Builder
+	for y := 0; y < size; y += 2 {
+		for x := 0; x < size; x++ {
+			top, bottom := light(x, y), y+1 < size && light(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+	io.WriteString(w, b.String())
+}
@@ -0,0 +1,280 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ACLAction is what the client does with a connection.
+type ACLAction int
+
+const (
+	// Connect through the shadowsocks server
+	ACL_PROXY ACLAction = iota
+	// Connect to the destination directly
+	ACL_DIRECT
+	// Close the connection
+	ACL_REJECT
+)
+
+var aclActionNames = map[ACLAction]string{
+	ACL_PROXY:  "proxy",
+	ACL_DIRECT: "direct",
+	ACL_REJECT: "reject",
+}
+
+func (a ACLAction) String() string {
+	if name, ok := aclActionNames[a]; ok {
+		return name
+	}
+	return fmt.Sprintf("ACLAction(%d)", int(a))
+}
+
+// ParseACLAction parses "proxy", "direct" or "reject".
+func ParseACLAction(name string) (ACLAction, error) {
+	for a, n := range aclActionNames {
+		if n == name {
+			return a, nil
+		}
+	}
+	return ACL_PROXY, fmt.Errorf("Unknown ACL action: %s", name)
+}
+
+type aclRule struct {
+	match  func(host string, ip net.IP, port uint16) bool
+	action ACLAction
+}
+
+// ACL decides the action of each connection of a client by its
+// destination. Rules are matched in order, and the action of the
+// first matching rule is taken, or the default action if none
+// matches. Domain rules match destinations given as domain names,
+// and CIDR rules match destinations given as IP addresses, as the
+// client never resolves domain names itself.
+type ACL struct {
+	rules   []aclRule
+	Default ACLAction
+}
+
+// NewACL creates an ACL without rules.
+func NewACL(def ACLAction) *ACL {
+	return &ACL{Default: def}
+}
+
+func (a *ACL) add(action ACLAction, match func(host string, ip net.IP, port uint16) bool) {
+	a.rules = append(a.rules, aclRule{match: match, action: action})
+}
+
+// AddDomain adds a rule matching the domain exactly.
+func (a *ACL) AddDomain(domain string, action ACLAction) {
+	domain = strings.ToLower(domain)
+	a.add(action, func(host string, ip net.IP, port uint16) bool {
+		return ip == nil && host == domain
+	})
+}
+
+// AddSuffix adds a rule matching the domain and its subdomains.
+func (a *ACL) AddSuffix(suffix string, action ACLAction) {
+	suffix = strings.ToLower(strings.TrimPrefix(suffix, "."))
+	a.add(action, func(host string, ip net.IP, port uint16) bool {
+		return ip == nil && (host == suffix || strings.HasSuffix(host, "."+suffix))
+	})
+}
+
+// AddKeyword adds a rule matching the domains containing keyword.
+func (a *ACL) AddKeyword(keyword string, action ACLAction) {
+	keyword = strings.ToLower(keyword)
+	a.add(action, func(host string, ip net.IP, port uint16) bool {
+		return ip == nil && strings.Contains(host, keyword)
+	})
+}
+
+// AddRegexp adds a rule matching the domains matching expr.
+func (a *ACL) AddRegexp(expr string, action ACLAction) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return err
+	}
+	a.add(action, func(host string, ip net.IP, port uint16) bool {
+		return ip == nil && re.MatchString(host)
+	})
+	return nil
+}
+
+// AddCIDR adds a rule matching the addresses in a network in CIDR
+// notation, or a single address.
+func (a *ACL) AddCIDR(cidr string, action ACLAction) error {
+	n, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	a.add(action, func(host string, ip net.IP, port uint16) bool {
+		return ip != nil && n.Contains(ip)
+	})
+	return nil
+}
+
+// AddPort adds a rule matching a port or a port range.
+func (a *ACL) AddPort(spec string, action ACLAction) error {
+	r, err := ParsePortRange(spec)
+	if err != nil {
+		return err
+	}
+	a.add(action, func(host string, ip net.IP, port uint16) bool {
+		return r.contains(port)
+	})
+	return nil
+}
+
+// Match returns the action for the destination host and port,
+// where host is either a domain name or an IP address.
+func (a *ACL) Match(host string, port uint16) ACLAction {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, rule := range a.rules {
+		if rule.match(host, ip, port) {
+			return rule.action
+		}
+	}
+	return a.Default
+}
+
+// LoadACL loads rules in the native format, one rule per line:
+//
+//	# comment
+//	default proxy
+//	domain www.example.com direct
+//	suffix example.com direct
+//	keyword tracker reject
+//	regex ^ads?\. reject
+//	cidr 192.168.0.0/16 direct
+//	port 25 reject
+//
+// The last field is the action, which is one of proxy, direct and
+// reject.
+func LoadACL(r io.Reader) (acl *ACL, err error) {
+	acl = NewACL(ACL_PROXY)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "default" {
+			if acl.Default, err = ParseACLAction(fields[1]); err != nil {
+				return nil, fmt.Errorf("Line %d: %v", n, err)
+			}
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Line %d: invalid rule", n)
+		}
+		var action ACLAction
+		if action, err = ParseACLAction(fields[2]); err != nil {
+			return nil, fmt.Errorf("Line %d: %v", n, err)
+		}
+		switch fields[0] {
+		case "domain":
+			acl.AddDomain(fields[1], action)
+		case "suffix":
+			acl.AddSuffix(fields[1], action)
+		case "keyword":
+			acl.AddKeyword(fields[1], action)
+		case "regex":
+			err = acl.AddRegexp(fields[1], action)
+		case "cidr":
+			err = acl.AddCIDR(fields[1], action)
+		case "port":
+			err = acl.AddPort(fields[1], action)
+		default:
+			err = fmt.Errorf("unknown rule type %s", fields[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", n, err)
+		}
+	}
+	return acl, scanner.Err()
+}
+
+// LoadLibevACL loads rules in the ACL format of shadowsocks-libev.
+// The mode [proxy_all] (or [accept_all]) and [bypass_all] (or
+// [reject_all]) sets the default action, and the entries of
+// [bypass_list] (or [black_list]) are connected directly, the
+// entries of [proxy_list] (or [white_list]) are proxied, and the
+// entries of [outbound_block_list] are rejected. An entry is either
+// an IP address or network, or a regular expression of domains.
+// Entries are matched in the order of the file, except that blocked
+// entries are matched first.
+// Specification:
+// https://github.com/shadowsocks/shadowsocks-libev/blob/master/acl/local.acl
+func LoadLibevACL(r io.Reader) (acl *ACL, err error) {
+	acl = NewACL(ACL_PROXY)
+	blocked := NewACL(ACL_PROXY)
+	var list *ACL
+	var action ACLAction
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		switch line {
+		case "[proxy_all]", "[accept_all]":
+			acl.Default = ACL_PROXY
+			continue
+		case "[bypass_all]", "[reject_all]":
+			acl.Default = ACL_DIRECT
+			continue
+		case "[bypass_list]", "[black_list]":
+			list, action = acl, ACL_DIRECT
+			continue
+		case "[proxy_list]", "[white_list]":
+			list, action = acl, ACL_PROXY
+			continue
+		case "[outbound_block_list]":
+			list, action = blocked, ACL_REJECT
+			continue
+		}
+		if line[0] == '[' {
+			return nil, fmt.Errorf("Line %d: unknown section %s", n, line)
+		}
+		if list == nil {
+			return nil, fmt.Errorf("Line %d: entry out of list", n)
+		}
+		if _, e := parseCIDR(line); e == nil {
+			err = list.AddCIDR(line, action)
+		} else {
+			err = list.AddRegexp(line, action)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", n, err)
+		}
+	}
+	acl.rules = append(blocked.rules, acl.rules...)
+	return acl, scanner.Err()
+}
+
+// LoadACLFile loads the rules in path, in the format of
+// shadowsocks-libev if the extension is .acl, and in the native
+// format otherwise.
+func LoadACLFile(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if filepath.Ext(path) == ".acl" {
+		return LoadLibevACL(f)
+	}
+	return LoadACL(f)
+}
@@ -0,0 +1,158 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"golang.org/x/net/proxy"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestACL(t *testing.T) {
+	acl, err := LoadACL(strings.NewReader(`
+# test rules
+default direct
+domain www.example.com reject
+suffix example.com proxy
+keyword tracker reject
+regex ^ads?\. reject
+cidr 10.0.0.0/8 proxy
+cidr 2001:db8::/32 proxy
+port 25 reject
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		host   string
+		port   uint16
+		action ACLAction
+	}{
+		{"www.example.com", 80, ACL_REJECT},
+		{"WWW.Example.COM.", 80, ACL_REJECT},
+		{"example.com", 80, ACL_PROXY},
+		{"mail.example.com", 25, ACL_PROXY},
+		{"notexample.com", 80, ACL_DIRECT},
+		{"a.tracker.net", 443, ACL_REJECT},
+		{"ad.example.org", 443, ACL_REJECT},
+		{"10.1.2.3", 80, ACL_PROXY},
+		{"2001:db8::1", 80, ACL_PROXY},
+		{"192.0.2.1", 25, ACL_REJECT},
+		{"192.0.2.1", 80, ACL_DIRECT},
+	} {
+		if action := acl.Match(c.host, c.port); action != c.action {
+			t.Fatal("Wrong action of", c.host, c.port, action)
+		}
+	}
+	for _, rules := range []string{"suffix example.com", "domain example.com pass", "cidr 10.0.0.0/33 proxy", "default"} {
+		if _, err = LoadACL(strings.NewReader(rules)); err == nil {
+			t.Fatal("Invalid rules are loaded:", rules)
+		}
+	}
+
+	acl, err = LoadLibevACL(strings.NewReader(`
+[proxy_all]
+
+[bypass_list]
+127.0.0.0/8
+(^|\.)cn$
+
+[outbound_block_list]
+^blocked\.cn$
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		host   string
+		action ACLAction
+	}{
+		{"127.0.0.1", ACL_DIRECT},
+		{"www.example.cn", ACL_DIRECT},
+		{"blocked.cn", ACL_REJECT},
+		{"www.example.com", ACL_PROXY},
+		{"8.8.8.8", ACL_PROXY},
+	} {
+		if action := acl.Match(c.host, 80); action != c.action {
+			t.Fatal("Wrong action of", c.host, action)
+		}
+	}
+}
+
+func TestLibevACLAliases(t *testing.T) {
+	for _, c := range []struct {
+		rules  string
+		host   string
+		action ACLAction
+	}{
+		{"[accept_all]", "www.example.com", ACL_PROXY},
+		{"[reject_all]", "www.example.com", ACL_DIRECT},
+		{"[proxy_all]\n[black_list]\n192.0.2.0/24", "192.0.2.1", ACL_DIRECT},
+		{"[bypass_all]\n[white_list]\n192.0.2.0/24", "192.0.2.1", ACL_PROXY},
+	} {
+		acl, err := LoadLibevACL(strings.NewReader(c.rules))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action := acl.Match(c.host, 80); action != c.action {
+			t.Fatalf("Wrong action of %s with %q: %v", c.host, c.rules, action)
+		}
+	}
+}
+
+func TestClientACL(t *testing.T) {
+	// no server is running, so only direct connections work
+	clientConfig := DefaultConfig()
+	clientConfig.ServerHost = "127.0.0.1"
+	clientConfig.ServerPort = 7090
+	clientConfig.LocalPort = 6090
+	clientConfig.KeyDeriver = NewKeyDeriver([]byte("acl"))
+	clientConfig.ACL = NewACL(ACL_PROXY)
+	clientConfig.ACL.AddPort("8001", ACL_REJECT)
+	clientConfig.ACL.AddCIDR("127.0.0.1", ACL_DIRECT)
+	client, err := NewClientContext(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+	defer client.Wait()
+	defer client.Stop()
+
+	socks, _ := proxy.SOCKS5("tcp", "127.0.0.1:6090", nil, proxy.Direct)
+	for _, dial := range []func(string, string) (net.Conn, error){socks.Dial, nil} {
+		transport := &http.Transport{Dial: dial}
+		if dial == nil { // HTTP proxy
+			transport.Proxy = http.ProxyURL(&url.URL{Scheme: "http", Host: "127.0.0.1:6090"})
+		}
+		requester := &http.Client{Transport: transport, Timeout: time.Second}
+		get := func(url string) (string, error) {
+			request, err := requester.Get(url)
+			if err != nil {
+				return "", err
+			}
+			defer request.Body.Close()
+			if request.StatusCode != http.StatusOK { // HTTP proxy errors
+				return "", fmt.Errorf("%s", request.Status)
+			}
+			content, err := ioutil.ReadAll(request.Body)
+			return string(content), err
+		}
+		content, err := get("http://127.0.0.1:8000/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if content != "Hello" {
+			t.Fatal("Wrong content:", content)
+		}
+		if _, err = get("http://127.0.0.1:8001/hello"); err == nil {
+			t.Fatal("Rejected destination is connected")
+		}
+		if _, err = get("http://localhost:8000/hello"); err == nil {
+			t.Fatal("Proxied destination is connected without server")
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_BAN_THRESHOLD = 10
+	DEFAULT_BAN_WINDOW    = time.Minute
+	DEFAULT_BAN_DURATION  = time.Hour
+	MAX_BAN_ENTRIES       = 65536
+)
+
+// BanList tracks the authentication failures of each source address
+// in a sliding window, and bans the sources failing too often for a
+// while. Connections from banned sources are handled like failed
+// ones (see FallbackMode), so that probers see no difference. The
+// bans may be persisted in a file to survive restarts.
+type BanList struct {
+	lock      sync.Mutex
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	failures  map[string][]time.Time
+	bans      map[string]time.Time // source -> expiry
+	path      string
+	saving    sync.Mutex // held while writing the file
+}
+
+// NewBanList creates a ban list which bans a source for duration
+// once it fails threshold times within window.
+func NewBanList(threshold int, window, duration time.Duration) *BanList {
+	return &BanList{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		failures:  map[string][]time.Time{},
+		bans:      map[string]time.Time{},
+	}
+}
+
+// Load loads the bans persisted in path, and saves the bans to path
+// whenever they change. A missing file is not an error.
+func (b *BanList) Load(path string) (err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.path = path
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	var bans map[string]int64
+	if err = json.Unmarshal(data, &bans); err != nil {
+		return
+	}
+	now := time.Now()
+	for source, expiry := range bans {
+		if t := time.Unix(expiry, 0); t.After(now) {
+			b.bans[source] = t
+		}
+	}
+	return
+}
+
+// save writes the bans to the file loaded. The bans are copied with
+// the lock held, and written without blocking the checks, so it must
+// be called without the lock.
+func (b *BanList) save() error {
+	b.saving.Lock()
+	defer b.saving.Unlock()
+	b.lock.Lock()
+	path := b.path
+	if path == "" {
+		b.lock.Unlock()
+		return nil
+	}
+	bans := make(map[string]int64, len(b.bans))
+	for source, expiry := range b.bans {
+		bans[source] = expiry.Unix()
+	}
+	b.lock.Unlock()
+	data, err := json.Marshal(bans)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Fail records an authentication failure of source, and returns
+// true if source is banned because of it.
+func (b *BanList) Fail(source string) bool {
+	b.lock.Lock()
+	now := time.Now()
+	if len(b.failures) >= MAX_BAN_ENTRIES {
+		b.prune(now)
+	}
+	failures := b.failures[source]
+	for len(failures) > 0 && now.Sub(failures[0]) > b.window {
+		failures = failures[1:]
+	}
+	failures = append(failures, now)
+	if len(failures) < b.threshold {
+		b.failures[source] = failures
+		b.lock.Unlock()
+		return false
+	}
+	delete(b.failures, source)
+	b.bans[source] = now.Add(b.duration)
+	b.lock.Unlock()
+	b.save() // ignoring errors, the ban works anyway
+	return true
+}
+
+// prune removes the failures out of window and the expired bans.
+// It must be called with the lock held.
+func (b *BanList) prune(now time.Time) {
+	for source, failures := range b.failures {
+		if now.Sub(failures[len(failures)-1]) > b.window {
+			delete(b.failures, source)
+		}
+	}
+	if len(b.failures) >= MAX_BAN_ENTRIES {
+		b.failures = map[string][]time.Time{}
+	}
+	for source, expiry := range b.bans {
+		if !expiry.After(now) {
+			delete(b.bans, source)
+		}
+	}
+}
+
+// Banned checks whether source is banned.
+func (b *BanList) Banned(source string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	expiry, ok := b.bans[source]
+	if !ok {
+		return false
+	}
+	if !expiry.After(time.Now()) {
+		delete(b.bans, source)
+		return false
+	}
+	return true
+}
+
+// Bans returns the banned sources and the expiry of their bans.
+func (b *BanList) Bans() map[string]time.Time {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.prune(time.Now())
+	res := make(map[string]time.Time, len(b.bans))
+	for source, expiry := range b.bans {
+		res[source] = expiry
+	}
+	return res
+}
+
+// Unban lifts the ban of source, and returns false if source is not
+// banned.
+func (b *BanList) Unban(source string) bool {
+	b.lock.Lock()
+	if _, ok := b.bans[source]; !ok {
+		b.lock.Unlock()
+		return false
+	}
+	delete(b.bans, source)
+	delete(b.failures, source)
+	b.lock.Unlock()
+	b.save()
+	return true
+}
+
+// Clear lifts all bans and forgets all failures.
+func (b *BanList) Clear() {
+	b.lock.Lock()
+	b.bans = map[string]time.Time{}
+	b.failures = map[string][]time.Time{}
+	b.lock.Unlock()
+	b.save()
+}
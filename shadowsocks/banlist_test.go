@@ -0,0 +1,73 @@
+package shadowsocks
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "banlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bans.json")
+
+	bans := NewBanList(3, time.Minute, time.Hour)
+	if err = bans.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := DefaultConfig()
+	serverConfig.ServerHost = "127.0.0.1"
+	serverConfig.ServerPort = 7060
+	serverConfig.KeyDeriver = NewKeyDeriver([]byte("banlist"))
+	serverConfig.BanList = bans
+	server, err := NewServerContext(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+	defer server.Wait()
+	defer server.Stop()
+
+	// a probe with garbage fails authentication, and is drained
+	probe := func() {
+		conn, err := net.Dial("tcp", "127.0.0.1:7060")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write(make([]byte, 100))
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err = conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("Probe is answered")
+		} else if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			t.Fatal("Probe is not drained:", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		probe()
+	}
+	if !bans.Banned("127.0.0.1") {
+		t.Fatal("Source is not banned")
+	}
+	probe() // banned sources are drained too
+
+	restored := NewBanList(3, time.Minute, time.Hour)
+	if err = restored.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.Banned("127.0.0.1") {
+		t.Fatal("Ban is not persisted")
+	}
+	if !bans.Unban("127.0.0.1") || bans.Banned("127.0.0.1") {
+		t.Fatal("Ban is not lifted")
+	}
+	if bans.Unban("127.0.0.1") {
+		t.Fatal("Unbanned source is unbanned again")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -15,45 +16,145 @@ var v4InV6Prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
 // using specified encryption.
 // It accepts several protocols, e.g. HTTP proxy, socks4(a), socks5.
 // The combinition should be able to be configured in the future.
+// In tunnel mode, it listens on the local ports of the tunnels instead.
+// It forwards DNS queries through the servers as well if configured,
+// or answers them with fake addresses mapped back to the domains, and
+// the connections and datagrams of a TPROXY listener on linux.
 type ClientContext struct {
 	listener              net.Listener
+	tunnels               []*tunnelListener
+	dns                   *DNSForwarder
+	fakeIP                *FakeIPPool
+	tproxy                *tproxyListener
 	running               chan bool
-	serverAddr            string
-	cipherFactory         CipherFactory
+	pool                  *ServerPool
+	health                *HealthChecker
+	subscription          *Subscription
 	err                   chan error
 	timeout               time.Duration
+	connectTimeout        time.Duration
+	acl                   *ACL
 	httpConnectionManager *HTTPConnectionManager
 }
 
 // NewClientContext creates a new client context.
 func NewClientContext(config Config) (ctx ClientContext, err error) {
-	cipherInfo, ok := Ciphers[config.Method]
-	if !ok {
-		err = fmt.Errorf("Unknown cipher: %s", config.Method)
-		return
-	}
-	key := make([]byte, cipherInfo.keySize)
-	var n int
-	n, err = config.KeyDeriver.Read(key)
-	if err != nil {
-		return
+	servers := config.Servers
+	if len(servers) == 0 {
+		servers = []ServerConfig{{
+			Host:       config.ServerHost,
+			Port:       config.ServerPort,
+			Method:     config.Method,
+			KeyDeriver: config.KeyDeriver,
+			Plugin:     config.Plugin,
+			PluginOpts: config.PluginOpts,
+		}}
 	}
-	if n < cipherInfo.keySize {
-		err = fmt.Errorf("Insufficient key size")
-		return
+	var probe *HealthProbe
+	if config.HealthProbe != "" {
+		if probe, err = ParseHealthProbe(config.HealthProbe); err != nil {
+			return
+		}
 	}
 	var server net.Listener
-	server, err = net.Listen("tcp", WrapAddr(config.LocalHost, config.LocalPort))
-	if err != nil {
+	var tunnels []*tunnelListener
+	var dns *DNSForwarder
+	var tproxy *tproxyListener
+	var upstreams []*Upstream
+	pool := NewServerPool(nil, config.Strategy, config.ServerCooldown)
+	defer func() {
+		if err != nil { // stop the listeners and the plugins started
+			if server != nil {
+				server.Close()
+			}
+			for _, t := range tunnels {
+				t.Close()
+			}
+			if dns != nil {
+				dns.Close()
+			}
+			if tproxy != nil {
+				tproxy.Close()
+			}
+			for _, u := range upstreams {
+				u.Close()
+			}
+			pool.Close()
+		}
+	}()
+	udpTimeout := config.UDPTimeout
+	if udpTimeout == 0 {
+		udpTimeout = DEFAULT_UDP_TIMEOUT
+	}
+	if len(config.Tunnels) > 0 {
+		for _, t := range config.Tunnels {
+			var l *tunnelListener
+			if l, err = listenTunnel(t, config.LocalHost, config.UDPRelay, udpTimeout); err != nil {
+				return
+			}
+			tunnels = append(tunnels, l)
+		}
+	} else if server, err = net.Listen("tcp", WrapAddr(config.LocalHost, config.LocalPort)); err != nil {
 		return
 	}
+	if config.TProxyListen != "" {
+		if tproxy, err = listenTProxy(config.TProxyListen, config.UDPRelay, udpTimeout); err != nil {
+			return
+		}
+	}
+	var subscription *Subscription
+	if config.Subscription != "" {
+		subscription = NewSubscription(config.Subscription, pool, config.SubscriptionInterval, config.ConnectTimeout, config.UDPRelay)
+		if err = subscription.Update(); err != nil {
+			return
+		}
+	} else {
+		for _, sc := range servers {
+			var u *Upstream
+			if u, err = NewUpstream(sc, config.UDPRelay); err != nil {
+				return
+			}
+			upstreams = append(upstreams, u)
+		}
+		pool.SetServers(upstreams)
+	}
+	var fakeIP *FakeIPPool
+	if config.FakeIP {
+		if config.DNSListen == "" {
+			err = fmt.Errorf("Fake IP requires the DNS listener")
+			return
+		}
+		if fakeIP, err = NewFakeIPPool(config.FakeIPRange, config.FakeIP6Range, config.FakeIPEntries); err != nil {
+			return
+		}
+		if config.FakeIPFile != "" {
+			if err = fakeIP.Load(config.FakeIPFile); err != nil {
+				return
+			}
+		}
+	}
+	if config.DNSListen != "" {
+		if dns, err = NewDNSForwarder(config.DNSListen, pool, config.DNSRemote, config.DNSLocal,
+			config.DNSLocalDomains, fakeIP, config.ConnectTimeout); err != nil {
+			return
+		}
+	}
 	ctx = ClientContext{
-		listener:      server,
-		running:       make(chan bool, 1),
-		serverAddr:    WrapAddr(config.ServerHost, config.ServerPort),
-		cipherFactory: cipherInfo.newFactory(key),
-		err:           make(chan error, 1),
-		timeout:       config.Timeout,
+		listener:       server,
+		tunnels:        tunnels,
+		dns:            dns,
+		fakeIP:         fakeIP,
+		tproxy:         tproxy,
+		running:        make(chan bool, 1),
+		pool:           pool,
+		subscription:   subscription,
+		err:            make(chan error, 1),
+		timeout:        config.Timeout,
+		connectTimeout: config.ConnectTimeout,
+		acl:            config.ACL,
+	}
+	if probe != nil {
+		ctx.health = NewHealthChecker(ctx.pool, probe, config.HealthInterval, config.HealthTimeout)
 	}
 	ctx.running <- false
 	return
@@ -73,25 +174,98 @@ func (ctx *ClientContext) Run() {
 	default:
 	}
 	ctx.httpConnectionManager = NewHTTPConnectionManager(ctx)
+	if ctx.health != nil {
+		ctx.health.Start()
+	}
+	if ctx.subscription != nil {
+		ctx.subscription.Start()
+	}
+	// the client stops when any listener stops
+	res := make(chan error, 3+len(ctx.tunnels))
+	n := 0
+	if ctx.listener != nil {
+		n++
+		go ctx.serve(ctx.listener, ctx.HandleConnection, res)
+	}
+	for _, t := range ctx.tunnels {
+		t := t
+		n++
+		go ctx.serve(t.listener, func(conn net.Conn) {
+			ctx.HandleTunnel(conn, t)
+		}, res)
+		if t.udp != nil {
+			go ctx.relayTunnelUDP(t)
+		}
+	}
+	if ctx.dns != nil {
+		n++
+		go ctx.serve(ctx.dns.tcp, ctx.dns.HandleConnection, res)
+		go ctx.dns.serveUDP()
+	}
+	if ctx.tproxy != nil {
+		n++
+		go ctx.serve(ctx.tproxy.tcp, ctx.HandleTProxy, res)
+		if ctx.tproxy.udp != nil {
+			go ctx.relayTProxyUDP(ctx.tproxy)
+		}
+	}
+	err := <-res
+	ctx.closeListeners()
+	for ; n > 1; n-- {
+		<-res
+	}
+	ctx.httpConnectionManager.Delete()
+	if ctx.health != nil {
+		ctx.health.Stop()
+	}
+	if ctx.subscription != nil {
+		ctx.subscription.Stop()
+	}
+	ctx.pool.Close()
+	if ctx.fakeIP != nil {
+		if err := ctx.fakeIP.Save(); err != nil {
+			log.Print(err)
+		}
+	}
+	running = <-ctx.running
+	ctx.running <- false
+	if !running {
+		log.Panic("Client is running, but status is false")
+	}
+	if strings.Index(err.Error(), "use of closed network connection") != -1 {
+		ctx.err <- nil
+	} else {
+		ctx.err <- err
+	}
+}
+
+// serve accepts the connections of l, and handles them with handle
+// in new goroutines, until l fails.
+func (ctx *ClientContext) serve(l net.Listener, handle func(net.Conn), res chan error) {
 	for {
 		FDAttain()
-		conn, err := ctx.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
 			FDRelease()
-			ctx.httpConnectionManager.Delete()
-			running = <-ctx.running
-			ctx.running <- false
-			if !running {
-				log.Panic("Client is running, but status is false")
-			}
-			if strings.Index(err.Error(), "use of closed network connection") != -1 {
-				ctx.err <- nil
-			} else {
-				ctx.err <- err
-			}
+			res <- err
 			return
 		}
-		go ctx.HandleConnection(conn)
+		go handle(conn)
+	}
+}
+
+func (ctx *ClientContext) closeListeners() {
+	if ctx.listener != nil {
+		ctx.listener.Close()
+	}
+	for _, t := range ctx.tunnels {
+		t.Close()
+	}
+	if ctx.dns != nil {
+		ctx.dns.Close()
+	}
+	if ctx.tproxy != nil {
+		ctx.tproxy.Close()
 	}
 }
 
@@ -102,7 +276,7 @@ func (ctx *ClientContext) Stop() {
 	if !running {
 		return
 	}
-	ctx.listener.Close()
+	ctx.closeListeners()
 }
 
 // Wait waits the client to stop and return its error
@@ -122,7 +296,7 @@ func (ctx *ClientContext) HandleConnection(conn net.Conn) {
 			log.Print(err)
 		}
 	}()
-	tconn := PlainConn{conn.(*net.TCPConn)}
+	tconn := PlainConn{TCPConn: conn.(*net.TCPConn)}
 	tconn.TCPConn.SetNoDelay(true)
 	tconn.TCPConn.SetKeepAlivePeriod(ctx.timeout)
 	tconn.TCPConn.SetKeepAlive(true)
@@ -150,13 +324,75 @@ func (ctx *ClientContext) HandleConnection(conn net.Conn) {
 	}
 }
 
-func (ctx *ClientContext) DialServer() (conn SSConn, err error) {
-	var rconn net.Conn
-	rconn, err = net.Dial("tcp", ctx.serverAddr)
-	if err != nil {
+// DialTarget connects to the target in the address header at the
+// beginning of buf, through the server or directly as decided by
+// the ACL. The header is kept in buf to be sent to the server, or
+// removed if connected directly.
+func (ctx *ClientContext) DialTarget(buf *SSBuffer) (conn SSConn, err error) {
+	if ctx.acl == nil {
+		return ctx.DialServer()
+	}
+	var addr string
+	var ln int
+	if addr, ln, err = ParseAddress(buf.buf); err != nil {
 		return
 	}
-	rconn.(*net.TCPConn).SetNoDelay(true)
-	conn = ctx.cipherFactory.Wrap(PlainConn{rconn.(*net.TCPConn)})
-	return
+	if len(buf.buf) < ln {
+		return nil, ERR_INVALID_ADDR
+	}
+	var host, sport string
+	if host, sport, err = net.SplitHostPort(addr); err != nil {
+		return
+	}
+	var port int
+	if port, err = strconv.Atoi(sport); err != nil {
+		return
+	}
+	switch ctx.acl.Match(host, uint16(port)) {
+	case ACL_DIRECT:
+		var rconn net.Conn
+		if rconn, err = net.DialTimeout("tcp", addr, ctx.connectTimeout); err != nil {
+			return
+		}
+		rconn.(*net.TCPConn).SetNoDelay(true)
+		copy(buf.buf, buf.buf[ln:])
+		buf.buf = buf.buf[:len(buf.buf)-ln]
+		return PlainConn{TCPConn: rconn.(*net.TCPConn)}, nil
+	case ACL_REJECT:
+		return nil, NewError(fmt.Sprintf("Connection to %s rejected by ACL", addr))
+	}
+	return ctx.DialServer()
+}
+
+// DialServer connects to one of the servers, failing over to the
+// others if it fails.
+func (ctx *ClientContext) DialServer() (SSConn, error) {
+	return ctx.pool.Dial(ctx.connectTimeout)
+}
+
+// Servers returns the pool of the servers of the client.
+func (ctx *ClientContext) Servers() *ServerPool {
+	return ctx.pool
+}
+
+// Subscription returns the subscription updating the servers, or nil
+// if the servers are not subscribed.
+func (ctx *ClientContext) Subscription() *Subscription {
+	return ctx.subscription
+}
+
+// FakeIP returns the fake IP pool of the client, or nil if disabled.
+func (ctx *ClientContext) FakeIP() *FakeIPPool {
+	return ctx.fakeIP
+}
+
+// DNS returns the DNS forwarder of the client, or nil if disabled.
+func (ctx *ClientContext) DNS() *DNSForwarder {
+	return ctx.dns
+}
+
+// HealthChecker returns the health checker of the servers, or nil if
+// health checks are disabled.
+func (ctx *ClientContext) HealthChecker() *HealthChecker {
+	return ctx.health
 }
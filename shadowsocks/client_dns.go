@@ -0,0 +1,531 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_DNS_REMOTE  = "8.8.8.8:53"
+	DEFAULT_DNS_TIMEOUT = 5 * time.Second
+	// Timeout of a query through the UDP relay of a server, after
+	// which it is queried over TCP in case the server relays no UDP
+	DNS_PACKET_TIMEOUT = 2 * time.Second
+	// Time the queries are sent over TCP to a server failing to relay
+	// them over UDP
+	DNS_PACKET_COOLDOWN = 10 * time.Minute
+)
+
+// DNS_CACHE_SIZE is the maximum number of answers cached.
+const DNS_CACHE_SIZE = 4096
+
+// dnsAddr appends the default port 53 to a resolver address without
+// a port.
+func dnsAddr(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+	}
+	return addr
+}
+
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// DNSCache caches DNS answers until their TTLs expire.
+type DNSCache struct {
+	lock    sync.Mutex
+	entries map[dnsCacheKey]*dnsCacheEntry
+}
+
+// NewDNSCache creates an empty DNS cache.
+func NewDNSCache() *DNSCache {
+	return &DNSCache{entries: map[dnsCacheKey]*dnsCacheEntry{}}
+}
+
+func newDNSCacheKey(q dnsmessage.Question) dnsCacheKey {
+	return dnsCacheKey{strings.ToLower(q.Name.String()), q.Type, q.Class}
+}
+
+// Get returns the cached answer of q with the id, and the TTLs
+// reduced by the time it has been cached, or nil.
+func (c *DNSCache) Get(q dnsmessage.Question, id uint16) []byte {
+	c.lock.Lock()
+	entry := c.entries[newDNSCacheKey(q)]
+	c.lock.Unlock()
+	now := time.Now()
+	if entry == nil || !now.Before(entry.expires) {
+		return nil
+	}
+	msg := entry.msg
+	msg.ID = id
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range []*[]dnsmessage.Resource{&msg.Answers, &msg.Authorities, &msg.Additionals} {
+		resources := make([]dnsmessage.Resource, len(*section))
+		for i, r := range *section {
+			if r.Header.Type != dnsmessage.TypeOPT {
+				if r.Header.TTL > elapsed {
+					r.Header.TTL -= elapsed
+				} else {
+					r.Header.TTL = 0
+				}
+			}
+			resources[i] = r
+		}
+		*section = resources
+	}
+	data, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// Put caches a response for the lowest TTL of its records. Only the
+// answers and the negative answers with an SOA record are cached.
+func (c *DNSCache) Put(resp []byte) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil || len(msg.Questions) != 1 || msg.Truncated {
+		return
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError {
+		return
+	}
+	var ttl uint32
+	found := false
+	for _, section := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities} {
+		for _, r := range section {
+			if r.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if !found || r.Header.TTL < ttl {
+				ttl = r.Header.TTL
+			}
+			found = true
+		}
+	}
+	if !found || ttl == 0 {
+		return
+	}
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) >= DNS_CACHE_SIZE {
+		for key, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, key)
+			}
+		}
+		if len(c.entries) >= DNS_CACHE_SIZE {
+			c.entries = map[dnsCacheKey]*dnsCacheEntry{}
+		}
+	}
+	c.entries[newDNSCacheKey(msg.Questions[0])] = &dnsCacheEntry{
+		msg:     msg,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// Len returns the number of answers cached.
+func (c *DNSCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
+
+// DNSForwarder is a local DNS server on both UDP and TCP, which
+// forwards the queries to a remote resolver through the servers,
+// over UDP if a server relays UDP and over TCP otherwise, or if the
+// server fails to relay the queries over UDP. The queries
+// of the local domains are sent to a local resolver directly. With a
+// fake IP pool, the other domains are answered with fake addresses.
+type DNSForwarder struct {
+	pool           *ServerPool
+	remote         string
+	header         []byte // address header of the remote resolver
+	local          string
+	localDomains   []string
+	cache          *DNSCache
+	fakeIP         *FakeIPPool
+	udp            *net.UDPConn
+	tcp            net.Listener
+	connectTimeout time.Duration
+	timeout        time.Duration
+	packetTimeout  time.Duration
+	lock           sync.Mutex
+	packetDown     map[*Upstream]time.Time // servers failing to relay UDP
+}
+
+// NewDNSForwarder creates a DNS forwarder listening on addr. The local
+// domains include their subdomains. fakeIP may be nil to forward all
+// the queries.
+func NewDNSForwarder(addr string, pool *ServerPool, remote, local string, localDomains []string, fakeIP *FakeIPPool, connectTimeout time.Duration) (f *DNSForwarder, err error) {
+	if remote == "" {
+		remote = DEFAULT_DNS_REMOTE
+	}
+	f = &DNSForwarder{
+		pool:           pool,
+		remote:         dnsAddr(remote),
+		cache:          NewDNSCache(),
+		fakeIP:         fakeIP,
+		connectTimeout: connectTimeout,
+		timeout:        DEFAULT_DNS_TIMEOUT,
+		packetTimeout:  DNS_PACKET_TIMEOUT,
+		packetDown:     map[*Upstream]time.Time{},
+	}
+	var host string
+	var port uint16
+	if host, port, err = UnwrapAddr(f.remote); err != nil {
+		return nil, fmt.Errorf("Invalid DNS resolver address: %s", remote)
+	}
+	if f.header, err = AppendAddress(nil, host, port); err != nil {
+		return
+	}
+	if local != "" {
+		f.local = dnsAddr(local)
+		for _, domain := range localDomains {
+			f.localDomains = append(f.localDomains, strings.ToLower(strings.Trim(domain, ".")))
+		}
+	}
+	var uaddr *net.UDPAddr
+	if uaddr, err = net.ResolveUDPAddr("udp", addr); err != nil {
+		return
+	}
+	if f.udp, err = net.ListenUDP("udp", uaddr); err != nil {
+		return
+	}
+	if f.tcp, err = net.Listen("tcp", addr); err != nil {
+		f.udp.Close()
+		return
+	}
+	return
+}
+
+// Cache returns the cache of the answers.
+func (f *DNSForwarder) Cache() *DNSCache {
+	return f.cache
+}
+
+// Close closes the listeners.
+func (f *DNSForwarder) Close() {
+	f.udp.Close()
+	f.tcp.Close()
+}
+
+// isLocal checks whether name is resolved by the local resolver.
+func (f *DNSForwarder) isLocal(name string) bool {
+	if f.local == "" {
+		return false
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, domain := range f.localDomains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve answers a query, from the cache or from the resolver. The
+// truncated answers are queried again over TCP.
+func (f *DNSForwarder) Resolve(query []byte) (resp []byte, err error) {
+	return f.resolve(query, true)
+}
+
+// resolve answers a query, and queries the truncated answers again
+// over TCP if stream is set, or returns them to the clients over UDP
+// to retry over TCP otherwise.
+func (f *DNSForwarder) resolve(query []byte, stream bool) (resp []byte, err error) {
+	var p dnsmessage.Parser
+	var header dnsmessage.Header
+	if header, err = p.Start(query); err != nil {
+		return
+	}
+	var q dnsmessage.Question
+	if q, err = p.Question(); err != nil {
+		return
+	}
+	local := f.isLocal(q.Name.String())
+	if f.fakeIP != nil && !local && q.Class == dnsmessage.ClassINET &&
+		(q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA) {
+		return f.fakeIP.Answer(header, q)
+	}
+	if resp = f.cache.Get(q, header.ID); resp != nil {
+		return
+	}
+	if local {
+		resp, err = f.exchangeLocal(query, stream)
+	} else if up := f.pickPacket(); up != nil {
+		resp, err = f.exchangePacket(up, query)
+		if err != nil {
+			// the server may relay no UDP, which times out or is
+			// refused
+			if resp, err = f.exchangeStream(query); err == nil {
+				log.Printf("DNS queries are sent over TCP to server %s failing to relay UDP", up.Name)
+				f.lock.Lock()
+				f.packetDown[up] = time.Now().Add(DNS_PACKET_COOLDOWN)
+				f.lock.Unlock()
+			}
+		} else if err == nil && stream && len(resp) > 2 && resp[2]&0x02 != 0 { // truncated
+			resp, err = f.exchangeStream(query)
+		}
+	} else {
+		resp, err = f.exchangeStream(query)
+	}
+	if err != nil {
+		return
+	}
+	f.cache.Put(resp)
+	return
+}
+
+// pickPacket chooses a server relaying UDP, except those failing to
+// relay the queries, or returns nil.
+func (f *DNSForwarder) pickPacket() *Upstream {
+	tried := map[*Upstream]bool{}
+	now := time.Now()
+	f.lock.Lock()
+	for _, u := range f.pool.Servers() {
+		if u.udpCipher == nil {
+			tried[u] = true
+		} else if until, ok := f.packetDown[u]; ok {
+			if now.Before(until) {
+				tried[u] = true
+			} else {
+				delete(f.packetDown, u)
+			}
+		}
+	}
+	f.lock.Unlock()
+	return f.pool.Pick(tried)
+}
+
+// exchangePacket sends a query to the remote resolver through the UDP
+// relay of up.
+func (f *DNSForwarder) exchangePacket(up *Upstream, query []byte) (resp []byte, err error) {
+	var saddr *net.UDPAddr
+	if saddr, err = up.UDPAddr(); err != nil {
+		return
+	}
+	var cipher PacketCipher
+	if cipher, err = NewPacketSession(up.udpCipher); err != nil {
+		return
+	}
+	var conn *net.UDPConn
+	if conn, err = net.DialUDP("udp", nil, saddr); err != nil {
+		return
+	}
+	defer conn.Close()
+	plain := append(append(make([]byte, 0, len(f.header)+len(query)), f.header...), query...)
+	var pkt []byte
+	if pkt, err = cipher.SealPacket(nil, plain); err != nil {
+		return
+	}
+	if _, err = conn.Write(pkt); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(f.packetTimeout))
+	buf := make([]byte, MAX_UDP_PACKET_SIZE)
+	for {
+		var n int
+		if n, err = conn.Read(buf); err != nil {
+			return
+		}
+		if plain, err = cipher.OpenPacket(nil, buf[:n]); err != nil {
+			continue
+		}
+		_, ln, err := ParseAddress(plain)
+		if err != nil || len(plain) < ln+2 {
+			continue
+		}
+		if resp = plain[ln:]; resp[0] == query[0] && resp[1] == query[1] {
+			return resp, nil
+		}
+	}
+}
+
+// exchangeStream sends a query to the remote resolver over TCP
+// through a server.
+func (f *DNSForwarder) exchangeStream(query []byte) (resp []byte, err error) {
+	var conn SSConn
+	if conn, err = f.pool.Dial(f.connectTimeout); err != nil {
+		return
+	}
+	defer conn.Close()
+	timer := time.AfterFunc(f.timeout, func() { conn.Close() })
+	defer timer.Stop()
+	buf := NewBuffer()
+	buf.buf = append(buf.buf[:0], f.header...)
+	buf.buf = append(buf.buf, byte(len(query)>>8), byte(len(query)))
+	buf.buf = append(buf.buf, query...)
+	if err = conn.SSWrite(buf); err != nil {
+		return
+	}
+	for len(buf.buf) < 2 || len(buf.buf) < 2+int(binary.BigEndian.Uint16(buf.buf)) {
+		if err = conn.SSRead(buf); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+	}
+	return buf.buf[2 : 2+int(binary.BigEndian.Uint16(buf.buf))], nil
+}
+
+// exchangeLocal sends a query to the local resolver directly, over
+// UDP and then TCP if the answer is truncated and stream is set.
+func (f *DNSForwarder) exchangeLocal(query []byte, stream bool) (resp []byte, err error) {
+	var conn net.Conn
+	if conn, err = net.DialTimeout("udp", f.local, f.timeout); err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(f.timeout))
+	if _, err = conn.Write(query); err != nil {
+		return
+	}
+	buf := make([]byte, MAX_UDP_PACKET_SIZE)
+	for {
+		var n int
+		if n, err = conn.Read(buf); err != nil {
+			return
+		}
+		if n > 2 && buf[0] == query[0] && buf[1] == query[1] {
+			resp = buf[:n]
+			break
+		}
+	}
+	if !stream || resp[2]&0x02 == 0 {
+		return
+	}
+	var tconn net.Conn
+	if tconn, err = net.DialTimeout("tcp", f.local, f.timeout); err != nil {
+		return
+	}
+	defer tconn.Close()
+	tconn.SetDeadline(time.Now().Add(f.timeout))
+	if err = writeDNSStream(tconn, query); err != nil {
+		return
+	}
+	return readDNSStream(tconn)
+}
+
+// writeDNSStream writes a DNS message prefixed by its length.
+func writeDNSStream(w io.Writer, msg []byte) error {
+	_, err := w.Write(append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...))
+	return err
+}
+
+// readDNSStream reads a DNS message prefixed by its length.
+func readDNSStream(r io.Reader) (msg []byte, err error) {
+	var size [2]byte
+	if _, err = io.ReadFull(r, size[:]); err != nil {
+		return
+	}
+	msg = make([]byte, binary.BigEndian.Uint16(size[:]))
+	_, err = io.ReadFull(r, msg)
+	return
+}
+
+// dnsFailure builds the SERVFAIL response of a query.
+func dnsFailure(query []byte) []byte {
+	return dnsEmptyResponse(query, dnsmessage.RCodeServerFailure, false)
+}
+
+// dnsEmptyResponse builds a response of a query without records.
+func dnsEmptyResponse(query []byte, rcode dnsmessage.RCode, truncated bool) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil
+	}
+	header.Response = true
+	header.Truncated = truncated
+	header.RCode = rcode
+	resp, _ := (&dnsmessage.Message{Header: header, Questions: questions}).Pack()
+	return resp
+}
+
+// dnsUDPSize returns the maximum size of the responses over UDP
+// advertised by a query with EDNS, or 512 bytes without.
+func dnsUDPSize(query []byte) int {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err == nil {
+		for _, r := range msg.Additionals {
+			if r.Header.Type == dnsmessage.TypeOPT && int(r.Header.Class) > 512 {
+				return int(r.Header.Class)
+			}
+		}
+	}
+	return 512
+}
+
+func (f *DNSForwarder) answer(query []byte, client string, stream bool) []byte {
+	resp, err := f.resolve(query, stream)
+	if err != nil {
+		log.Printf("Failed to resolve the DNS query of %s: %v", client, err)
+		return dnsFailure(query)
+	}
+	return resp
+}
+
+// serveUDP answers the queries received over UDP.
+func (f *DNSForwarder) serveUDP() {
+	buf := make([]byte, MAX_UDP_PACKET_SIZE)
+	for {
+		n, caddr, err := f.udp.ReadFromUDP(buf)
+		if err != nil {
+			if !isClosedError(err) {
+				log.Print(err)
+			}
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp := f.answer(query, caddr.String(), false)
+			if len(resp) > dnsUDPSize(query) { // to be retried over TCP
+				resp = dnsEmptyResponse(query, dnsmessage.RCodeSuccess, true)
+			}
+			if resp != nil {
+				f.udp.WriteToUDP(resp, caddr)
+			}
+		}()
+	}
+}
+
+// HandleConnection answers the queries of a TCP connection.
+func (f *DNSForwarder) HandleConnection(conn net.Conn) {
+	defer FDRelease()
+	defer conn.Close()
+	for {
+		conn.SetDeadline(time.Now().Add(f.timeout + f.connectTimeout))
+		query, err := readDNSStream(conn)
+		if err != nil {
+			return
+		}
+		resp := f.answer(query, conn.RemoteAddr().String(), true)
+		if resp == nil || writeDNSStream(conn, resp) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package shadowsocks
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDNS answers every A query with ip over both UDP and TCP, and
+// counts the queries. The answers of the names starting with
+// "truncated." are truncated over UDP.
+type fakeDNS struct {
+	udp        *net.UDPConn
+	tcp        net.Listener
+	ip         [4]byte
+	udpQueries int32
+	tcpQueries int32
+}
+
+func startFakeDNS(t *testing.T, ip [4]byte) *fakeDNS {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeDNS{udp: udp, tcp: tcp, ip: ip}
+	go func() {
+		buf := make([]byte, MAX_UDP_PACKET_SIZE)
+		for {
+			n, addr, err := udp.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.udpQueries, 1)
+			udp.WriteToUDP(s.answer(buf[:n], true), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					query, err := readDNSStream(conn)
+					if err != nil {
+						return
+					}
+					atomic.AddInt32(&s.tcpQueries, 1)
+					writeDNSStream(conn, s.answer(query, false))
+				}
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *fakeDNS) Addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *fakeDNS) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+func (s *fakeDNS) answer(query []byte, udp bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil
+	}
+	msg.Response = true
+	for _, q := range msg.Questions {
+		if udp && strings.HasPrefix(q.Name.String(), "truncated.") {
+			msg.Truncated = true
+			break
+		}
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{A: s.ip},
+		})
+	}
+	resp, _ := msg.Pack()
+	return resp
+}
+
+func newDNSQuery(t *testing.T, id uint16, name string) []byte {
+	query, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET},
+		},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func checkDNSAnswer(t *testing.T, resp []byte, id uint16, ip [4]byte) uint32 {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != id || len(msg.Answers) != 1 {
+		t.Fatalf("Wrong DNS answer: %+v", msg)
+	}
+	if a, ok := msg.Answers[0].Body.(*dnsmessage.AResource); !ok || a.A != ip {
+		t.Fatal("Wrong DNS answer:", msg.Answers[0].Body)
+	}
+	return msg.Answers[0].Header.TTL
+}
+
+func TestDNSForwarder(t *testing.T) {
+	remote := startFakeDNS(t, [4]byte{1, 2, 3, 4})
+	defer remote.Close()
+	local := startFakeDNS(t, [4]byte{192, 168, 1, 1})
+	defer local.Close()
+
+	serverConfig, clientConfig := testConfigs(7150, "dns")
+	_, stopServer := startServer(t, serverConfig)
+	defer stopServer()
+
+	clientConfig.LocalPort = 6150
+	clientConfig.DNSListen = "127.0.0.1:6151"
+	clientConfig.DNSRemote = remote.Addr()
+	clientConfig.DNSLocal = local.Addr()
+	clientConfig.DNSLocalDomains = []string{"lan"}
+	client, stopClient := startClient(t, clientConfig)
+	defer stopClient()
+
+	conn, err := net.Dial("udp", "127.0.0.1:6151")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	exchange := func(query []byte) []byte {
+		if _, err := conn.Write(query); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, MAX_UDP_PACKET_SIZE)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	// resolved through the UDP relay of the server, then cached
+	checkDNSAnswer(t, exchange(newDNSQuery(t, 1, "example.com.")), 1, remote.ip)
+	if ttl := checkDNSAnswer(t, exchange(newDNSQuery(t, 2, "Example.COM.")), 2, remote.ip); ttl > 60 {
+		t.Fatal("Wrong cached TTL:", ttl)
+	}
+	if n := atomic.LoadInt32(&remote.udpQueries); n != 1 {
+		t.Fatal("Wrong number of remote queries:", n)
+	}
+
+	// resolved by the local resolver
+	checkDNSAnswer(t, exchange(newDNSQuery(t, 3, "nas.lan.")), 3, local.ip)
+	if n := atomic.LoadInt32(&local.udpQueries); n != 1 {
+		t.Fatal("Wrong number of local queries:", n)
+	}
+
+	// queried over TCP
+	tconn, err := net.Dial("tcp", "127.0.0.1:6151")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tconn.Close()
+	tconn.SetDeadline(time.Now().Add(time.Second))
+	if err = writeDNSStream(tconn, newDNSQuery(t, 4, "example.org.")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := readDNSStream(tconn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDNSAnswer(t, resp, 4, remote.ip)
+
+	// resolved over TCP through a client without UDP relay
+	tcpConfig := clientConfig
+	tcpConfig.KeyDeriver = NewKeyDeriver([]byte("dns"))
+	tcpConfig.UDPRelay = false
+	tcpConfig.LocalPort = 6152
+	tcpConfig.DNSListen = "127.0.0.1:6153"
+	tcpClient, stopTCPClient := startClient(t, tcpConfig)
+	defer stopTCPClient()
+	if resp, err = tcpClient.DNS().Resolve(newDNSQuery(t, 5, "example.net.")); err != nil {
+		t.Fatal(err)
+	}
+	checkDNSAnswer(t, resp, 5, remote.ip)
+	if n := atomic.LoadInt32(&remote.tcpQueries); n != 1 {
+		t.Fatal("Wrong number of remote TCP queries:", n)
+	}
+	if n := client.DNS().Cache().Len(); n != 3 {
+		t.Fatal("Wrong number of cached answers:", n)
+	}
+
+	// truncated answers are returned to UDP clients to retry over TCP
+	var msg dnsmessage.Message
+	if err = msg.Unpack(exchange(newDNSQuery(t, 6, "truncated.example.com."))); err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Truncated || len(msg.Answers) != 0 {
+		t.Fatalf("Wrong truncated answer: %+v", msg)
+	}
+	if n := atomic.LoadInt32(&remote.tcpQueries); n != 1 {
+		t.Fatal("Wrong number of remote TCP queries:", n)
+	}
+	if err = writeDNSStream(tconn, newDNSQuery(t, 7, "truncated.example.com.")); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = readDNSStream(tconn); err != nil {
+		t.Fatal(err)
+	}
+	checkDNSAnswer(t, resp, 7, remote.ip)
+}
+
+func TestDNSForwarderWithoutUDPRelay(t *testing.T) {
+	remote := startFakeDNS(t, [4]byte{1, 2, 3, 4})
+	defer remote.Close()
+
+	serverConfig, clientConfig := testConfigs(7180, "dns")
+	serverConfig.UDPRelay = false
+	_, stopServer := startServer(t, serverConfig)
+	defer stopServer()
+
+	clientConfig.LocalPort = 6180
+	clientConfig.DNSListen = "127.0.0.1:6181"
+	clientConfig.DNSRemote = remote.Addr()
+	client, stopClient := startClient(t, clientConfig)
+	defer stopClient()
+	client.DNS().packetTimeout = 100 * time.Millisecond
+
+	// queried over TCP after the UDP relay times out, then over TCP
+	// directly
+	for i, name := range []string{"example.com.", "example.org."} {
+		resp, err := client.DNS().Resolve(newDNSQuery(t, uint16(i), name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkDNSAnswer(t, resp, uint16(i), remote.ip)
+	}
+	if n := atomic.LoadInt32(&remote.tcpQueries); n != 2 {
+		t.Fatal("Wrong number of remote TCP queries:", n)
+	}
+	if up := client.DNS().pickPacket(); up != nil {
+		t.Fatal("Server failing to relay UDP is picked:", up.Name)
+	}
+}
@@ -0,0 +1,263 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_HEALTH_INTERVAL = time.Minute
+	DEFAULT_HEALTH_TIMEOUT  = 5 * time.Second
+	HEALTH_HISTORY_SIZE     = 32
+)
+
+// HealthProbe is the target requested through each server to check
+// its health. An HTTP probe sends a HEAD request and expects an HTTP
+// response. A TCP probe sends nothing and expects the first byte of
+// the target, so it needs a target speaking first, like an SSH or an
+// SMTP server.
+type HealthProbe struct {
+	host    string
+	port    uint16
+	request []byte // nil for TCP probes
+}
+
+// ParseHealthProbe parses an HTTP URL like
+// "http://www.gstatic.com/generate_204" for an HTTP probe, or an
+// address like "example.com:22" for a TCP probe.
+func ParseHealthProbe(s string) (p *HealthProbe, err error) {
+	if !strings.Contains(s, "://") {
+		p = &HealthProbe{}
+		p.host, p.port, err = UnwrapAddr(s)
+		return
+	}
+	var u *url.URL
+	if u, err = url.Parse(s); err != nil {
+		return
+	}
+	if u.Scheme != "http" {
+		return nil, fmt.Errorf("Unsupported probe scheme: %s", u.Scheme)
+	}
+	p = &HealthProbe{host: u.Hostname(), port: 80}
+	if u.Port() != "" {
+		var port uint64
+		if port, err = strconv.ParseUint(u.Port(), 10, 16); err != nil {
+			return nil, err
+		}
+		p.port = uint16(port)
+	}
+	p.request = []byte(fmt.Sprintf("HEAD %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", u.RequestURI(), u.Host))
+	return
+}
+
+// HealthResult is the result of a health check. The latencies are
+// in nanoseconds in JSON.
+type HealthResult struct {
+	Time    time.Time `json:"time"`
+	Healthy bool      `json:"healthy"`
+	// Time to connect the server
+	Handshake time.Duration `json:"handshake"`
+	// Time from sending the request to receiving the first byte of
+	// the response, 0 if nothing is received
+	FirstByte time.Duration `json:"first_byte"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// Check checks the health of server u through the probe.
+func (p *HealthProbe) Check(u *Upstream, timeout time.Duration) (r HealthResult) {
+	r.Time = time.Now()
+	err := p.check(u, timeout, &r)
+	if err != nil {
+		r.Error = err.Error()
+	} else {
+		r.Healthy = true
+	}
+	return
+}
+
+func (p *HealthProbe) check(u *Upstream, timeout time.Duration, r *HealthResult) (err error) {
+	var rconn net.Conn
+	if rconn, err = net.DialTimeout("tcp", u.dialAddr, timeout); err != nil {
+		return
+	}
+	defer rconn.Close()
+	r.Handshake = time.Since(r.Time)
+	tcpConn := rconn.(*net.TCPConn)
+	tcpConn.SetDeadline(r.Time.Add(timeout))
+	conn := u.cipherFactory.Wrap(PlainConn{TCPConn: tcpConn})
+
+	buf := NewBuffer()
+	if buf.buf, err = AppendAddress(buf.buf, p.host, p.port); err != nil {
+		return
+	}
+	buf.buf = append(buf.buf, p.request...)
+	sent := time.Now()
+	if err = conn.SSWrite(buf); err != nil {
+		return
+	}
+	for len(buf.buf) < len("HTTP/") && err == nil {
+		err = conn.SSRead(buf)
+		if len(buf.buf) > 0 && r.FirstByte == 0 {
+			r.FirstByte = time.Since(sent)
+			if p.request == nil {
+				return nil
+			}
+		}
+	}
+	if len(buf.buf) < len("HTTP/") {
+		return
+	}
+	if !bytes.HasPrefix(buf.buf, []byte("HTTP/")) {
+		return NewError("Invalid HTTP response")
+	}
+	return nil
+}
+
+// Health returns the latest results of the health checks of the
+// server, the oldest first.
+func (u *Upstream) Health() []HealthResult {
+	u.healthLock.Lock()
+	defer u.healthLock.Unlock()
+	return append([]HealthResult(nil), u.health...)
+}
+
+func (u *Upstream) addHealth(r HealthResult) {
+	u.healthLock.Lock()
+	defer u.healthLock.Unlock()
+	if len(u.health) >= HEALTH_HISTORY_SIZE {
+		u.health = append(u.health[:0], u.health[1:]...)
+	}
+	u.health = append(u.health, r)
+}
+
+// HealthChecker checks the health of the servers of a pool
+// periodically, marking the servers failing the check down, and the
+// others up.
+type HealthChecker struct {
+	pool     *ServerPool
+	probe    *HealthProbe
+	interval time.Duration
+	timeout  time.Duration
+	lock     sync.Mutex
+	stop     chan bool
+}
+
+// NewHealthChecker creates a health checker of the servers in pool.
+func NewHealthChecker(pool *ServerPool, probe *HealthProbe, interval, timeout time.Duration) *HealthChecker {
+	if interval <= 0 {
+		interval = DEFAULT_HEALTH_INTERVAL
+	}
+	if timeout <= 0 {
+		timeout = DEFAULT_HEALTH_TIMEOUT
+	}
+	return &HealthChecker{pool: pool, probe: probe, interval: interval, timeout: timeout}
+}
+
+// Start starts checking in a new goroutine.
+func (h *HealthChecker) Start() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.stop != nil {
+		return
+	}
+	h.stop = make(chan bool)
+	go h.run(h.stop)
+}
+
+// Stop stops checking.
+func (h *HealthChecker) Stop() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+}
+
+func (h *HealthChecker) run(stop chan bool) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		h.CheckAll()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAll checks all the servers at once, and waits for the results.
+func (h *HealthChecker) CheckAll() {
+	var wg sync.WaitGroup
+	for _, u := range h.pool.Servers() {
+		wg.Add(1)
+		go func(u *Upstream) {
+			defer wg.Done()
+			h.Check(u)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// Check checks the health of server u, and records the result.
+func (h *HealthChecker) Check(u *Upstream) HealthResult {
+	r := h.probe.Check(u, h.timeout)
+	u.addHealth(r)
+	// only the changes are logged
+	if r.Healthy {
+		u.updateLatency(r.Handshake)
+		if u.Down() {
+			log.Printf("Server %s is healthy: handshake %v, first byte %v", u.Name, r.Handshake, r.FirstByte)
+		}
+		u.MarkUp()
+	} else {
+		if !u.Down() {
+			log.Printf("Server %s is unhealthy: %s", u.Name, r.Error)
+		}
+		u.MarkDown(h.pool.cooldown)
+	}
+	return r
+}
+
+// ServerHealth is the status of a server.
+type ServerHealth struct {
+	Name    string         `json:"name"`
+	Addr    string         `json:"addr"`
+	Down    bool           `json:"down"`
+	Active  int64          `json:"active"`
+	Latency time.Duration  `json:"latency"`
+	History []HealthResult `json:"history"`
+}
+
+// Health returns the status of the servers.
+func (p *ServerPool) Health() []ServerHealth {
+	servers := p.Servers()
+	res := make([]ServerHealth, len(servers))
+	for i, u := range servers {
+		res[i] = ServerHealth{
+			Name:    u.Name,
+			Addr:    u.addr,
+			Down:    u.Down(),
+			Active:  u.Active(),
+			Latency: u.Latency(),
+			History: u.Health(),
+		}
+	}
+	return res
+}
+
+// ServeHTTP serves the status of the servers in JSON.
+func (p *ServerPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.Health())
+}
@@ -0,0 +1,101 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	serverConfig, _ := testConfigs(7110, "health")
+	_, stopServer := startServer(t, serverConfig)
+	defer stopServer()
+
+	newUpstream := func(port uint16, password string) *Upstream {
+		u, err := NewUpstream(ServerConfig{
+			Host:       "127.0.0.1",
+			Port:       port,
+			Method:     serverConfig.Method,
+			KeyDeriver: NewKeyDeriver([]byte(password)),
+		}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	alive := newUpstream(7110, "health")
+	wrongKey := newUpstream(7110, "wrong")
+	dead := newUpstream(7111, "health") // no server is running on 7111
+	pool := NewServerPool([]*Upstream{alive, wrongKey, dead}, BALANCE_ROUND_ROBIN, time.Minute)
+
+	// a target speaking first for TCP probes
+	greeter, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer greeter.Close()
+	go func() {
+		for {
+			conn, err := greeter.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("SSH-2.0-Test\r\n"))
+			conn.Close()
+		}
+	}()
+
+	for _, c := range []struct {
+		probe   string
+		healthy []bool
+	}{
+		{"http://127.0.0.1:8000/hello", []bool{true, false, false}},
+		{greeter.Addr().String(), []bool{true, false, false}},
+		{"127.0.0.1:8000", []bool{false, false, false}}, // silent targets fail TCP probes
+		{"127.0.0.1:1", []bool{false, false, false}},
+	} {
+		probe, err := ParseHealthProbe(c.probe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checker := NewHealthChecker(pool, probe, time.Minute, 500*time.Millisecond)
+		for i, u := range pool.Servers() {
+			r := checker.Check(u)
+			if r.Healthy != c.healthy[i] {
+				t.Fatal("Wrong health of", c.probe, "through", i, r.Error)
+			}
+			if u.Down() == r.Healthy {
+				t.Fatal("Server is not marked by the health of", c.probe, "through", i)
+			}
+			if r.Healthy && r.Handshake == 0 {
+				t.Fatal("Handshake latency is not measured")
+			}
+		}
+	}
+	if r := alive.Health()[0]; r.FirstByte == 0 {
+		t.Fatal("First byte latency is not measured")
+	}
+	if r := alive.Health()[1]; !r.Healthy || r.FirstByte == 0 {
+		t.Fatal("First byte latency of the TCP probe is not measured")
+	}
+	if len(alive.Health()) != 4 {
+		t.Fatal("Wrong history size:", len(alive.Health()))
+	}
+
+	recorder := httptest.NewRecorder()
+	pool.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	var status []ServerHealth
+	if err = json.Unmarshal(recorder.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	// the last probe fails through all the servers
+	if len(status) != 3 || !status[0].Down || !status[1].Down || !status[2].Down || len(status[0].History) != 4 {
+		t.Fatal("Wrong health status:", recorder.Body.String())
+	}
+
+	if _, err = ParseHealthProbe("https://example.com/"); err == nil {
+		t.Fatal("Unsupported probe is parsed")
+	}
+}
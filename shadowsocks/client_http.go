@@ -90,7 +90,7 @@ func (ctx *ClientContext) HandleHTTP(tconn SSConn, buf *SSBuffer) (err error) {
 			}
 
 			var wrconn SSConn
-			wrconn, err = ctx.DialServer()
+			wrconn, err = ctx.DialTarget(buf)
 			if err != nil {
 				return
 			}
@@ -119,14 +119,17 @@ loop:
 				binary.Write(bytes.NewBuffer(b[:2+len(host)]), binary.BigEndian, &port)
 
 				var wtrconn SSConn
-				wtrconn, err = m.ctx.DialServer()
+				hbuf := &SSBuffer{buf: b}
+				wtrconn, err = m.ctx.DialTarget(hbuf)
 				if err != nil {
 					m.err <- err
 					continue
 				}
-				dwtrconn := NewDelayInitConn(wtrconn, b)
+				if len(hbuf.buf) > 0 { // the header is to be sent to the server
+					wtrconn = NewDelayInitConn(wtrconn, hbuf.buf)
+				}
 				m.res <- &HTTPConnCtx{
-					conn: dwtrconn,
+					conn: wtrconn,
 					addr: addr,
 				}
 			} else {
@@ -3,7 +3,6 @@
 package shadowsocks
 
 import (
-	"bytes"
 	"encoding/binary"
 	"net"
 	"syscall"
@@ -68,23 +67,18 @@ func DetectRedir(tconn SSConn) bool {
 	return true
 }
 
+// HandleRedir forwards a connection redirected by iptables to its
+// original destination, or to the domain mapped to it if it is a fake
+// address, or to the host name sniffed from its first bytes.
 func (ctx *ClientContext) HandleRedir(tconn SSConn, buf *SSBuffer) (err error) {
 	rbuf := NewBuffer()
 	addr, _ := getOrigAddr(tconn.(PlainConn).TCPConn)
-	if bytes.Equal(addr.IP[:12], v4InV6Prefix) {
-		buf.buf = buf.buf[:7]
-		buf.buf[0] = 0x01
-		copy(buf.buf[1:5], addr.IP[12:])
-		binary.BigEndian.PutUint16(buf.buf[5:], uint16(addr.Port))
-	} else {
-		buf.buf = buf.buf[:19]
-		buf.buf[0] = 0x04
-		copy(buf.buf[1:17], addr.IP[:])
-		binary.BigEndian.PutUint16(buf.buf[17:], uint16(addr.Port))
+	if err = ctx.transparentTarget(tconn.(PlainConn), addr, buf); err != nil {
+		return
 	}
 
 	var wrconn SSConn
-	wrconn, err = ctx.DialServer()
+	wrconn, err = ctx.DialTarget(buf)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,429 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_SERVER_COOLDOWN = 30 * time.Second
+
+// MAX_SERVER_FAILURES is the number of consecutive connections
+// failing before any reply, after which a server is marked down.
+// A single failure may be caused by the target rather than by the
+// server.
+const MAX_SERVER_FAILURES = 3
+
+// SERVER_RESOLVE_INTERVAL is how long the resolved UDP address of a
+// server is reused before resolving its host again.
+const SERVER_RESOLVE_INTERVAL = time.Minute
+
+// ServerConfig is an upstream server of a client.
+type ServerConfig struct {
+	// Name of the server, used in logs
+	Name string
+	// Server address
+	Host string
+	// Server port
+	Port uint16
+	// Encryption method
+	Method string
+	// Key generator
+	KeyDeriver io.Reader
+	// SIP003 plugin executable and its options
+	Plugin     string
+	PluginOpts string
+}
+
+// BalanceStrategy is how a client chooses among its servers.
+type BalanceStrategy int
+
+const (
+	// Use the servers in turn
+	BALANCE_ROUND_ROBIN BalanceStrategy = iota
+	// Use the server with the fewest alive connections
+	BALANCE_LEAST_CONNS
+	// Use the server with the lowest connection latency, among those
+	// without plugins if any is up
+	BALANCE_LOWEST_LATENCY
+)
+
+var balanceStrategyNames = map[BalanceStrategy]string{
+	BALANCE_ROUND_ROBIN:    "round-robin",
+	BALANCE_LEAST_CONNS:    "least-connections",
+	BALANCE_LOWEST_LATENCY: "lowest-latency",
+}
+
+func (s BalanceStrategy) String() string {
+	if name, ok := balanceStrategyNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("BalanceStrategy(%d)", int(s))
+}
+
+// ParseBalanceStrategy parses "round-robin", "least-connections" or
+// "lowest-latency".
+func ParseBalanceStrategy(name string) (BalanceStrategy, error) {
+	for s, n := range balanceStrategyNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	return BALANCE_ROUND_ROBIN, fmt.Errorf("Unknown balance strategy: %s", name)
+}
+
+// Upstream is a server used by a client, with its state.
+type Upstream struct {
+	Name          string
+	addr          string
+	dialAddr      string // the plugin address if the server has a plugin
+	plugin        *Plugin
+	cipherFactory CipherFactory
+	udpCipher     PacketCipher
+	active        int64 // alive connections
+	released      int32 // 1 if the server is no longer used
+	latency       int64 // smoothed connection latency in nanoseconds, 0 if unknown or through a plugin
+	downUntil     int64 // unix nanoseconds
+	failures      int32 // consecutive connections failing before any reply
+	healthLock    sync.Mutex
+	health        []HealthResult // latest results of health checks
+	udpLock       sync.Mutex
+	udpAddr       *net.UDPAddr // resolved addr, for relaying UDP
+	udpResolved   time.Time
+}
+
+// NewUpstream creates an upstream server, relaying UDP packets if
+// udpRelay is set and the cipher supports it.
+func NewUpstream(config ServerConfig, udpRelay bool) (u *Upstream, err error) {
+	cipherInfo, ok := Ciphers[config.Method]
+	if !ok {
+		return nil, fmt.Errorf("Unknown cipher: %s", config.Method)
+	}
+	key := make([]byte, cipherInfo.keySize)
+	var n int
+	if n, err = config.KeyDeriver.Read(key); err != nil {
+		return
+	}
+	if n < cipherInfo.keySize {
+		return nil, fmt.Errorf("Insufficient key size")
+	}
+	u = &Upstream{
+		Name:          config.Name,
+		addr:          WrapAddr(config.Host, config.Port),
+		cipherFactory: cipherInfo.newFactory(key),
+	}
+	u.dialAddr = u.addr
+	if u.Name == "" {
+		u.Name = u.addr
+	}
+	if udpRelay {
+		u.udpCipher, _ = u.cipherFactory.(PacketCipher)
+	}
+	if config.Plugin != "" {
+		var port uint16
+		if port, err = FreePort("127.0.0.1"); err != nil {
+			return nil, err
+		}
+		u.plugin = NewPlugin(config.Plugin, config.PluginOpts, config.Host, config.Port, "127.0.0.1", port)
+		if err = u.plugin.Start(); err != nil {
+			return nil, err
+		}
+		u.dialAddr = u.plugin.LocalAddr()
+	}
+	return
+}
+
+// Close stops the plugin of the server, if any.
+func (u *Upstream) Close() {
+	if u.plugin != nil {
+		u.plugin.Stop()
+	}
+}
+
+// Release closes the server once its alive connections are closed,
+// for a server no longer used, so that the connections through its
+// plugin are not dropped.
+func (u *Upstream) Release() {
+	atomic.StoreInt32(&u.released, 1)
+	if atomic.LoadInt64(&u.active) == 0 {
+		u.Close()
+	}
+}
+
+// Addr returns the address of the server.
+func (u *Upstream) Addr() string {
+	return u.addr
+}
+
+// UDPAddr returns the resolved address of the server to relay UDP
+// packets to, resolving it at most once per SERVER_RESOLVE_INTERVAL.
+// The last address is kept for another interval if resolving it
+// again fails.
+func (u *Upstream) UDPAddr() (addr *net.UDPAddr, err error) {
+	u.udpLock.Lock()
+	defer u.udpLock.Unlock()
+	if u.udpAddr != nil && time.Since(u.udpResolved) < SERVER_RESOLVE_INTERVAL {
+		return u.udpAddr, nil
+	}
+	if addr, err = net.ResolveUDPAddr("udp", u.addr); err != nil {
+		if u.udpAddr != nil {
+			log.Printf("Resolving %s: %v", u.Name, err)
+			u.udpResolved = time.Now()
+			return u.udpAddr, nil
+		}
+		return
+	}
+	u.udpAddr, u.udpResolved = addr, time.Now()
+	return
+}
+
+// Active returns the number of alive connections to the server.
+func (u *Upstream) Active() int64 {
+	return atomic.LoadInt64(&u.active)
+}
+
+// Latency returns the smoothed connection latency of the server,
+// or 0 if unknown. It is not measured through a plugin, as the
+// connections are then to the plugin on loopback.
+func (u *Upstream) Latency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&u.latency))
+}
+
+// Down checks whether the server is marked down.
+func (u *Upstream) Down() bool {
+	return atomic.LoadInt64(&u.downUntil) > time.Now().UnixNano()
+}
+
+// MarkDown marks the server down for cooldown.
+func (u *Upstream) MarkDown(cooldown time.Duration) {
+	atomic.StoreInt64(&u.downUntil, time.Now().Add(cooldown).UnixNano())
+}
+
+// MarkUp marks the server up.
+func (u *Upstream) MarkUp() {
+	atomic.StoreInt64(&u.downUntil, 0)
+	atomic.StoreInt32(&u.failures, 0)
+}
+
+// updateLatency adds a latency sample to the moving average. The
+// samples of a server with a plugin are ignored.
+func (u *Upstream) updateLatency(sample time.Duration) {
+	if u.plugin != nil {
+		return
+	}
+	for {
+		old := atomic.LoadInt64(&u.latency)
+		latency := int64(sample)
+		if old != 0 {
+			latency = old - old/8 + latency/8
+		}
+		if atomic.CompareAndSwapInt64(&u.latency, old, latency) {
+			return
+		}
+	}
+}
+
+// ServerPool holds the upstream servers of a client, and chooses
+// among them. The servers failing are marked down, and are not
+// chosen until the cooldown passes, unless all servers are down.
+type ServerPool struct {
+	lock     sync.RWMutex
+	servers  []*Upstream
+	strategy BalanceStrategy
+	cooldown time.Duration
+	next     uint32
+}
+
+// NewServerPool creates a pool of servers.
+func NewServerPool(servers []*Upstream, strategy BalanceStrategy, cooldown time.Duration) *ServerPool {
+	if cooldown <= 0 {
+		cooldown = DEFAULT_SERVER_COOLDOWN
+	}
+	return &ServerPool{servers: servers, strategy: strategy, cooldown: cooldown}
+}
+
+// Servers returns the servers of the pool.
+func (p *ServerPool) Servers() []*Upstream {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.servers
+}
+
+// SetServers replaces the servers of the pool. The alive connections
+// to the servers removed are kept, unless the servers are closed.
+func (p *ServerPool) SetServers(servers []*Upstream) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.servers = servers
+}
+
+// Close closes the servers of the pool, stopping their plugins.
+func (p *ServerPool) Close() {
+	for _, u := range p.Servers() {
+		u.Close()
+	}
+}
+
+// Pick chooses a server not in tried by the strategy, or nil if all
+// servers are tried. If all the servers left are down, the one to be
+// up first is chosen rather than none.
+func (p *ServerPool) Pick(tried map[*Upstream]bool) *Upstream {
+	var up, down []*Upstream
+	for _, u := range p.Servers() {
+		if tried[u] {
+			continue
+		}
+		if u.Down() {
+			down = append(down, u)
+		} else {
+			up = append(up, u)
+		}
+	}
+	if len(up) == 0 {
+		var best *Upstream
+		for _, u := range down {
+			if best == nil || atomic.LoadInt64(&u.downUntil) < atomic.LoadInt64(&best.downUntil) {
+				best = u
+			}
+		}
+		return best
+	}
+	best := up[0]
+	switch p.strategy {
+	case BALANCE_LEAST_CONNS:
+		for _, u := range up[1:] {
+			if u.Active() < best.Active() {
+				best = u
+			}
+		}
+	case BALANCE_LOWEST_LATENCY:
+		// the latency through a plugin is unknown, so the servers with
+		// plugins are used in turn only if no other server is up
+		best = nil
+		for _, u := range up {
+			if u.plugin == nil && (best == nil || u.Latency() < best.Latency()) {
+				best = u
+			}
+		}
+		if best == nil {
+			best = up[int(atomic.AddUint32(&p.next, 1)-1)%len(up)]
+		}
+	default:
+		best = up[int(atomic.AddUint32(&p.next, 1)-1)%len(up)]
+	}
+	return best
+}
+
+// PickPacket chooses a server relaying UDP packets by the strategy,
+// or nil if none relays them.
+func (p *ServerPool) PickPacket() *Upstream {
+	tried := map[*Upstream]bool{}
+	for _, u := range p.Servers() {
+		if u.udpCipher == nil {
+			tried[u] = true
+		}
+	}
+	return p.Pick(tried)
+}
+
+// packetSession returns the session of src in nat, and the address of
+// the server relaying it. The server of a new session is chosen by the
+// strategy, and kept for the whole session, so that the targets see
+// each flow from a single address. It returns ERR_NO_SERVER if no
+// server relays UDP packets. It must be called by a single goroutine
+// per table.
+func (ctx *ClientContext) packetSession(nat *NATTable, src string, recv func(s *UDPSession, pkt []byte, from *net.UDPAddr)) (s *UDPSession, saddr *net.UDPAddr, err error) {
+	if s = nat.Lookup(src); s == nil {
+		up := ctx.pool.PickPacket()
+		if up == nil {
+			return nil, nil, ERR_NO_SERVER
+		}
+		if s, err = nat.Get(src, up.udpCipher, recv); err != nil {
+			return
+		}
+		if s.upstream == nil {
+			s.upstream = up
+		}
+	}
+	saddr, err = s.upstream.UDPAddr()
+	return
+}
+
+// Dial connects to a server chosen by the strategy, failing over to
+// the other servers if it fails.
+func (p *ServerPool) Dial(timeout time.Duration) (conn SSConn, err error) {
+	tried := map[*Upstream]bool{}
+	err = ERR_NO_SERVER
+	for {
+		u := p.Pick(tried)
+		if u == nil {
+			return
+		}
+		tried[u] = true
+		if conn, err = p.dial(u, timeout); err == nil {
+			return
+		}
+		log.Printf("Server %s is down: %v", u.Name, err)
+	}
+}
+
+func (p *ServerPool) dial(u *Upstream, timeout time.Duration) (SSConn, error) {
+	start := time.Now()
+	rconn, err := net.DialTimeout("tcp", u.dialAddr, timeout)
+	if err != nil {
+		u.MarkDown(p.cooldown)
+		return nil, err
+	}
+	u.updateLatency(time.Since(start))
+	if atomic.LoadInt64(&u.downUntil) != 0 {
+		u.MarkUp()
+	}
+	rconn.(*net.TCPConn).SetNoDelay(true)
+	atomic.AddInt64(&u.active, 1)
+	return &upstreamConn{
+		SSConn: u.cipherFactory.Wrap(PlainConn{TCPConn: rconn.(*net.TCPConn)}),
+		pool:   p,
+		up:     u,
+	}, nil
+}
+
+// upstreamConn is a connection to an upstream server, which keeps
+// the state of the server.
+type upstreamConn struct {
+	SSConn
+	pool     *ServerPool
+	up       *Upstream
+	received bool
+	closed   int32
+}
+
+func (c *upstreamConn) SSRead(b *SSBuffer) error {
+	n := len(b.buf)
+	err := c.SSConn.SSRead(b)
+	if c.received {
+		return err
+	}
+	if len(b.buf) > n {
+		c.received = true
+		atomic.StoreInt32(&c.up.failures, 0)
+	} else if err != nil && err != io.EOF {
+		if atomic.AddInt32(&c.up.failures, 1) >= MAX_SERVER_FAILURES {
+			log.Printf("Server %s stops answering: %v", c.up.Name, err)
+			c.up.MarkDown(c.pool.cooldown)
+			atomic.StoreInt32(&c.up.failures, 0)
+		}
+	}
+	return err
+}
+
+func (c *upstreamConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) &&
+		atomic.AddInt64(&c.up.active, -1) == 0 && atomic.LoadInt32(&c.up.released) != 0 {
+		c.up.Close()
+	}
+	return c.SSConn.Close()
+}
@@ -0,0 +1,128 @@
+package shadowsocks
+
+import (
+	"golang.org/x/net/proxy"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestServerPool(t *testing.T) {
+	a := &Upstream{Name: "a", active: 2, latency: int64(30 * time.Millisecond)}
+	b := &Upstream{Name: "b", active: 1, latency: int64(20 * time.Millisecond)}
+	c := &Upstream{Name: "c", active: 3, latency: int64(10 * time.Millisecond)}
+	servers := []*Upstream{a, b, c}
+
+	pool := NewServerPool(servers, BALANCE_ROUND_ROBIN, time.Minute)
+	for i := 0; i < 6; i++ {
+		if u := pool.Pick(nil); u != servers[i%3] {
+			t.Fatal("Wrong round-robin server:", u.Name)
+		}
+	}
+	pool = NewServerPool(servers, BALANCE_LEAST_CONNS, time.Minute)
+	if u := pool.Pick(nil); u != b {
+		t.Fatal("Wrong least-connections server:", u.Name)
+	}
+	pool = NewServerPool(servers, BALANCE_LOWEST_LATENCY, time.Minute)
+	if u := pool.Pick(nil); u != c {
+		t.Fatal("Wrong lowest-latency server:", u.Name)
+	}
+
+	// down servers are avoided unless all are down
+	c.MarkDown(time.Minute)
+	if u := pool.Pick(nil); u != b {
+		t.Fatal("Down server is picked:", u.Name)
+	}
+	if u := pool.Pick(map[*Upstream]bool{a: true, b: true}); u != c {
+		t.Fatal("Down server is not picked when all are down")
+	}
+	if u := pool.Pick(map[*Upstream]bool{a: true, b: true, c: true}); u != nil {
+		t.Fatal("Tried server is picked:", u.Name)
+	}
+	c.MarkUp()
+	if c.Down() {
+		t.Fatal("Server is still down")
+	}
+
+	// the latency through a plugin is unknown
+	c.plugin = &Plugin{}
+	if u := pool.Pick(nil); u != b {
+		t.Fatal("Server with a plugin is picked by latency:", u.Name)
+	}
+	if u := pool.Pick(map[*Upstream]bool{a: true, b: true}); u != c {
+		t.Fatal("Server with a plugin is not picked when no other is up")
+	}
+	c.plugin = nil
+
+	if s, err := ParseBalanceStrategy("least-connections"); err != nil || s != BALANCE_LEAST_CONNS {
+		t.Fatal("Wrong strategy:", s, err)
+	}
+	if _, err := ParseBalanceStrategy("random"); err == nil {
+		t.Fatal("Unknown strategy is parsed")
+	}
+}
+
+func TestUpstreamUDPAddr(t *testing.T) {
+	u := &Upstream{Name: "a", addr: "localhost:7000"}
+	addr, err := u.UDPAddr()
+	if err != nil || addr.Port != 7000 {
+		t.Fatal("Wrong address:", addr, err)
+	}
+	// the address is resolved once per interval, and kept if resolving
+	// it again fails
+	u.addr = "invalid"
+	if a, err := u.UDPAddr(); a != addr || err != nil {
+		t.Fatal("Address is resolved again:", a, err)
+	}
+	u.udpResolved = time.Time{}
+	if a, err := u.UDPAddr(); a != addr || err != nil {
+		t.Fatal("Address is not kept:", a, err)
+	}
+	if _, err = (&Upstream{Name: "b", addr: "invalid"}).UDPAddr(); err == nil {
+		t.Fatal("Invalid address is resolved")
+	}
+}
+
+func TestClientFailover(t *testing.T) {
+	serverConfig, _ := testConfigs(7100, "failover")
+	_, stopServer := startServer(t, serverConfig)
+	defer stopServer()
+
+	// no server is running on 7101
+	clientConfig := DefaultConfig()
+	clientConfig.LocalPort = 6100
+	clientConfig.Servers = []ServerConfig{
+		{Name: "dead", Host: "127.0.0.1", Port: 7101, Method: "chacha20-ietf-poly1305", KeyDeriver: NewKeyDeriver([]byte("dead"))},
+		{Name: "alive", Host: "127.0.0.1", Port: 7100, Method: "aes-128-gcm", KeyDeriver: NewKeyDeriver([]byte("failover"))},
+	}
+	client, stopClient := startClient(t, clientConfig)
+	defer stopClient()
+
+	socks, _ := proxy.SOCKS5("tcp", "127.0.0.1:6100", nil, proxy.Direct)
+	requester := &http.Client{
+		Transport: &http.Transport{Dial: socks.Dial, DisableKeepAlives: true},
+		Timeout:   time.Second,
+	}
+	for i := 0; i < 4; i++ {
+		request, err := requester.Get("http://127.0.0.1:8000/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "Hello" {
+			t.Fatal("Wrong content:", string(content))
+		}
+	}
+	servers := client.Servers().Servers()
+	if !servers[0].Down() {
+		t.Fatal("Dead server is not marked down")
+	}
+	if servers[1].Down() || servers[1].Latency() == 0 {
+		t.Fatal("Alive server is not used")
+	}
+}
@@ -85,7 +85,7 @@ func (ctx *ClientContext) HandleSocks4(tconn SSConn, buf *SSBuffer) (err error)
 	}
 
 	var wrconn SSConn
-	wrconn, err = ctx.DialServer()
+	wrconn, err = ctx.DialTarget(buf)
 	if err != nil {
 		return
 	}
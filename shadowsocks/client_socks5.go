@@ -47,7 +47,7 @@ func (ctx *ClientContext) HandleSocks5(tconn SSConn, buf *SSBuffer) (err error)
 		}
 	}
 	cmd := buf.buf[1]
-	if cmd != 0x01 {
+	if cmd != 0x01 && cmd != 0x03 { // CONNECT and UDP ASSOCIATE
 		return ERR_SOCKS5_COMMAND_NOT_SUPPORTED
 	}
 	atyp := buf.buf[3]
@@ -66,6 +66,9 @@ func (ctx *ClientContext) HandleSocks5(tconn SSConn, buf *SSBuffer) (err error)
 			return
 		}
 	}
+	if cmd == 0x03 {
+		return ctx.HandleSocks5UDP(tconn, buf)
+	}
 	copy(buf.buf, buf.buf[3:])
 	buf.buf = buf.buf[:len(buf.buf)-3]
 
@@ -82,7 +85,7 @@ func (ctx *ClientContext) HandleSocks5(tconn SSConn, buf *SSBuffer) (err error)
 	}
 
 	var wrconn SSConn
-	wrconn, err = ctx.DialServer()
+	wrconn, err = ctx.DialTarget(buf)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,124 @@
+package shadowsocks
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// HandleSocks5UDP handles a socks5 UDP ASSOCIATE request. It binds a
+// relay socket for the association on the address of the controlling
+// connection, and forwards the datagrams between the socks5 client and
+// the UDP relay of one of the servers until the controlling connection
+// is closed. The datagrams to the server are sent through a socket of
+// their own, as a socket bound to loopback cannot reach remote servers.
+func (ctx *ClientContext) HandleSocks5UDP(tconn SSConn, buf *SSBuffer) (err error) {
+	rbuf := NewBuffer()
+	up := ctx.pool.PickPacket()
+	if up == nil {
+		rbuf.buf = append(rbuf.buf[:0], 0x05, 0x07, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+		tconn.SSWrite(rbuf)
+		return ERR_SOCKS5_COMMAND_NOT_SUPPORTED
+	}
+	var saddr *net.UDPAddr
+	if saddr, err = up.UDPAddr(); err != nil {
+		return
+	}
+	var cipher PacketCipher
+	if cipher, err = NewPacketSession(up.udpCipher); err != nil {
+		return
+	}
+	tcpConn := tconn.(PlainConn).TCPConn
+	laddr := tcpConn.LocalAddr().(*net.TCPAddr)
+	caddr := tcpConn.RemoteAddr().(*net.TCPAddr)
+	var relay *net.UDPConn
+	if relay, err = net.ListenUDP("udp", &net.UDPAddr{IP: laddr.IP, Zone: laddr.Zone}); err != nil {
+		return
+	}
+	defer relay.Close()
+	var remote *net.UDPConn
+	if remote, err = net.DialUDP("udp", nil, saddr); err != nil {
+		return
+	}
+	defer remote.Close()
+
+	rbuf.buf = append(rbuf.buf[:0], 0x05, 0x00, 0x00)
+	rbuf.buf, _ = AppendAddress(rbuf.buf, laddr.IP.String(), uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+	if err = tconn.SSWrite(rbuf); err != nil {
+		return
+	}
+
+	var client atomic.Value // *net.UDPAddr of the last datagram of the client
+	go relaySocks5UDP(relay, remote, caddr.IP, cipher, &client)
+	go replySocks5UDP(relay, remote, cipher, &client)
+
+	// the association terminates when the TCP connection terminates
+	for {
+		buf.buf = buf.buf[:0]
+		if err = tconn.SSRead(buf); err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// relaySocks5UDP seals the datagrams of the socks5 client to the
+// server.
+func relaySocks5UDP(relay, remote *net.UDPConn, cip net.IP, cipher PacketCipher, client *atomic.Value) {
+	var drops dropLog
+	pkt := make([]byte, MAX_UDP_PACKET_SIZE)
+	for {
+		n, from, err := relay.ReadFromUDP(pkt)
+		if err != nil {
+			if !isClosedError(err) {
+				log.Print(err)
+			}
+			return
+		}
+		// drop the datagrams of others and the fragmented datagrams
+		if !from.IP.Equal(cip) || n < 4 || pkt[2] != 0x00 {
+			continue
+		}
+		client.Store(from)
+		var data []byte
+		if data, err = cipher.SealPacket(nil, pkt[3:n]); err == nil {
+			_, err = remote.Write(data)
+		}
+		if err != nil {
+			drops.Drop(err)
+		}
+	}
+}
+
+// replySocks5UDP opens the datagrams of the server to the socks5
+// client.
+func replySocks5UDP(relay, remote *net.UDPConn, cipher PacketCipher, client *atomic.Value) {
+	var drops dropLog
+	pkt := make([]byte, MAX_UDP_PACKET_SIZE)
+	for {
+		n, err := remote.Read(pkt)
+		if err != nil {
+			if isClosedError(err) {
+				return
+			}
+			drops.Drop(err) // e.g. ICMP port unreachable
+			continue
+		}
+		caddr, _ := client.Load().(*net.UDPAddr)
+		if caddr == nil {
+			continue
+		}
+		var plain []byte
+		// reserve the socks5 header of RSV and FRAG
+		if plain, err = cipher.OpenPacket([]byte{0x00, 0x00, 0x00}, pkt[:n]); err == nil {
+			_, err = relay.WriteToUDP(plain, caddr)
+		}
+		if err != nil {
+			drops.Drop(err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSocks5UDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, MAX_UDP_PACKET_SIZE)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	conn, uconn := socks5Associate(t, "127.0.0.1:6000")
+	defer conn.Close()
+	defer uconn.Close()
+	eaddr := echo.LocalAddr().(*net.UDPAddr)
+	dgram, _ := AppendAddress([]byte{0x00, 0x00, 0x00}, "127.0.0.1", uint16(eaddr.Port))
+	dgram = append(dgram, []byte("Hello")...)
+	buf := make([]byte, MAX_UDP_PACKET_SIZE)
+	for i := 0; i < 3; i++ {
+		if _, err = uconn.Write(dgram); err != nil {
+			t.Fatal(err)
+		}
+		uconn.SetReadDeadline(time.Now().Add(time.Second))
+		var n int
+		if n, err = uconn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], dgram) {
+			t.Fatal("Wrong content:", buf[:n])
+		}
+	}
+}
+
+// TestSocks5UDPRemoteServer checks that the datagrams reach a server on
+// a non-loopback address from an address it can reply to, though the
+// relay of the association is bound to loopback.
+func TestSocks5UDPRemoteServer(t *testing.T) {
+	var host net.IP
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil && !n.IP.IsLoopback() {
+			host = n.IP
+			break
+		}
+	}
+	if host == nil {
+		t.Skip("No non-loopback address")
+	}
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: host})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	_, clientConfig := testConfigs(uint16(server.LocalAddr().(*net.UDPAddr).Port), "socks5udp")
+	clientConfig.ServerHost = host.String()
+	clientConfig.LocalPort = 6200
+	_, stopClient := startClient(t, clientConfig)
+	defer stopClient()
+
+	conn, uconn := socks5Associate(t, "127.0.0.1:6200")
+	defer conn.Close()
+	defer uconn.Close()
+	dgram, _ := AppendAddress([]byte{0x00, 0x00, 0x00}, "192.0.2.1", 53)
+	dgram = append(dgram, []byte("Hello")...)
+	if _, err = uconn.Write(dgram); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, MAX_UDP_PACKET_SIZE)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	n, from, err := server.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.IP.IsLoopback() {
+		t.Fatal("Datagram is sent from a loopback address:", from)
+	}
+	key := make([]byte, Ciphers["aes-128-gcm"].keySize)
+	NewKeyDeriver([]byte("socks5udp")).Read(key)
+	plain, err := Ciphers["aes-128-gcm"].newFactory(key).(PacketCipher).OpenPacket(nil, buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain, dgram[3:]) {
+		t.Fatal("Wrong content:", plain)
+	}
+}
+
+// socks5Associate requests a UDP association of the socks5 proxy, and
+// returns the controlling connection and a socket connected to the
+// relay of the association.
+func socks5Associate(t *testing.T, proxy string) (conn net.Conn, uconn *net.UDPConn) {
+	var err error
+	for i := 0; i < 10; i++ { // the proxy may not be listening yet
+		if conn, err = net.Dial("tcp", proxy); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	reply := make([]byte, 10)
+	if _, err = io.ReadFull(conn, reply[:2]); err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte{0x05, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0x00 || reply[3] != 0x01 {
+		t.Fatal("Wrong reply:", reply)
+	}
+	relay := &net.UDPAddr{
+		IP:   net.IP(reply[4:8]),
+		Port: int(reply[8])<<8 | int(reply[9]),
+	}
+	if uconn, err = net.DialUDP("udp", nil, relay); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
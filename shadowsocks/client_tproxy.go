@@ -0,0 +1,312 @@
+// +build linux
+
+package shadowsocks
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MAX_TPROXY_REPLY_CONNS is the maximum number of the sockets a NAT
+// session of TPROXY keeps to reply from the original destinations.
+const MAX_TPROXY_REPLY_CONNS = 64
+
+// The options missing from syscall.
+const (
+	IPV6_RECVORIGDSTADDR = 74
+	IPV6_ORIGDSTADDR     = 74
+	IPV6_TRANSPARENT     = 75
+)
+
+// TPROXY delivers the connections and the datagrams to a transparent
+// listener without rewriting their destinations, so that the client
+// proxies both TCP and UDP of a gateway. The packets are marked and
+// routed to the local host, which requires CAP_NET_ADMIN, e.g. for a
+// listener on port 1081:
+//
+//	ip rule add fwmark 1 lookup 100
+//	ip route add local 0.0.0.0/0 dev lo table 100
+//	ip -6 rule add fwmark 1 lookup 100
+//	ip -6 route add local ::/0 dev lo table 100
+//
+//	table inet shadowsocks {
+//		chain prerouting {
+//			type filter hook prerouting priority mangle; policy accept;
+//			ip daddr { 127.0.0.0/8, 10.0.0.0/8, 172.16.0.0/12, 192.168.0.0/16 } return
+//			ip6 daddr { ::1, fc00::/7, fe80::/10 } return
+//			meta l4proto { tcp, udp } tproxy to :1081 meta mark set 1 accept
+//		}
+//	}
+//
+// The listener on "[::]:1081" receives both IPv4 and IPv6.
+type tproxyListener struct {
+	tcp net.Listener
+	udp *net.UDPConn
+	nat *NATTable
+}
+
+// transparentControl makes a socket transparent, and receives the
+// original destinations of the datagrams on UDP sockets.
+func transparentControl(network, address string, c syscall.RawConn) (err error) {
+	cerr := c.Control(func(fd uintptr) {
+		s := int(fd)
+		udp := strings.HasPrefix(network, "udp")
+		if strings.HasSuffix(network, "6") {
+			if err = syscall.SetsockoptInt(s, syscall.SOL_IPV6, IPV6_TRANSPARENT, 1); err != nil {
+				return
+			}
+			if udp {
+				if err = syscall.SetsockoptInt(s, syscall.SOL_IPV6, IPV6_RECVORIGDSTADDR, 1); err != nil {
+					return
+				}
+			}
+		}
+		// the IPv4 options apply to the IPv4 packets of dual-stack
+		// sockets as well
+		v4 := strings.HasSuffix(network, "4")
+		if e := syscall.SetsockoptInt(s, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); e != nil && v4 {
+			err = e
+			return
+		}
+		if udp {
+			if e := syscall.SetsockoptInt(s, syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); e != nil && v4 {
+				err = e
+				return
+			}
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return
+}
+
+// replyControl makes a socket transparent to send the replies from
+// the original destinations.
+func replyControl(network, address string, c syscall.RawConn) (err error) {
+	cerr := c.Control(func(fd uintptr) {
+		s := int(fd)
+		if err = syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+			return
+		}
+		if strings.HasSuffix(network, "6") {
+			err = syscall.SetsockoptInt(s, syscall.SOL_IPV6, IPV6_TRANSPARENT, 1)
+		} else {
+			err = syscall.SetsockoptInt(s, syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		}
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return
+}
+
+func listenTProxy(addr string, udpRelay bool, udpTimeout time.Duration) (l *tproxyListener, err error) {
+	lc := net.ListenConfig{Control: transparentControl}
+	l = &tproxyListener{}
+	if l.tcp, err = lc.Listen(context.Background(), "tcp", addr); err != nil {
+		return nil, err
+	}
+	if udpRelay {
+		var conn net.PacketConn
+		if conn, err = lc.ListenPacket(context.Background(), "udp", addr); err != nil {
+			l.tcp.Close()
+			return nil, err
+		}
+		l.udp = conn.(*net.UDPConn)
+		l.nat = NewNATTable(udpTimeout)
+	}
+	return
+}
+
+func (l *tproxyListener) Close() {
+	l.tcp.Close()
+	if l.udp != nil {
+		l.udp.Close()
+		l.nat.Close()
+	}
+}
+
+// parseOrigDst parses the original destination of a datagram from its
+// control messages.
+func parseOrigDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		data := msg.Data
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR &&
+			len(data) >= syscall.SizeofSockaddrInet4:
+			return &net.UDPAddr{
+				IP:   net.IPv4(data[4], data[5], data[6], data[7]),
+				Port: int(binary.BigEndian.Uint16(data[2:4])),
+			}, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == IPV6_ORIGDSTADDR &&
+			len(data) >= syscall.SizeofSockaddrInet6:
+			return &net.UDPAddr{
+				IP:   append(net.IP(nil), data[8:24]...),
+				Port: int(binary.BigEndian.Uint16(data[2:4])),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("No original destination of the datagram")
+}
+
+// HandleTProxy forwards a connection accepted by the TPROXY listener
+// to its original destination, which is its local address, or to the
+// domain mapped to it if it is a fake address, or to the host name
+// sniffed from its first bytes.
+func (ctx *ClientContext) HandleTProxy(conn net.Conn) {
+	defer FDRelease()
+	var err error
+	defer conn.Close()
+	defer func() {
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+	tconn := PlainConn{TCPConn: conn.(*net.TCPConn)}
+	tconn.TCPConn.SetNoDelay(true)
+	tconn.TCPConn.SetKeepAlivePeriod(ctx.timeout)
+	tconn.TCPConn.SetKeepAlive(true)
+
+	addr := conn.LocalAddr().(*net.TCPAddr)
+	buf := NewBuffer()
+	if err = ctx.transparentTarget(tconn, addr, buf); err != nil {
+		return
+	}
+	var rconn SSConn
+	if rconn, err = ctx.DialTarget(buf); err != nil {
+		return
+	}
+	defer rconn.Close()
+
+	res := make(chan error, 1)
+	DPipe(tconn, rconn, buf, NewBuffer(), res)
+	err = <-res
+}
+
+// relayTProxyUDP forwards the datagrams received by the TPROXY
+// listener to their original destinations through the servers
+// relaying UDP, or to the domains mapped to the fake destinations.
+// Each flow, from a source to an original destination, is relayed by
+// the server chosen for its first datagram. The replies are sent from
+// the original destinations with transparent sockets.
+func (ctx *ClientContext) relayTProxyUDP(l *tproxyListener) {
+	pkt := make([]byte, MAX_UDP_PACKET_SIZE)
+	var drops dropLog
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, caddr, err := l.udp.ReadMsgUDP(pkt, oob)
+		if err != nil {
+			if !isClosedError(err) {
+				log.Print(err)
+			}
+			return
+		}
+		var dst *net.UDPAddr
+		if dst, err = parseOrigDst(oob[:oobn]); err != nil {
+			log.Print(err)
+			continue
+		}
+		host := dst.IP.String()
+		fake := ctx.fakeIP != nil && ctx.fakeIP.Contains(dst.IP)
+		if fake {
+			if host = ctx.fakeIP.Domain(dst.IP); host == "" {
+				log.Print(ERR_FAKE_IP_NOT_MAPPED)
+				continue
+			}
+		}
+		var plain []byte
+		if plain, err = AppendAddress(nil, host, uint16(dst.Port)); err != nil {
+			continue
+		}
+		plain = append(plain, pkt[:n]...)
+		// each flow has its own session, so that it keeps its server,
+		// and the replies of a domain come from its fake address
+		key := caddr.String() + "/" + dst.String()
+		var replies *tproxyReplies
+		var session *UDPSession
+		var saddr *net.UDPAddr
+		session, saddr, err = ctx.packetSession(l.nat, key, func(s *UDPSession, pkt []byte, from *net.UDPAddr) {
+			plain, err := s.Cipher().OpenPacket(nil, pkt)
+			if err != nil {
+				return
+			}
+			addr, ln, err := ParseAddress(plain)
+			if err != nil || len(plain) < ln {
+				return
+			}
+			if fake { // from the fake address
+				addr = dst.String()
+			}
+			if replies == nil {
+				replies = &tproxyReplies{caddr: caddr, conns: map[string]net.PacketConn{}}
+				s.OnClose(replies.Close)
+			}
+			if err = replies.Send(addr, plain[ln:]); err != nil {
+				log.Print(err)
+			}
+		})
+		if err == nil {
+			var data []byte
+			if data, err = session.Cipher().SealPacket(nil, plain); err == nil {
+				err = session.WriteTo(data, saddr)
+			}
+		}
+		if err == ERR_NO_SERVER {
+			drops.Drop(err)
+		} else if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// tproxyReplies sends the replies of a NAT session to the client from
+// the original destinations, through a transparent socket bound to
+// each of them. The sockets are kept until the session is closed, at
+// most MAX_TPROXY_REPLY_CONNS of them.
+type tproxyReplies struct {
+	caddr *net.UDPAddr
+	conns map[string]net.PacketConn
+}
+
+// Send sends a reply from the address from to the client.
+func (r *tproxyReplies) Send(from string, data []byte) (err error) {
+	conn := r.conns[from]
+	if conn == nil {
+		network := "udp4"
+		if r.caddr.IP.To4() == nil {
+			network = "udp6"
+		}
+		lc := net.ListenConfig{Control: replyControl}
+		if conn, err = lc.ListenPacket(context.Background(), network, from); err != nil {
+			return
+		}
+		if len(r.conns) >= MAX_TPROXY_REPLY_CONNS {
+			for addr, c := range r.conns { // any of them
+				c.Close()
+				delete(r.conns, addr)
+				break
+			}
+		}
+		r.conns[from] = conn
+	}
+	_, err = conn.WriteTo(data, r.caddr)
+	return
+}
+
+// Close closes the sockets.
+func (r *tproxyReplies) Close() {
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+}
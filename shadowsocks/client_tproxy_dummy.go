@@ -0,0 +1,29 @@
+// +build !linux
+
+package shadowsocks
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+type tproxyListener struct {
+	tcp net.Listener
+	udp *net.UDPConn
+}
+
+func listenTProxy(addr string, udpRelay bool, udpTimeout time.Duration) (*tproxyListener, error) {
+	return nil, fmt.Errorf("TPROXY is only supported on linux")
+}
+
+func (l *tproxyListener) Close() {
+}
+
+func (ctx *ClientContext) HandleTProxy(conn net.Conn) {
+	defer FDRelease()
+	conn.Close()
+}
+
+func (ctx *ClientContext) relayTProxyUDP(l *tproxyListener) {
+}
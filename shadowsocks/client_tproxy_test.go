@@ -0,0 +1,194 @@
+// +build linux
+
+package shadowsocks
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseOrigDst(t *testing.T) {
+	addrs := []string{"127.0.0.1:0"}
+	if os.Getenv("NOIPV6") != "1" {
+		addrs = append(addrs, "[::1]:0")
+	}
+	for _, addr := range addrs {
+		lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) (err error) {
+			c.Control(func(fd uintptr) {
+				if strings.HasSuffix(network, "6") {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, IPV6_RECVORIGDSTADDR, 1)
+				} else {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+				}
+			})
+			return
+		}}
+		conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		laddr := conn.LocalAddr().(*net.UDPAddr)
+		sender, err := net.DialUDP("udp", nil, laddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sender.Close()
+		if _, err = sender.Write([]byte("Hello")); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		pkt, oob := make([]byte, 64), make([]byte, 1024)
+		_, oobn, _, _, err := conn.(*net.UDPConn).ReadMsgUDP(pkt, oob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dst, err := parseOrigDst(oob[:oobn])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !dst.IP.Equal(laddr.IP) || dst.Port != laddr.Port {
+			t.Fatal("Wrong original destination:", dst)
+		}
+	}
+	if _, err := parseOrigDst(nil); err == nil {
+		t.Fatal("Missing original destination is parsed")
+	}
+}
+
+// TestTProxy proxies the connections and the datagrams of the test to
+// 198.51.100.1 and 2001:db8::1 with TPROXY. It changes the routes and
+// the nftables rules, so it only runs in a network namespace as root
+// when SS_TEST_TPROXY is set, e.g.
+//
+//	unshare -n sh -c 'ip link set lo up && SS_TEST_TPROXY=1 go test -run TestTProxy'
+//
+// The locally generated packets are marked in the output chain to be
+// routed back to the prerouting chain, while a gateway only needs the
+// prerouting chain for the packets it forwards.
+func TestTProxy(t *testing.T) {
+	if os.Getenv("SS_TEST_TPROXY") == "" || os.Getuid() != 0 {
+		t.Skip("SS_TEST_TPROXY is not set in a network namespace as root")
+	}
+	const rules = `
+table inet sstest {
+	chain output {
+		type route hook output priority mangle; policy accept;
+		ip daddr 198.51.100.1 tcp sport 40000 meta mark set 1
+		ip daddr 198.51.100.1 udp sport 40000 meta mark set 1
+		ip6 daddr 2001:db8::1 tcp sport 40000 meta mark set 1
+		ip6 daddr 2001:db8::1 udp sport 40000 meta mark set 1
+	}
+	chain prerouting {
+		type filter hook prerouting priority mangle; policy accept;
+		ip daddr 198.51.100.1 meta mark 1 meta l4proto { tcp, udp } tproxy ip to :6161 accept
+		ip6 daddr 2001:db8::1 meta mark 1 meta l4proto { tcp, udp } tproxy ip6 to :6161 accept
+	}
+}
+`
+	targets := []string{"198.51.100.1"}
+	commands := [][]string{
+		{"ip", "addr", "add", "198.51.100.1/32", "dev", "lo"},
+		{"ip", "rule", "add", "fwmark", "1", "lookup", "100"},
+		{"ip", "route", "add", "local", "0.0.0.0/0", "dev", "lo", "table", "100"},
+	}
+	if os.Getenv("NOIPV6") != "1" {
+		targets = append(targets, "2001:db8::1")
+		commands = append(commands,
+			[]string{"ip", "-6", "addr", "add", "2001:db8::1/128", "dev", "lo", "nodad"},
+			[]string{"ip", "-6", "rule", "add", "fwmark", "1", "lookup", "100"},
+			[]string{"ip", "-6", "route", "add", "local", "::/0", "dev", "lo", "table", "100"})
+	}
+	for _, args := range append(commands, []string{"nft", "-f", "-"}) {
+		cmd := exec.Command(args[0], args[1:]...)
+		if args[0] == "nft" {
+			cmd.Stdin = strings.NewReader(rules)
+		}
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatal(args, err, string(out))
+		}
+	}
+	defer exec.Command("nft", "delete", "table", "inet", "sstest").Run()
+
+	serverConfig, clientConfig := testConfigs(7160, "tproxy")
+	_, stopServer := startServer(t, serverConfig)
+	defer stopServer()
+
+	clientConfig.LocalPort = 6160
+	clientConfig.TProxyListen = "[::]:6161"
+	_, stopClient := startClient(t, clientConfig)
+	defer stopClient()
+
+	for _, target := range targets {
+		// the replies are sent from the address of the echo server
+		lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) (err error) {
+			c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			})
+			return
+		}}
+		pconn, err := lc.ListenPacket(context.Background(), "udp", WrapAddr(target, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo := pconn.(*net.UDPConn)
+		defer echo.Close()
+		go func() {
+			buf := make([]byte, MAX_UDP_PACKET_SIZE)
+			for {
+				n, addr, err := echo.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				echo.WriteToUDP(buf[:n], addr)
+			}
+		}()
+
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{Port: 40000}}
+		requester := &http.Client{
+			Transport: &http.Transport{DialContext: dialer.DialContext, DisableKeepAlives: true},
+			Timeout:   time.Second,
+		}
+		request, err := requester.Get("http://" + WrapAddr(target, 8000) + "/hello")
+		if err != nil {
+			t.Fatal(target, err)
+		}
+		content, err := ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			t.Fatal(target, err)
+		}
+		if string(content) != "Hello" {
+			t.Fatal(target, "Wrong content:", string(content))
+		}
+
+		conn, err := net.DialUDP("udp", &net.UDPAddr{Port: 40000}, echo.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(target, err)
+		}
+		defer conn.Close()
+		// the second reply is sent through the socket of the first
+		for i := 0; i < 2; i++ {
+			if _, err = conn.Write([]byte("Hello")); err != nil {
+				t.Fatal(target, err)
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 64)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(target, err)
+			}
+			if string(buf[:n]) != "Hello" {
+				t.Fatal(target, "Wrong content:", string(buf[:n]))
+			}
+		}
+	}
+}
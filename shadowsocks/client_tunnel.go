@@ -0,0 +1,154 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tunnel forwards a local port to a fixed destination through the
+// servers, like ss-tunnel.
+type Tunnel struct {
+	// Local listening port
+	LocalPort uint16
+	// Destination address
+	Host string
+	// Destination port
+	Port uint16
+}
+
+// ParseTunnel parses a tunnel like "5353:8.8.8.8:53", the local port
+// followed by the destination address.
+func ParseTunnel(s string) (t Tunnel, err error) {
+	p := strings.Index(s, ":")
+	if p == -1 {
+		return t, fmt.Errorf("Invalid tunnel: %s", s)
+	}
+	var port uint64
+	if port, err = strconv.ParseUint(s[:p], 10, 16); err != nil {
+		return t, fmt.Errorf("Invalid tunnel local port: %s", s)
+	}
+	t.LocalPort = uint16(port)
+	if t.Host, t.Port, err = UnwrapAddr(s[p+1:]); err != nil {
+		return t, fmt.Errorf("Invalid tunnel destination: %s", s)
+	}
+	return
+}
+
+func (t Tunnel) String() string {
+	return fmt.Sprintf("%d:%s", t.LocalPort, WrapAddr(t.Host, t.Port))
+}
+
+// tunnelListener listens on the local port of a tunnel.
+type tunnelListener struct {
+	Tunnel
+	header   []byte // address header of the destination
+	listener net.Listener
+	udp      *net.UDPConn
+	nat      *NATTable
+}
+
+func listenTunnel(t Tunnel, host string, udpRelay bool, udpTimeout time.Duration) (l *tunnelListener, err error) {
+	l = &tunnelListener{Tunnel: t}
+	if l.header, err = AppendAddress(nil, t.Host, t.Port); err != nil {
+		return nil, err
+	}
+	addr := WrapAddr(host, t.LocalPort)
+	if l.listener, err = net.Listen("tcp", addr); err != nil {
+		return nil, err
+	}
+	if udpRelay {
+		var uaddr *net.UDPAddr
+		if uaddr, err = net.ResolveUDPAddr("udp", addr); err == nil {
+			l.udp, err = net.ListenUDP("udp", uaddr)
+		}
+		if err != nil {
+			l.listener.Close()
+			return nil, err
+		}
+		l.nat = NewNATTable(udpTimeout)
+	}
+	return
+}
+
+func (l *tunnelListener) Close() {
+	l.listener.Close()
+	if l.udp != nil {
+		l.udp.Close()
+		l.nat.Close()
+	}
+}
+
+// HandleTunnel forwards a connection accepted by a tunnel to its
+// destination through the servers.
+func (ctx *ClientContext) HandleTunnel(conn net.Conn, t *tunnelListener) {
+	defer FDRelease()
+	var err error
+	defer conn.Close()
+	defer func() {
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+	tconn := PlainConn{TCPConn: conn.(*net.TCPConn)}
+	tconn.TCPConn.SetNoDelay(true)
+	tconn.TCPConn.SetKeepAlivePeriod(ctx.timeout)
+	tconn.TCPConn.SetKeepAlive(true)
+
+	var rconn SSConn
+	if rconn, err = ctx.DialServer(); err != nil {
+		return
+	}
+	defer rconn.Close()
+
+	buf := NewBuffer()
+	buf.buf = append(buf.buf[:0], t.header...)
+	res := make(chan error, 1)
+	DPipe(tconn, rconn, buf, NewBuffer(), res)
+	err = <-res
+}
+
+// relayTunnelUDP forwards the datagrams received by a tunnel to its
+// destination through the servers relaying UDP. The datagrams from
+// each source have a session on the server chosen for its first one.
+func (ctx *ClientContext) relayTunnelUDP(t *tunnelListener) {
+	pkt := make([]byte, MAX_UDP_PACKET_SIZE)
+	var drops dropLog
+	for {
+		n, caddr, err := t.udp.ReadFromUDP(pkt)
+		if err != nil {
+			if !isClosedError(err) {
+				log.Print(err)
+			}
+			return
+		}
+		var session *UDPSession
+		var saddr *net.UDPAddr
+		session, saddr, err = ctx.packetSession(t.nat, caddr.String(), func(s *UDPSession, pkt []byte, from *net.UDPAddr) {
+			plain, err := s.Cipher().OpenPacket(nil, pkt)
+			if err != nil {
+				return
+			}
+			_, ln, err := ParseAddress(plain)
+			if err != nil || len(plain) < ln {
+				return
+			}
+			t.udp.WriteToUDP(plain[ln:], caddr)
+		})
+		if err == nil {
+			plain := append(append(make([]byte, 0, len(t.header)+n), t.header...), pkt[:n]...)
+			var data []byte
+			if data, err = session.Cipher().SealPacket(nil, plain); err == nil {
+				err = session.WriteTo(data, saddr)
+			}
+		}
+		if err == ERR_NO_SERVER {
+			drops.Drop(err)
+		} else if err != nil {
+			log.Print(err)
+		}
+	}
+}
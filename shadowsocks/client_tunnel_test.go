@@ -0,0 +1,128 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTunnel(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	var lock sync.Mutex
+	sources := map[string]bool{}
+	go func() {
+		buf := make([]byte, MAX_UDP_PACKET_SIZE)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			sources[addr.String()] = true
+			lock.Unlock()
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	// the servers are used in turn
+	serverConfig, clientConfig := testConfigs(7140, "tunnel")
+	_, stopServer := startServer(t, serverConfig)
+	defer stopServer()
+	serverConfig, _ = testConfigs(7141, "tunnel")
+	_, stopServer2 := startServer(t, serverConfig)
+	defer stopServer2()
+	for _, port := range []uint16{7140, 7141} {
+		clientConfig.Servers = append(clientConfig.Servers, ServerConfig{
+			Host: "127.0.0.1", Port: port, Method: "aes-128-gcm", KeyDeriver: NewKeyDeriver([]byte("tunnel")),
+		})
+	}
+
+	for _, spec := range []string{
+		"6140:127.0.0.1:8000",
+		fmt.Sprintf("6141:127.0.0.1:%d", echo.LocalAddr().(*net.UDPAddr).Port),
+	} {
+		tunnel, err := ParseTunnel(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConfig.Tunnels = append(clientConfig.Tunnels, tunnel)
+	}
+	_, stopClient := startClient(t, clientConfig)
+	defer stopClient()
+
+	requester := &http.Client{Timeout: time.Second}
+	for i := 0; i < 3; i++ {
+		request, err := requester.Get("http://127.0.0.1:6140/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "Hello" {
+			t.Fatal("Wrong content:", string(content))
+		}
+	}
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6141})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, MAX_UDP_PACKET_SIZE)
+	for i := 0; i < 3; i++ {
+		if _, err = conn.Write([]byte("Hello")); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "Hello" {
+			t.Fatal("Wrong content:", string(buf[:n]))
+		}
+	}
+	// a flow keeps the server of its first datagram
+	lock.Lock()
+	if len(sources) != 1 {
+		t.Fatal("Flow is relayed through several servers:", sources)
+	}
+	lock.Unlock()
+
+	// the proxy does not listen in tunnel mode
+	if conn, err := net.Dial("tcp", "127.0.0.1:1080"); err == nil {
+		conn.Close()
+		t.Fatal("Proxy listens in tunnel mode")
+	}
+}
+
+func TestParseTunnel(t *testing.T) {
+	for spec, tunnel := range map[string]Tunnel{
+		"5353:8.8.8.8:53":           {5353, "8.8.8.8", 53},
+		"2222:internal-git:22":      {2222, "internal-git", 22},
+		"5353:[2001:4860::8888]:53": {5353, "2001:4860::8888", 53},
+	} {
+		if parsed, err := ParseTunnel(spec); err != nil || parsed != tunnel {
+			t.Fatal("Wrong tunnel of", spec, parsed, err)
+		}
+		if tunnel.String() != spec {
+			t.Fatal("Wrong tunnel string:", tunnel.String())
+		}
+	}
+	for _, spec := range []string{"5353", "dns:8.8.8.8:53", "5353:8.8.8.8", "70000:8.8.8.8:53"} {
+		if _, err := ParseTunnel(spec); err == nil {
+			t.Fatal("Invalid tunnel is parsed:", spec)
+		}
+	}
+}
@@ -5,6 +5,23 @@ import (
 	"time"
 )
 
+// User is a credential accepted by a multi-user server.
+type User struct {
+	// Name of the user, used in logs and statistics
+	Name string
+	// Key generator of the user
+	KeyDeriver io.Reader
+	// Upload rate limit of the user in bytes per second, 0 for unlimited
+	UploadRate int64
+	// Download rate limit of the user in bytes per second, 0 for unlimited
+	DownloadRate int64
+	// Bucket size of the rate limits of the user in bytes, 0 for the
+	// bytes of one second
+	RateBurst int64
+	// Maximum simultaneous connections of the user, 0 for unlimited
+	MaxConns int
+}
+
 type Config struct {
 	// Server listening address
 	ServerHost string
@@ -18,12 +35,110 @@ type Config struct {
 	Method string
 	// Key generator
 	KeyDeriver io.Reader
+	// Password KeyDeriver is created from, only needed to format URIs
+	Password string
+	// SIP003 plugin executable transporting the traffic, and its options
+	Plugin     string
+	PluginOpts string
+	// Name of the server in URIs
+	Remarks string
 	// TCP keepalive timeout
 	Timeout time.Duration
 	// Connect IPv4 address only (Server only)
 	ConnectV4Only bool
-	// New connection timeout (Server only)
+	// New connection timeout
 	ConnectTimeout time.Duration
+	// Relay UDP packets on the server port, and accept socks5
+	// UDP ASSOCIATE on the client
+	UDPRelay bool
+	// Idle timeout of UDP sessions
+	UDPTimeout time.Duration
+	// Users sharing the port, identified by their keys. KeyDeriver
+	// is ignored if it is not empty (Server only, AEAD ciphers only)
+	Users []User
+	// Upload rate limit of the port in bytes per second, 0 for
+	// unlimited (Server only)
+	UploadRate int64
+	// Download rate limit of the port in bytes per second, 0 for
+	// unlimited (Server only)
+	DownloadRate int64
+	// Bucket size of the rate limits of the port in bytes, 0 for the
+	// bytes of one second (Server only)
+	RateBurst int64
+	// Maximum simultaneous connections of the port, 0 for unlimited
+	// (Server only)
+	MaxConns int
+	// Maximum simultaneous connections from a single IP address,
+	// 0 for unlimited (Server only)
+	MaxConnsPerIP int
+	// Ban list of the sources failing authentication, nil to disable.
+	// It may be shared by several servers (Server only)
+	BanList *BanList
+	// Handling of the connections failing authentication (Server only)
+	Fallback FallbackMode
+	// Decoy server address of FALLBACK_DECOY (Server only)
+	FallbackDecoy string
+	// Maximum delay before closing of FALLBACK_CLOSE (Server only)
+	FallbackDelay time.Duration
+	// Destinations the server may connect to, nil to allow all
+	// (Server only)
+	DestPolicy *DestPolicy
+	// DNS server resolving destinations, e.g. "8.8.8.8:53", empty to
+	// use the system resolver (Server only)
+	Nameserver string
+	// Rules deciding whether to connect through the server, directly
+	// or not at all, nil to connect all through the server (Client only)
+	ACL *ACL
+	// Servers to connect, each with its own encryption. ServerHost,
+	// ServerPort, Method and KeyDeriver are ignored if it is not
+	// empty (Client only)
+	Servers []ServerConfig
+	// How to choose among the servers (Client only)
+	Strategy BalanceStrategy
+	// Time a failed server is avoided for (Client only)
+	ServerCooldown time.Duration
+	// Target requested through each server to check its health, an
+	// HTTP URL or host:port, empty to disable (Client only)
+	HealthProbe string
+	// Interval of health checks (Client only)
+	HealthInterval time.Duration
+	// Timeout of a health check (Client only)
+	HealthTimeout time.Duration
+	// SIP008 online config the servers are fetched from, an HTTP(S)
+	// URL or a file path, overriding Servers (Client only)
+	Subscription string
+	// Interval of fetching Subscription (Client only)
+	SubscriptionInterval time.Duration
+	// Local ports forwarded to fixed destinations, listened on
+	// LocalHost instead of the proxy on LocalPort (Client only)
+	Tunnels []Tunnel
+	// Local DNS listener address of both UDP and TCP, e.g.
+	// "127.0.0.1:5353", empty to disable (Client only)
+	DNSListen string
+	// DNS resolver queried through the servers (Client only)
+	DNSRemote string
+	// DNS resolver of DNSLocalDomains, queried directly (Client only)
+	DNSLocal string
+	// Domains resolved by DNSLocal, including their subdomains
+	// (Client only)
+	DNSLocalDomains []string
+	// TPROXY listener address of both TCP and UDP, e.g. "[::]:1081",
+	// empty to disable, linux only (Client only)
+	TProxyListen string
+	// Answer the A and AAAA queries of DNSListen with fake addresses,
+	// which the redirected connections are forwarded to the domains
+	// of (Client only)
+	FakeIP bool
+	// IPv4 and IPv6 ranges of the fake addresses in CIDR notation,
+	// empty to disable the family (Client only)
+	FakeIPRange  string
+	FakeIP6Range string
+	// Maximum number of domains mapped to fake addresses, the least
+	// recently used are evicted first (Client only)
+	FakeIPEntries int
+	// The path to persist the fake addresses across restarts
+	// (Client only)
+	FakeIPFile string
 }
 
 func DefaultConfig() Config {
@@ -37,5 +152,17 @@ func DefaultConfig() Config {
 		Timeout:        300 * time.Second,
 		ConnectV4Only:  false,
 		ConnectTimeout: 15 * time.Second,
+		UDPRelay:       true,
+		UDPTimeout:     DEFAULT_UDP_TIMEOUT,
+		Fallback:       FALLBACK_DRAIN,
+		FallbackDelay:  DEFAULT_FALLBACK_DELAY,
+		Strategy:       BALANCE_ROUND_ROBIN,
+		ServerCooldown: DEFAULT_SERVER_COOLDOWN,
+		HealthInterval: DEFAULT_HEALTH_INTERVAL,
+		HealthTimeout:  DEFAULT_HEALTH_TIMEOUT,
+		DNSRemote:      DEFAULT_DNS_REMOTE,
+		FakeIPRange:    DEFAULT_FAKE_IP_RANGE,
+		FakeIP6Range:   DEFAULT_FAKE_IP6_RANGE,
+		FakeIPEntries:  DEFAULT_FAKE_IP_ENTRIES,
 	}
 }
@@ -0,0 +1,57 @@
+package shadowsocks
+
+import "sync"
+
+// SourceLimiter limits the simultaneous connections from each
+// source address, so that a single client cannot exhaust the
+// file descriptors shared by all clients (see FDSetMax).
+type SourceLimiter struct {
+	lock  sync.Mutex
+	max   int // 0 for unlimited
+	conns map[string]int
+}
+
+// NewSourceLimiter creates a limiter allowing max connections from
+// each source, 0 for unlimited.
+func NewSourceLimiter(max int) *SourceLimiter {
+	return &SourceLimiter{max: max, conns: map[string]int{}}
+}
+
+// SetMax sets the maximum connections from each source, 0 for
+// unlimited. Alive connections over the limit are kept.
+func (l *SourceLimiter) SetMax(max int) {
+	l.lock.Lock()
+	l.max = max
+	l.lock.Unlock()
+}
+
+// Max returns the maximum connections from each source.
+func (l *SourceLimiter) Max() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.max
+}
+
+// Acquire counts a new connection from source, or returns false if
+// too many connections from source are alive. Release must be called
+// when an acquired connection is closed.
+func (l *SourceLimiter) Acquire(source string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.max > 0 && l.conns[source] >= l.max {
+		return false
+	}
+	l.conns[source]++
+	return true
+}
+
+// Release counts a connection from source as closed.
+func (l *SourceLimiter) Release(source string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.conns[source] <= 1 {
+		delete(l.conns, source)
+	} else {
+		l.conns[source]--
+	}
+}
@@ -0,0 +1,61 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimit(t *testing.T) {
+	serverConfig := DefaultConfig()
+	serverConfig.ServerHost = "127.0.0.1"
+	serverConfig.ServerPort = 7050
+	serverConfig.KeyDeriver = NewKeyDeriver([]byte("connlimit"))
+	serverConfig.MaxConns = 1
+	server, err := NewServerContext(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+	defer server.Wait()
+	defer server.Stop()
+
+	// rejected connections are closed without reading anything
+	rejected := func() bool {
+		conn, err := net.Dial("tcp", "127.0.0.1:7050")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1))
+		e, ok := err.(net.Error)
+		return !ok || !e.Timeout()
+	}
+
+	held, err := net.Dial("tcp", "127.0.0.1:7050")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	time.Sleep(50 * time.Millisecond)
+	if !rejected() {
+		t.Fatal("Connection over the port limit is accepted")
+	}
+
+	server.Quota().SetMaxConns(0)
+	server.Sources().SetMax(1)
+	if !rejected() {
+		t.Fatal("Connection over the source limit is accepted")
+	}
+	server.Sources().SetMax(2)
+	if rejected() {
+		t.Fatal("Connection under the limits is rejected")
+	}
+	if stats := server.Stats().Snapshot(); stats.Rejected != 2 {
+		t.Fatal("Wrong rejected connections:", stats.Rejected)
+	}
+	if state := server.Quota().State(); state.Rejected != 2 || server.Sources().Max() != 2 {
+		t.Fatal("Wrong quota state:", state, server.Sources().Max())
+	}
+}
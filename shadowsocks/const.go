@@ -1,6 +1,12 @@
 package shadowsocks
 
+import "time"
+
 const MAX_WRITE_CHUNK_SIZE = 2048
 const DEFAULT_BUF_SIZE = 3072
 const MAX_BUF_SIZE = 32768
 const MAX_READ_SIZE = 2048
+const MAX_UDP_PACKET_SIZE = 65535
+const DEFAULT_UDP_TIMEOUT = 60 * time.Second
+const MAX_RECORD_SIZE = 16384
+const DEFAULT_FALLBACK_DELAY = 30 * time.Second
@@ -1,7 +1,11 @@
 package shadowsocks
 
 import (
+	"bytes"
 	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
 	"io"
 )
 
@@ -73,11 +77,103 @@ type CipherFactory interface {
 	Wrap(PlainConn) SSConn
 }
 
+// ServerCipherFactory is implemented by cipher factories whose
+// protocol differs between the client and the server side.
+type ServerCipherFactory interface {
+	WrapServer(PlainConn) SSConn
+}
+
+// WrapServer wraps an accepted connection with f on the server side.
+func WrapServer(f CipherFactory, c PlainConn) SSConn {
+	if sf, ok := f.(ServerCipherFactory); ok {
+		return sf.WrapServer(c)
+	}
+	return f.Wrap(c)
+}
+
+// PacketCipher is implemented by cipher factories which are able to
+// encrypt the packets of UDP relay. Each packet is encrypted
+// independently with a random salt.
+type PacketCipher interface {
+	// SealPacket encrypts plain and appends the packet to dst.
+	SealPacket(dst, plain []byte) ([]byte, error)
+	// OpenPacket decrypts pkt and appends the plain text to dst.
+	OpenPacket(dst, pkt []byte) ([]byte, error)
+}
+
+// SessionPacketCipher is implemented by packet ciphers whose packets
+// belong to sessions with their own state, like Shadowsocks 2022.
+// Clients seal and open the packets of each session with a cipher
+// from NewPacketSession. Servers open the packets with
+// OpenSessionPacket, which also returns the cipher of the client's
+// session to seal the replies with.
+type SessionPacketCipher interface {
+	PacketCipher
+	NewPacketSession() (PacketCipher, error)
+	OpenSessionPacket(dst, pkt []byte) (plain []byte, session PacketCipher, err error)
+}
+
+// NewPacketSession returns the cipher of a new client session of c,
+// which is c itself if it has no sessions.
+func NewPacketSession(c PacketCipher) (PacketCipher, error) {
+	if sc, ok := c.(SessionPacketCipher); ok {
+		return sc.NewPacketSession()
+	}
+	return c, nil
+}
+
 type NewCipherFactoryFunc func([]byte) CipherFactory
 
 type CipherInfo struct {
 	newFactory NewCipherFactoryFunc
 	keySize    int
+	// psk is set if the cipher takes a base64 pre-shared key
+	// instead of a password.
+	psk bool
 }
 
 var Ciphers = map[string]*CipherInfo{}
+
+// NewKeyReader returns the key source of method. The password is
+// decoded as a base64 key if the method requires a pre-shared key,
+// otherwise the key is derived from the password.
+func NewKeyReader(method, password string) (io.Reader, error) {
+	cipherInfo, ok := Ciphers[method]
+	if !ok {
+		return nil, fmt.Errorf("Unknown cipher: %s", method)
+	}
+	if !cipherInfo.psk {
+		return NewKeyDeriver([]byte(password)), nil
+	}
+	return NewRawKeyReader(method, password)
+}
+
+// NewRawKeyReader returns the key source of method from a raw key in
+// base64, which must be of the key size of method.
+func NewRawKeyReader(method, key string) (io.Reader, error) {
+	cipherInfo, ok := Ciphers[method]
+	if !ok {
+		return nil, fmt.Errorf("Unknown cipher: %s", method)
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid base64 key for %s: %v", method, err)
+	}
+	if len(raw) != cipherInfo.keySize {
+		return nil, fmt.Errorf("Key of %s must be %d bytes, got %d", method, cipherInfo.keySize, len(raw))
+	}
+	return bytes.NewReader(raw), nil
+}
+
+// GenerateKey generates a random key of method in base64.
+func GenerateKey(method string) (string, error) {
+	cipherInfo, ok := Ciphers[method]
+	if !ok {
+		return "", fmt.Errorf("Unknown cipher: %s", method)
+	}
+	key := make([]byte, cipherInfo.keySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
@@ -36,6 +36,55 @@ func (a *AEADCipherFactory) Wrap(c PlainConn) SSConn {
 	return &AEADConn{conn: c, factory: a}
 }
 
+func (a *AEADCipherFactory) subkeyCipher(salt []byte) (aead cipher.AEAD, err error) {
+	h := hkdf.New(sha1.New, a.key, salt, []byte(HKDF_INFO))
+	skey := make([]byte, a.keySize)
+	if _, err = io.ReadFull(h, skey); err != nil {
+		return
+	}
+	return a.newCipher(skey)
+}
+
+// SealPacket implements PacketCipher. The packet is
+// [salt][encrypted payload][tag], sealed with a zero nonce.
+func (a *AEADCipherFactory) SealPacket(dst, plain []byte) ([]byte, error) {
+	salt := make([]byte, a.saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return dst, err
+	}
+	aead, err := a.subkeyCipher(salt)
+	if err != nil {
+		return dst, err
+	}
+	dst = append(dst, salt...)
+	return aead.Seal(dst, NewNonce(aead.NonceSize()), plain, nil), nil
+}
+
+// OpenPacket implements PacketCipher. The salts of the packets opened
+// are added to the salt filter, so that replayed packets are rejected.
+func (a *AEADCipherFactory) OpenPacket(dst, pkt []byte) ([]byte, error) {
+	if len(pkt) < a.saltSize {
+		return dst, ERR_AUTH_FAIL
+	}
+	salt := append([]byte(nil), pkt[:a.saltSize]...) // added asynchronously
+	if saltFilter.Contains(salt) {
+		return dst, ERR_DUP_SALT
+	}
+	aead, err := a.subkeyCipher(salt)
+	if err != nil {
+		return dst, err
+	}
+	if len(pkt) < a.saltSize+aead.Overhead() {
+		return dst, ERR_AUTH_FAIL
+	}
+	res, err := aead.Open(dst, NewNonce(aead.NonceSize()), pkt[a.saltSize:], nil)
+	if err != nil {
+		return dst, ERR_AUTH_FAIL
+	}
+	saltFilter.Add(salt)
+	return res, nil
+}
+
 // AEADCipherConn implements SSConn with given AEAD cipher.
 type AEADConn struct {
 	conn        PlainConn
@@ -44,6 +93,45 @@ type AEADConn struct {
 	readerAEAD  cipher.AEAD
 	writerNonce Nonce
 	writerAEAD  cipher.AEAD
+	// users is set on multi-user servers, where factory is replaced
+	// by the one of the identified user.
+	users  *UserTable
+	user   *ServerUser
+	source string
+	lchunk []byte
+}
+
+// identify finds the user whose key authenticates the first length
+// chunk. The chunk is kept in lchunk to be decrypted again.
+func (c *AEADConn) identify(salt []byte) (err error) {
+	var sealed, scratch []byte
+	candidates := c.users.Candidates(c.source)
+	for i, u := range candidates {
+		var aead cipher.AEAD
+		if aead, err = u.factory.subkeyCipher(salt); err != nil {
+			return
+		}
+		if sealed == nil {
+			sealed = make([]byte, LEN_SIZE+aead.Overhead())
+			if _, err = io.ReadFull(c.conn, sealed); err != nil {
+				return
+			}
+			scratch = make([]byte, 0, len(sealed))
+		}
+		if _, e := aead.Open(scratch, NewNonce(aead.NonceSize()), sealed, nil); e == nil {
+			c.readerAEAD, c.factory, c.user = aead, u.factory, u
+			c.lchunk = sealed
+			c.users.Remember(c.source, u, i)
+			return nil
+		}
+	}
+	c.users.Remember(c.source, nil, len(candidates))
+	return ERR_AUTH_FAIL
+}
+
+// User returns the identified user on multi-user servers.
+func (c *AEADConn) User() *ServerUser {
+	return c.user
 }
 
 func (c *AEADConn) SSRead(b *SSBuffer) (err error) {
@@ -51,20 +139,18 @@ func (c *AEADConn) SSRead(b *SSBuffer) (err error) {
 	var salt []byte
 	if firstTime {
 		salt = make([]byte, c.factory.saltSize)
-		_, err = io.ReadFull(c.conn.TCPConn, salt)
+		_, err = io.ReadFull(c.conn, salt)
 		if err != nil {
 			return
 		}
 		if saltFilter.Contains(salt) {
 			return ERR_DUP_SALT
 		}
-		h := hkdf.New(sha1.New, c.factory.key, salt, []byte(HKDF_INFO))
-		skey := make([]byte, c.factory.keySize)
-		_, err = io.ReadFull(h, skey)
-		if err != nil {
-			return
+		if c.users != nil {
+			err = c.identify(salt)
+		} else {
+			c.readerAEAD, err = c.factory.subkeyCipher(salt)
 		}
-		c.readerAEAD, err = c.factory.newCipher(skey)
 		if err != nil {
 			return
 		}
@@ -79,8 +165,10 @@ func (c *AEADConn) SSRead(b *SSBuffer) (err error) {
 	}
 
 	lbuf := b.buf[pos : pos+LEN_SIZE+TAG_SIZE]
-	_, err = io.ReadFull(c.conn.TCPConn, lbuf)
-	if err != nil {
+	if c.lchunk != nil { // read by identify
+		copy(lbuf, c.lchunk)
+		c.lchunk = nil
+	} else if _, err = io.ReadFull(c.conn, lbuf); err != nil {
 		return
 	}
 
@@ -101,7 +189,7 @@ func (c *AEADConn) SSRead(b *SSBuffer) (err error) {
 	}
 
 	dbuf := b.buf[pos : pos+n+TAG_SIZE]
-	_, err = io.ReadFull(c.conn.TCPConn, dbuf)
+	_, err = io.ReadFull(c.conn, dbuf)
 	if err != nil {
 		return
 	}
@@ -131,13 +219,7 @@ func (c *AEADConn) SSWrite(b *SSBuffer) (err error) {
 			return
 		}
 
-		h := hkdf.New(sha1.New, c.factory.key, salt, []byte(HKDF_INFO))
-		skey := make([]byte, c.factory.keySize)
-		_, err = io.ReadFull(h, skey)
-		if err != nil {
-			return
-		}
-		c.writerAEAD, err = c.factory.newCipher(skey)
+		c.writerAEAD, err = c.factory.subkeyCipher(salt)
 		if err != nil {
 			return
 		}
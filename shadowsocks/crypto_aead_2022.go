@@ -0,0 +1,386 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+	"lukechampine.com/blake3"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const SIP022_SUBKEY_CONTEXT = "shadowsocks 2022 session subkey"
+const SIP022_TIME_WINDOW = 30 * time.Second
+const SIP022_MAX_PADDING = 900
+const SIP022_REQUEST_HEADER_SIZE = 1 + 8 + 2
+
+var aes128gcm2022info = CipherInfo{
+	newFactory: newAES128GCM2022CipherFactory,
+	keySize:    16,
+	psk:        true,
+}
+
+var aes256gcm2022info = CipherInfo{
+	newFactory: newAES256GCM2022CipherFactory,
+	keySize:    32,
+	psk:        true,
+}
+
+var chacha20poly13052022info = CipherInfo{
+	newFactory: newChacha20Poly13052022CipherFactory,
+	keySize:    32,
+	psk:        true,
+}
+
+func init() {
+	Ciphers["2022-blake3-aes-128-gcm"] = &aes128gcm2022info
+	Ciphers["2022-blake3-aes-256-gcm"] = &aes256gcm2022info
+	Ciphers["2022-blake3-chacha20-poly1305"] = &chacha20poly13052022info
+}
+
+func newAES128GCM2022CipherFactory(key []byte) CipherFactory {
+	a := NewAEAD2022CipherFactory(newAESGCM, 16, key).(*AEAD2022CipherFactory)
+	a.block, _ = aes.NewCipher(key)
+	return a
+}
+
+func newAES256GCM2022CipherFactory(key []byte) CipherFactory {
+	a := NewAEAD2022CipherFactory(newAESGCM, 32, key).(*AEAD2022CipherFactory)
+	a.block, _ = aes.NewCipher(key)
+	return a
+}
+
+func newChacha20Poly13052022CipherFactory(key []byte) CipherFactory {
+	a := NewAEAD2022CipherFactory(chacha20poly1305.New, 32, key).(*AEAD2022CipherFactory)
+	a.xaead, _ = chacha20poly1305.NewX(key)
+	return a
+}
+
+// timedSaltPool remembers the salts seen within the time window.
+// Since the timestamps of Shadowsocks 2022 headers are checked,
+// older salts need not be remembered.
+type timedSaltPool struct {
+	lock   sync.Mutex
+	salts  map[string]time.Time
+	window time.Duration
+	clean  time.Time
+}
+
+// Add adds the salt to the pool. It returns false if the salt
+// is already in the pool.
+func (p *timedSaltPool) Add(salt []byte) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	if now.Sub(p.clean) > p.window {
+		for k, t := range p.salts {
+			if now.Sub(t) > p.window {
+				delete(p.salts, k)
+			}
+		}
+		p.clean = now
+	}
+	if t, ok := p.salts[string(salt)]; ok && now.Sub(t) <= p.window {
+		return false
+	}
+	p.salts[string(salt)] = now
+	return true
+}
+
+var saltPool2022 = &timedSaltPool{
+	salts:  map[string]time.Time{},
+	window: 2 * SIP022_TIME_WINDOW,
+}
+
+// AEAD2022CipherFactory implements CipherFactory with the ciphers
+// of Shadowsocks 2022 Edition.
+// Specification:
+// https://github.com/Shadowsocks-NET/shadowsocks-specs/blob/main/2022-1-shadowsocks-2022-edition.md
+type AEAD2022CipherFactory struct {
+	newCipher NewAEADCipherFunc
+	keySize   int
+	key       []byte
+	// UDP packets have their headers encrypted by block with AES, or
+	// are entirely sealed by xaead with ChaCha20-Poly1305.
+	block cipher.Block
+	xaead cipher.AEAD
+	// client is the session of the packets sealed and opened by the
+	// factory itself, and sessions are the ones of the clients on
+	// servers.
+	lock     sync.Mutex
+	client   *aead2022PacketSession
+	sessions map[uint64]*aead2022PacketSession
+	clean    time.Time
+}
+
+func NewAEAD2022CipherFactory(newCipher NewAEADCipherFunc, keySize int, key []byte) CipherFactory {
+	return &AEAD2022CipherFactory{
+		newCipher: newCipher,
+		keySize:   keySize,
+		key:       key,
+		sessions:  map[uint64]*aead2022PacketSession{},
+	}
+}
+
+func (a *AEAD2022CipherFactory) Wrap(c PlainConn) SSConn {
+	return &AEAD2022Conn{conn: c, factory: a, sent: make(chan bool)}
+}
+
+func (a *AEAD2022CipherFactory) WrapServer(c PlainConn) SSConn {
+	return &AEAD2022Conn{conn: c, factory: a, server: true}
+}
+
+func (a *AEAD2022CipherFactory) subkeyCipher(salt []byte) (cipher.AEAD, error) {
+	material := make([]byte, 0, len(a.key)+len(salt))
+	material = append(material, a.key...)
+	material = append(material, salt...)
+	skey := make([]byte, a.keySize)
+	blake3.DeriveKey(skey, SIP022_SUBKEY_CONTEXT, material)
+	return a.newCipher(skey)
+}
+
+// AEAD2022Conn implements SSConn with Shadowsocks 2022 protocol.
+// The first chunk read on the server side, which is the variable
+// length header of the request, has its padding removed and thus
+// starts with the target address as the other ciphers do.
+type AEAD2022Conn struct {
+	conn        PlainConn
+	factory     *AEAD2022CipherFactory
+	server      bool
+	readerNonce Nonce
+	readerAEAD  cipher.AEAD
+	writerNonce Nonce
+	writerAEAD  cipher.AEAD
+	rbuf        []byte
+	pending     []byte
+	// requestSalt is the salt of the request, which is echoed in
+	// the response header. On the client side, sent is closed
+	// once it is set.
+	requestSalt []byte
+	sent        chan bool
+}
+
+func checkTimestamp(b []byte) error {
+	ts := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	if d := time.Since(ts); d > SIP022_TIME_WINDOW || d < -SIP022_TIME_WINDOW {
+		return ERR_BAD_TIMESTAMP
+	}
+	return nil
+}
+
+// readSealed reads and decrypts a sealed chunk of size n. The returned
+// slice is valid until the next call.
+func (c *AEAD2022Conn) readSealed(n int) (plain []byte, err error) {
+	l := n + c.readerAEAD.Overhead()
+	if cap(c.rbuf) < l {
+		c.rbuf = make([]byte, l)
+	}
+	sealed := c.rbuf[:l]
+	if _, err = io.ReadFull(c.conn, sealed); err != nil {
+		return
+	}
+	if plain, err = c.readerAEAD.Open(sealed[:0], c.readerNonce, sealed, nil); err != nil {
+		return nil, ERR_AUTH_FAIL
+	}
+	c.readerNonce.Inc()
+	return
+}
+
+func (c *AEAD2022Conn) readHeader() (data []byte, err error) {
+	salt := make([]byte, c.factory.keySize)
+	if _, err = io.ReadFull(c.conn, salt); err != nil {
+		return
+	}
+	if c.readerAEAD, err = c.factory.subkeyCipher(salt); err != nil {
+		return
+	}
+	c.readerNonce = NewNonce(c.readerAEAD.NonceSize())
+
+	var fixed []byte
+	if c.server {
+		fixed, err = c.readSealed(SIP022_REQUEST_HEADER_SIZE)
+	} else {
+		fixed, err = c.readSealed(SIP022_REQUEST_HEADER_SIZE + len(salt))
+	}
+	if err != nil {
+		return
+	}
+	if (c.server && fixed[0] != 0x00) || (!c.server && fixed[0] != 0x01) {
+		return nil, ERR_BAD_HEADER_TYPE
+	}
+	if err = checkTimestamp(fixed[1:9]); err != nil {
+		return
+	}
+	if !c.server {
+		<-c.sent
+		if !bytes.Equal(fixed[9:9+len(salt)], c.requestSalt) {
+			return nil, ERR_BAD_REQUEST_SALT
+		}
+	}
+	if !saltPool2022.Add(salt) {
+		return nil, ERR_DUP_SALT
+	}
+	n := int(binary.BigEndian.Uint16(fixed[len(fixed)-LEN_SIZE:]))
+
+	if data, err = c.readSealed(n); err != nil {
+		return
+	}
+	if !c.server {
+		return
+	}
+	c.requestSalt = salt
+	// strip the padding after the address
+	var ln int
+	if _, ln, err = ParseAddress(data); err != nil {
+		return
+	}
+	if len(data) < ln+LEN_SIZE {
+		return nil, ERR_INVALID_ADDR
+	}
+	pad := int(binary.BigEndian.Uint16(data[ln:]))
+	if len(data) < ln+LEN_SIZE+pad {
+		return nil, ERR_INVALID_CHUNK_SIZE
+	}
+	copy(data[ln:], data[ln+LEN_SIZE+pad:])
+	data = data[:len(data)-LEN_SIZE-pad]
+	return
+}
+
+func (c *AEAD2022Conn) SSRead(b *SSBuffer) (err error) {
+	data := c.pending
+	if len(data) == 0 {
+		if c.readerAEAD == nil {
+			data, err = c.readHeader()
+		} else {
+			var lbuf []byte
+			if lbuf, err = c.readSealed(LEN_SIZE); err != nil {
+				return
+			}
+			data, err = c.readSealed(int(binary.BigEndian.Uint16(lbuf)))
+		}
+		if err != nil {
+			return
+		}
+	}
+	// chunks may be larger than the buffer, keep the rest for later
+	if cap(b.buf) == len(b.buf) {
+		if err = b.Expand(len(b.buf) + len(data)); err != nil {
+			return
+		}
+	}
+	n := len(data)
+	if n > cap(b.buf)-len(b.buf) {
+		n = cap(b.buf) - len(b.buf)
+	}
+	b.buf = append(b.buf, data[:n]...)
+	c.pending = data[n:]
+	return
+}
+
+func (c *AEAD2022Conn) seal(dst, plain []byte) []byte {
+	dst = c.writerAEAD.Seal(dst, c.writerNonce, plain, nil)
+	c.writerNonce.Inc()
+	return dst
+}
+
+func (c *AEAD2022Conn) SSWrite(b *SSBuffer) (err error) {
+	if len(b.buf) == 0 {
+		return
+	}
+	data := b.buf
+	var out []byte
+	if c.writerAEAD == nil {
+		salt := make([]byte, c.factory.keySize)
+		if _, err = rand.Read(salt); err != nil {
+			return
+		}
+		if c.writerAEAD, err = c.factory.subkeyCipher(salt); err != nil {
+			return
+		}
+		c.writerNonce = NewNonce(c.writerAEAD.NonceSize())
+		out = make([]byte, 0, len(salt)+len(data)+SIP022_MAX_PADDING+256)
+		out = append(out, salt...)
+		if c.server {
+			s := len(data)
+			if s > MAX_WRITE_CHUNK_SIZE {
+				s = MAX_WRITE_CHUNK_SIZE
+			}
+			fixed := make([]byte, 0, SIP022_REQUEST_HEADER_SIZE+len(salt))
+			fixed = append(fixed, 0x01)
+			fixed = binary.BigEndian.AppendUint64(fixed, uint64(time.Now().Unix()))
+			fixed = append(fixed, c.requestSalt...)
+			fixed = binary.BigEndian.AppendUint16(fixed, uint16(s))
+			out = c.seal(out, fixed)
+			out = c.seal(out, data[:s])
+			data = data[s:]
+		} else {
+			c.requestSalt = salt
+			close(c.sent)
+			var ln int
+			if _, ln, err = ParseAddress(data); err != nil {
+				return
+			}
+			if len(data) < ln {
+				return ERR_INVALID_ADDR
+			}
+			s := len(data) - ln
+			if s > MAX_WRITE_CHUNK_SIZE {
+				s = MAX_WRITE_CHUNK_SIZE
+			}
+			pad := 0
+			if s == 0 {
+				var r *big.Int
+				if r, err = rand.Int(rand.Reader, big.NewInt(SIP022_MAX_PADDING)); err != nil {
+					return
+				}
+				pad = int(r.Int64()) + 1
+			}
+			header := make([]byte, 0, ln+LEN_SIZE+pad+s)
+			header = append(header, data[:ln]...)
+			header = binary.BigEndian.AppendUint16(header, uint16(pad))
+			header = append(header, make([]byte, pad)...)
+			header = append(header, data[ln:ln+s]...)
+			fixed := make([]byte, 0, SIP022_REQUEST_HEADER_SIZE)
+			fixed = append(fixed, 0x00)
+			fixed = binary.BigEndian.AppendUint64(fixed, uint64(time.Now().Unix()))
+			fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(header)))
+			out = c.seal(out, fixed)
+			out = c.seal(out, header)
+			data = data[ln+s:]
+		}
+	}
+
+	lbuf := make([]byte, LEN_SIZE)
+	for len(data) > 0 {
+		s := len(data)
+		if s > MAX_WRITE_CHUNK_SIZE {
+			s = MAX_WRITE_CHUNK_SIZE
+		}
+		binary.BigEndian.PutUint16(lbuf, uint16(s))
+		out = c.seal(out, lbuf)
+		out = c.seal(out, data[:s])
+		data = data[s:]
+	}
+	if _, err = c.conn.TCPConn.Write(out); err != nil {
+		return
+	}
+	b.buf = b.buf[:0]
+	return
+}
+
+func (c *AEAD2022Conn) Close() (err error) {
+	return c.conn.Close()
+}
+
+func (c *AEAD2022Conn) Alive() bool {
+	return c.conn.Alive()
+}
+
+func (c *AEAD2022Conn) RemoteAddr() string {
+	return c.conn.RemoteAddr()
+}
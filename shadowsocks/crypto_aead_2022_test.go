@@ -0,0 +1,176 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"golang.org/x/net/proxy"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAEAD2022(t *testing.T) {
+	keys := map[string]string{
+		"2022-blake3-aes-128-gcm":       "AAECAwQFBgcICQoLDA0ODw==",
+		"2022-blake3-aes-256-gcm":       "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
+		"2022-blake3-chacha20-poly1305": "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
+	}
+	port := uint16(7010)
+	for method, psk := range keys {
+		port++
+		serverConfig := DefaultConfig()
+		serverConfig.ServerHost = "127.0.0.1"
+		serverConfig.ServerPort = port
+		serverConfig.KeyDeriver, _ = NewKeyReader(method, psk)
+		serverConfig.Method = method
+		server, err := NewServerContext(serverConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Run()
+		clientConfig := DefaultConfig()
+		clientConfig.ServerHost = "127.0.0.1"
+		clientConfig.ServerPort = port
+		clientConfig.LocalPort = port - 1000
+		clientConfig.KeyDeriver, _ = NewKeyReader(method, psk)
+		clientConfig.Method = method
+		client, err := NewClientContext(clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go client.Run()
+		socks, _ := proxy.SOCKS5("tcp", WrapAddr("127.0.0.1", port-1000), nil, proxy.Direct)
+		requester := &http.Client{
+			Transport: &http.Transport{
+				Dial: socks.Dial,
+			},
+		}
+		for i := 0; i < 3; i++ {
+			request, err := requester.Get("http://127.0.0.1:8000/hello")
+			if err != nil {
+				t.Fatal(method, err)
+			}
+			content, err := ioutil.ReadAll(request.Body)
+			if err != nil {
+				t.Fatal(method, err)
+			}
+			if string(content) != "Hello" {
+				t.Fatal(method, "Wrong content:", string(content))
+			}
+		}
+		client.Stop()
+		client.Wait()
+		server.Stop()
+		server.Wait()
+	}
+}
+
+func TestAEAD2022KeyLength(t *testing.T) {
+	if _, err := NewKeyReader("2022-blake3-aes-256-gcm", "AAECAwQFBgcICQoLDA0ODw=="); err == nil {
+		t.Fatal("Short key is accepted")
+	}
+	if _, err := NewKeyReader("2022-blake3-aes-128-gcm", "not base64"); err == nil {
+		t.Fatal("Invalid base64 key is accepted")
+	}
+}
+
+func TestAEAD2022UDP(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, MAX_UDP_PACKET_SIZE)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	header, _ := AppendAddress(nil, "127.0.0.1", uint16(echo.LocalAddr().(*net.UDPAddr).Port))
+	plain := append(header, "Hello"...)
+
+	port := uint16(7190)
+	for _, method := range []string{"2022-blake3-aes-128-gcm", "2022-blake3-chacha20-poly1305"} {
+		port++
+		psk := "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8="
+		if method == "2022-blake3-aes-128-gcm" {
+			psk = "AAECAwQFBgcICQoLDA0ODw=="
+		}
+		serverConfig := DefaultConfig()
+		serverConfig.ServerHost = "127.0.0.1"
+		serverConfig.ServerPort = port
+		serverConfig.KeyDeriver, _ = NewKeyReader(method, psk)
+		serverConfig.Method = method
+		server, err := NewServerContext(serverConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Run()
+
+		info := Ciphers[method]
+		key := make([]byte, info.keySize)
+		keyReader, _ := NewKeyReader(method, psk)
+		keyReader.Read(key)
+		cipher, err := NewPacketSession(info.newFactory(key).(PacketCipher))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(port)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, MAX_UDP_PACKET_SIZE)
+		var pkt []byte
+		for i := 0; i < 3; i++ {
+			if pkt, err = cipher.SealPacket(nil, plain); err != nil {
+				t.Fatal(err)
+			}
+			conn.Write(pkt)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatal(method, err)
+			}
+			res, err := cipher.OpenPacket(nil, buf[:n])
+			if err != nil {
+				t.Fatal(method, err)
+			}
+			if !bytes.Equal(res, plain) {
+				t.Fatal(method, "Wrong content:", res)
+			}
+			// the replies are not accepted twice either
+			if _, err = cipher.OpenPacket(nil, buf[:n]); err != ERR_DUP_PACKET {
+				t.Fatal(method, "Wrong error of a replayed reply:", err)
+			}
+		}
+		// the replayed packet is dropped
+		conn.Write(pkt)
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err = conn.Read(buf); err == nil {
+			t.Fatal(method, "Replayed packet is relayed")
+		}
+		conn.Close()
+		server.Stop()
+		server.Wait()
+	}
+}
+
+func TestPacketWindow(t *testing.T) {
+	var w packetWindow
+	for _, c := range []struct {
+		id     uint64
+		accept bool
+	}{
+		{0, true}, {0, false}, {2, true}, {1, true}, {1, false},
+		{100, true}, {37, true}, {36, false}, {100, false}, {99, true},
+	} {
+		if w.Accept(c.id) != c.accept {
+			t.Fatalf("Wrong result of %d", c.id)
+		}
+	}
+}
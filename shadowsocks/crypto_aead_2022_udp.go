@@ -0,0 +1,305 @@
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SIP022_PACKET_HEADER_SIZE is the size of the session ID and the
+// packet ID heading every UDP packet.
+const SIP022_PACKET_HEADER_SIZE = 8 + 8
+
+// SIP022_SESSION_TIMEOUT is how long a server remembers an idle
+// session of a client.
+const SIP022_SESSION_TIMEOUT = 2 * DEFAULT_UDP_TIMEOUT
+
+// packetWindow is a sliding window filter of the packet IDs of a
+// session, accepting every ID once unless it is 64 or more behind
+// the highest one.
+type packetWindow struct {
+	top  uint64 // the highest ID accepted plus 1, 0 for none
+	bits uint64 // bit i is set if top-1-i is accepted
+}
+
+// Accept checks id, and records it if it is accepted.
+func (w *packetWindow) Accept(id uint64) bool {
+	if id >= w.top {
+		if shift := id + 1 - w.top; shift < 64 {
+			w.bits <<= shift
+		} else {
+			w.bits = 0
+		}
+		w.bits |= 1
+		w.top = id + 1
+		return true
+	}
+	d := w.top - 1 - id
+	if d >= 64 || w.bits&(1<<d) != 0 {
+		return false
+	}
+	w.bits |= 1 << d
+	return true
+}
+
+// sessionCipher returns the AEAD of the session id with AES.
+func (a *AEAD2022CipherFactory) sessionCipher(id uint64) (cipher.AEAD, error) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], id)
+	return a.subkeyCipher(b[:])
+}
+
+// sealPacket seals body as packet packetID of the session, whose AEAD
+// is aead with AES. Packets are either
+// [AES(session ID, packet ID)][AEAD(body)] with AES, or
+// [nonce][XChaCha20-Poly1305(session ID, packet ID, body)].
+func (a *AEAD2022CipherFactory) sealPacket(dst []byte, session, packetID uint64, aead cipher.AEAD, body []byte) ([]byte, error) {
+	header := make([]byte, SIP022_PACKET_HEADER_SIZE, SIP022_PACKET_HEADER_SIZE+len(body))
+	binary.BigEndian.PutUint64(header, session)
+	binary.BigEndian.PutUint64(header[8:], packetID)
+	if a.xaead != nil {
+		nonce := make([]byte, a.xaead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return dst, err
+		}
+		dst = append(dst, nonce...)
+		return a.xaead.Seal(dst, nonce, append(header, body...), nil), nil
+	}
+	if a.block == nil {
+		return dst, ERR_UNIMPLEMENTED
+	}
+	n := len(dst)
+	dst = append(dst, header...)
+	a.block.Encrypt(dst[n:], dst[n:])
+	// the nonce is the last 12 bytes of the plain header
+	return aead.Seal(dst, header[4:], body, nil), nil
+}
+
+// openPacket decrypts pkt into its plain header and body. With AES,
+// the AEAD of the session is given by session.
+func (a *AEAD2022CipherFactory) openPacket(pkt []byte, session func(id uint64) (cipher.AEAD, error)) (plain []byte, aead cipher.AEAD, err error) {
+	if a.xaead != nil {
+		n := a.xaead.NonceSize()
+		if len(pkt) < n+SIP022_PACKET_HEADER_SIZE+a.xaead.Overhead() {
+			return nil, nil, ERR_AUTH_FAIL
+		}
+		if plain, err = a.xaead.Open(nil, pkt[:n], pkt[n:], nil); err != nil {
+			return nil, nil, ERR_AUTH_FAIL
+		}
+		return
+	}
+	if a.block == nil {
+		return nil, nil, ERR_UNIMPLEMENTED
+	}
+	if len(pkt) < SIP022_PACKET_HEADER_SIZE {
+		return nil, nil, ERR_AUTH_FAIL
+	}
+	header := make([]byte, SIP022_PACKET_HEADER_SIZE, len(pkt))
+	a.block.Decrypt(header, pkt[:SIP022_PACKET_HEADER_SIZE])
+	if aead, err = session(binary.BigEndian.Uint64(header)); err != nil {
+		return
+	}
+	if len(pkt) < SIP022_PACKET_HEADER_SIZE+aead.Overhead() {
+		return nil, nil, ERR_AUTH_FAIL
+	}
+	if plain, err = aead.Open(header, header[4:], pkt[SIP022_PACKET_HEADER_SIZE:], nil); err != nil {
+		return nil, nil, ERR_AUTH_FAIL
+	}
+	return
+}
+
+// aead2022PacketSession is a UDP session of Shadowsocks 2022. It seals
+// its packets with increasing packet IDs, and opens the packets of the
+// session of the peer once each.
+type aead2022PacketSession struct {
+	factory  *AEAD2022CipherFactory
+	server   bool
+	id       uint64
+	aead     cipher.AEAD // of id with AES
+	lock     sync.Mutex
+	next     uint64
+	started  bool // set once the session of the peer is known
+	peer     uint64
+	peerAEAD cipher.AEAD // of peer with AES
+	window   packetWindow
+	last     time.Time // of the last packet from the client on servers
+}
+
+func (a *AEAD2022CipherFactory) newPacketSession(server bool) (s *aead2022PacketSession, err error) {
+	var b [8]byte
+	if _, err = rand.Read(b[:]); err != nil {
+		return
+	}
+	s = &aead2022PacketSession{factory: a, server: server, id: binary.BigEndian.Uint64(b[:])}
+	if a.xaead == nil {
+		if s.aead, err = a.sessionCipher(s.id); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// NewPacketSession implements SessionPacketCipher.
+func (a *AEAD2022CipherFactory) NewPacketSession() (PacketCipher, error) {
+	return a.newPacketSession(false)
+}
+
+// SealPacket implements PacketCipher with a client session shared by
+// all the packets of a, which suits a single socket only.
+func (a *AEAD2022CipherFactory) SealPacket(dst, plain []byte) ([]byte, error) {
+	s, err := a.clientSession()
+	if err != nil {
+		return dst, err
+	}
+	return s.SealPacket(dst, plain)
+}
+
+// OpenPacket implements PacketCipher with the session of SealPacket.
+func (a *AEAD2022CipherFactory) OpenPacket(dst, pkt []byte) ([]byte, error) {
+	s, err := a.clientSession()
+	if err != nil {
+		return dst, err
+	}
+	return s.OpenPacket(dst, pkt)
+}
+
+func (a *AEAD2022CipherFactory) clientSession() (s *aead2022PacketSession, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.client == nil {
+		a.client, err = a.newPacketSession(false)
+	}
+	return a.client, err
+}
+
+// OpenSessionPacket implements SessionPacketCipher. The sessions of
+// the clients are forgotten after SIP022_SESSION_TIMEOUT without
+// packets.
+func (a *AEAD2022CipherFactory) OpenSessionPacket(dst, pkt []byte) (plain []byte, session PacketCipher, err error) {
+	var s *aead2022PacketSession
+	var aead cipher.AEAD
+	if plain, aead, err = a.openPacket(pkt, func(id uint64) (cipher.AEAD, error) {
+		a.lock.Lock()
+		known := a.sessions[id]
+		a.lock.Unlock()
+		if known != nil {
+			return known.peerAEAD, nil
+		}
+		return a.sessionCipher(id)
+	}); err != nil {
+		return dst, nil, err
+	}
+	id := binary.BigEndian.Uint64(plain)
+	now := time.Now()
+	a.lock.Lock()
+	if now.Sub(a.clean) > SIP022_SESSION_TIMEOUT {
+		for k, s := range a.sessions {
+			if now.Sub(s.last) > SIP022_SESSION_TIMEOUT {
+				delete(a.sessions, k)
+			}
+		}
+		a.clean = now
+	}
+	if s = a.sessions[id]; s == nil {
+		if s, err = a.newPacketSession(true); err == nil {
+			s.started, s.peer, s.peerAEAD = true, id, aead
+			a.sessions[id] = s
+		}
+	}
+	if s != nil {
+		s.last = now
+	}
+	a.lock.Unlock()
+	if err != nil {
+		return dst, nil, err
+	}
+	if dst, err = s.accept(dst, plain, aead); err != nil {
+		return dst, nil, err
+	}
+	return dst, s, nil
+}
+
+// SealPacket implements PacketCipher. The main header is
+// [type][timestamp][client session ID on servers][padding length].
+func (s *aead2022PacketSession) SealPacket(dst, plain []byte) ([]byte, error) {
+	s.lock.Lock()
+	packetID, peer := s.next, s.peer
+	s.next++
+	s.lock.Unlock()
+	body := make([]byte, 0, 1+8+8+LEN_SIZE+len(plain))
+	if s.server {
+		body = append(body, 0x01)
+		body = binary.BigEndian.AppendUint64(body, uint64(time.Now().Unix()))
+		body = binary.BigEndian.AppendUint64(body, peer)
+	} else {
+		body = append(body, 0x00)
+		body = binary.BigEndian.AppendUint64(body, uint64(time.Now().Unix()))
+	}
+	body = binary.BigEndian.AppendUint16(body, 0) // no padding
+	body = append(body, plain...)
+	return s.factory.sealPacket(dst, s.id, packetID, s.aead, body)
+}
+
+// OpenPacket implements PacketCipher. A client follows the server to
+// a new session if the server restarts.
+func (s *aead2022PacketSession) OpenPacket(dst, pkt []byte) ([]byte, error) {
+	plain, aead, err := s.factory.openPacket(pkt, func(id uint64) (cipher.AEAD, error) {
+		s.lock.Lock()
+		started, peer, aead := s.started, s.peer, s.peerAEAD
+		s.lock.Unlock()
+		if started && peer == id {
+			return aead, nil
+		}
+		return s.factory.sessionCipher(id)
+	})
+	if err != nil {
+		return dst, err
+	}
+	return s.accept(dst, plain, aead)
+}
+
+// accept checks the main header of a packet from the peer, and appends
+// its address and payload to dst if it is not replayed.
+func (s *aead2022PacketSession) accept(dst, plain []byte, aead cipher.AEAD) ([]byte, error) {
+	id := binary.BigEndian.Uint64(plain)
+	packetID := binary.BigEndian.Uint64(plain[8:])
+	body := plain[SIP022_PACKET_HEADER_SIZE:]
+	typ, n := byte(0x00), 1+8+LEN_SIZE
+	if !s.server {
+		typ, n = 0x01, n+8
+	}
+	if len(body) < n {
+		return dst, ERR_INVALID_CHUNK_SIZE
+	}
+	if body[0] != typ {
+		return dst, ERR_BAD_HEADER_TYPE
+	}
+	if err := checkTimestamp(body[1:9]); err != nil {
+		return dst, err
+	}
+	if !s.server && binary.BigEndian.Uint64(body[9:17]) != s.id {
+		return dst, ERR_BAD_SESSION
+	}
+	pad := int(binary.BigEndian.Uint16(body[n-LEN_SIZE:]))
+	if len(body) < n+pad {
+		return dst, ERR_INVALID_CHUNK_SIZE
+	}
+	s.lock.Lock()
+	if !s.started || s.peer != id {
+		s.started, s.peer, s.peerAEAD, s.window = true, id, aead, packetWindow{}
+	}
+	ok := s.window.Accept(packetID)
+	s.lock.Unlock()
+	if !ok {
+		return dst, ERR_DUP_PACKET
+	}
+	return append(dst, body[n+pad:]...), nil
+}
+
+// String returns the ID of the session.
+func (s *aead2022PacketSession) String() string {
+	return fmt.Sprintf("%016x", s.id)
+}
@@ -36,6 +36,38 @@ func (s *StreamCipherFactory) Wrap(conn PlainConn) SSConn {
 	return &StreamCipherConn{conn: conn, factory: s}
 }
 
+// SealPacket implements PacketCipher. The packet is [iv][encrypted payload].
+func (s *StreamCipherFactory) SealPacket(dst, plain []byte) ([]byte, error) {
+	iv := make([]byte, s.ivSize)
+	if _, err := rand.Read(iv); err != nil {
+		return dst, err
+	}
+	stream, err := s.newEncipher(s.key, iv)
+	if err != nil {
+		return dst, err
+	}
+	pos := len(dst)
+	dst = append(dst, iv...)
+	dst = append(dst, plain...)
+	stream.XORKeyStream(dst[pos+len(iv):], dst[pos+len(iv):])
+	return dst, nil
+}
+
+// OpenPacket implements PacketCipher.
+func (s *StreamCipherFactory) OpenPacket(dst, pkt []byte) ([]byte, error) {
+	if len(pkt) < s.ivSize {
+		return dst, ERR_AUTH_FAIL
+	}
+	stream, err := s.newDecipher(s.key, pkt[:s.ivSize])
+	if err != nil {
+		return dst, err
+	}
+	pos := len(dst)
+	dst = append(dst, pkt[s.ivSize:]...)
+	stream.XORKeyStream(dst[pos:], dst[pos:])
+	return dst, nil
+}
+
 // StreamCipherConn implements SSConn with given stream cipher.
 type StreamCipherConn struct {
 	conn         PlainConn
@@ -47,7 +79,7 @@ type StreamCipherConn struct {
 func (s *StreamCipherConn) SSRead(b *SSBuffer) (err error) {
 	if s.readerStream == nil {
 		iv := make([]byte, s.factory.ivSize)
-		_, err = io.ReadFull(s.conn.TCPConn, iv)
+		_, err = io.ReadFull(s.conn, iv)
 		if err != nil {
 			return
 		}
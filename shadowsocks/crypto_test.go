@@ -0,0 +1,43 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestRawKey(t *testing.T) {
+	for method, size := range map[string]int{"aes-128-gcm": 16, "chacha20-ietf-poly1305": 32} {
+		key, err := GenerateKey(method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, _ := GenerateKey(method)
+		if key == again {
+			t.Fatal("Same key is generated twice:", key)
+		}
+		reader, err := NewRawKeyReader(method, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := ioutil.ReadAll(reader)
+		if len(raw) != size {
+			t.Fatalf("Wrong key size of %s: %d", method, len(raw))
+		}
+		// the raw key is used as is rather than derived
+		derived := make([]byte, size)
+		DeriveKey(derived, []byte(key))
+		if bytes.Equal(raw, derived) {
+			t.Fatal("Raw key is derived")
+		}
+	}
+	if _, err := NewRawKeyReader("aes-256-gcm", "AAECAwQFBgcICQoLDA0ODw=="); err == nil {
+		t.Fatal("Short key is accepted")
+	}
+	if _, err := NewRawKeyReader("aes-128-gcm", "not base64"); err == nil {
+		t.Fatal("Invalid base64 key is accepted")
+	}
+	if _, err := GenerateKey("unknown"); err == nil {
+		t.Fatal("Key of unknown cipher is generated")
+	}
+}
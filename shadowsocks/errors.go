@@ -43,13 +43,26 @@ var ERR_SOCKS5_COMMAND_NOT_SUPPORTED = NewError("Unsupported socks5 command")
 
 var ERR_AUTH_FAIL = NewAuthError("Authentication failure")
 var ERR_DUP_SALT = NewAuthError("Duplicated salt (maybe replay attack)")
+var ERR_BAD_TIMESTAMP = NewAuthError("Bad timestamp (maybe replay attack)")
+var ERR_BAD_HEADER_TYPE = NewAuthError("Bad header type")
+var ERR_BAD_REQUEST_SALT = NewAuthError("Response does not match request salt")
+var ERR_BAD_SESSION = NewAuthError("Response does not match client session")
+var ERR_DUP_PACKET = NewAuthError("Duplicated packet (maybe replay attack)")
+var ERR_BANNED = NewAuthError("Source is banned")
 var ERR_INVALID_CHUNK_SIZE = NewError("Invalid chunk size")
 var ERR_MAX_CHUNK_SIZE_EXCEED = NewError("Maximum chunk size exceeded")
 
 var ERR_SERVER_NOT_EXIST = NewError("Server does not exist")
+var ERR_USER_NOT_EXIST = NewError("User does not exist")
+var ERR_NO_SERVER = NewError("No server available")
+var ERR_QUOTA_EXCEEDED = NewError("Quota exceeded")
+var ERR_TOO_MANY_CONNS = NewError("Too many connections")
 var ERR_UNIMPLEMENTED = NewError("Unimplemented")
 var ERR_INVALID_ADDR_TYPE = NewError("Invalid address type")
 
 var ERR_BUF_SIZE_EXCEED = NewError("Maximum buffer size exceeded")
 
 var ERR_INVALID_ADDR = NewError("Invalid address")
+var ERR_SNIFF_INCOMPLETE = NewError("Incomplete data to sniff")
+var ERR_SNIFF_FAILED = NewError("No host name sniffed")
+var ERR_FAKE_IP_NOT_MAPPED = NewError("Fake IP is not mapped to any domain")
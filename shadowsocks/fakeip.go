@@ -0,0 +1,332 @@
+package shadowsocks
+
+import (
+	"container/list"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_FAKE_IP_RANGE  = "198.18.0.0/15"
+	DEFAULT_FAKE_IP6_RANGE = "fc00::/18"
+	// TTL of the fake answers, short so that the clients query again
+	// after the mappings are evicted
+	FAKE_IP_TTL = 1
+	// Delay of saving the mappings after they change, as the client may
+	// be killed without stopping
+	FAKE_IP_SAVE_DELAY = time.Second
+	// Default and maximum numbers of mappings, whatever the ranges are
+	DEFAULT_FAKE_IP_ENTRIES = 65536
+	MAX_FAKE_IP_ENTRIES     = 1 << 24
+)
+
+type fakeIPEntry struct {
+	domain string
+	offset uint32
+}
+
+// FakeIPPool maps the domains queried to fake addresses in reserved
+// ranges, so that the transparently proxied connections to the fake
+// addresses are forwarded to the domains. A domain has the addresses
+// of the same offset in the IPv4 and the IPv6 ranges. The least
+// recently used mappings are evicted once all the addresses are
+// mapped, and the mappings may be persisted in a file to survive
+// restarts.
+type FakeIPPool struct {
+	lock     sync.Mutex
+	net4     *net.IPNet
+	net6     *net.IPNet
+	capacity uint32
+	next     uint32
+	lru      *list.List // of *fakeIPEntry, the most recently used first
+	domains  map[string]*list.Element
+	offsets  map[uint32]*list.Element
+	path     string
+	timer    *time.Timer
+	saving   sync.Mutex // held while writing the file
+}
+
+// NewFakeIPPool creates a pool of the addresses in the CIDR ranges
+// range4 and range6, either of which may be empty to disable fake
+// addresses of its family. At most entries domains are mapped, or
+// DEFAULT_FAKE_IP_ENTRIES if entries is 0, and fewer if the ranges
+// are smaller.
+func NewFakeIPPool(range4, range6 string, entries int) (p *FakeIPPool, err error) {
+	if entries == 0 {
+		entries = DEFAULT_FAKE_IP_ENTRIES
+	}
+	if entries < 0 || entries > MAX_FAKE_IP_ENTRIES {
+		return nil, fmt.Errorf("Invalid number of fake IP entries: %d", entries)
+	}
+	p = &FakeIPPool{
+		capacity: uint32(entries),
+		next:     1,
+		lru:      list.New(),
+		domains:  map[string]*list.Element{},
+		offsets:  map[uint32]*list.Element{},
+	}
+	if range4 != "" {
+		if p.net4, err = parseFakeIPRange(range4, net.IPv4len); err != nil {
+			return nil, err
+		}
+		// without the network and the broadcast addresses
+		if size := fakeIPRangeSize(p.net4) - 2; size < p.capacity {
+			p.capacity = size
+		}
+	}
+	if range6 != "" {
+		if p.net6, err = parseFakeIPRange(range6, net.IPv6len); err != nil {
+			return nil, err
+		}
+		if size := fakeIPRangeSize(p.net6) - 1; size < p.capacity {
+			p.capacity = size
+		}
+	}
+	if p.net4 == nil && p.net6 == nil {
+		return nil, fmt.Errorf("No fake IP range")
+	}
+	return
+}
+
+func parseFakeIPRange(s string, length int) (*net.IPNet, error) {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil || len(n.IP) != length {
+		return nil, fmt.Errorf("Invalid fake IP range: %s", s)
+	}
+	if ones, bits := n.Mask.Size(); bits-ones < 2 {
+		return nil, fmt.Errorf("Fake IP range is too small: %s", s)
+	}
+	return n, nil
+}
+
+// fakeIPRangeSize returns the number of addresses of n, at most
+// MAX_FAKE_IP_ENTRIES.
+func fakeIPRangeSize(n *net.IPNet) uint32 {
+	ones, bits := n.Mask.Size()
+	if bits-ones >= 24 {
+		return MAX_FAKE_IP_ENTRIES
+	}
+	return 1 << uint(bits-ones)
+}
+
+// fakeIPAt returns the address at offset in n.
+func fakeIPAt(n *net.IPNet, offset uint32) net.IP {
+	ip := append(net.IP(nil), n.IP...)
+	tail := ip[len(ip)-4:]
+	binary.BigEndian.PutUint32(tail, binary.BigEndian.Uint32(tail)+offset)
+	return ip
+}
+
+// offsetOf returns the offset of ip in the ranges, or 0 if ip is not
+// a fake address.
+func (p *FakeIPPool) offsetOf(ip net.IP) uint32 {
+	n := p.net6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, n = ip4, p.net4
+	}
+	if n == nil || !n.Contains(ip) {
+		return 0
+	}
+	offset := binary.BigEndian.Uint32(ip[len(ip)-4:]) - binary.BigEndian.Uint32(n.IP[len(n.IP)-4:])
+	if offset == 0 || offset > p.capacity || !fakeIPAt(n, offset).Equal(ip) {
+		return 0
+	}
+	return offset
+}
+
+// addresses returns the fake addresses at offset, nil for the
+// disabled families.
+func (p *FakeIPPool) addresses(offset uint32) (ip4, ip6 net.IP) {
+	if p.net4 != nil {
+		ip4 = fakeIPAt(p.net4, offset)
+	}
+	if p.net6 != nil {
+		ip6 = fakeIPAt(p.net6, offset)
+	}
+	return
+}
+
+// Lookup returns the fake addresses of domain, mapping it to the next
+// free addresses or the least recently used ones if it is not mapped.
+func (p *FakeIPPool) Lookup(domain string) (ip4, ip6 net.IP) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if e, ok := p.domains[domain]; ok {
+		p.lru.MoveToFront(e)
+		return p.addresses(e.Value.(*fakeIPEntry).offset)
+	}
+	var offset uint32
+	if uint32(len(p.offsets)) < p.capacity {
+		for p.offsets[p.next] != nil {
+			p.next = p.next%p.capacity + 1
+		}
+		offset = p.next
+		p.next = p.next%p.capacity + 1
+	} else {
+		e := p.lru.Back()
+		entry := e.Value.(*fakeIPEntry)
+		p.lru.Remove(e)
+		delete(p.domains, entry.domain)
+		delete(p.offsets, entry.offset)
+		offset = entry.offset
+	}
+	p.add(domain, offset)
+	p.changed()
+	return p.addresses(offset)
+}
+
+// add maps domain to offset. It must be called with the lock held.
+func (p *FakeIPPool) add(domain string, offset uint32) {
+	e := p.lru.PushFront(&fakeIPEntry{domain: domain, offset: offset})
+	p.domains[domain] = e
+	p.offsets[offset] = e
+}
+
+// Contains checks whether ip is in the fake IP ranges, mapped or not.
+func (p *FakeIPPool) Contains(ip net.IP) bool {
+	return p.net4 != nil && p.net4.Contains(ip) || p.net6 != nil && p.net6.Contains(ip)
+}
+
+// Domain returns the domain mapped to ip, or an empty string.
+func (p *FakeIPPool) Domain(ip net.IP) string {
+	offset := p.offsetOf(ip)
+	if offset == 0 {
+		return ""
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	e, ok := p.offsets[offset]
+	if !ok {
+		return ""
+	}
+	p.lru.MoveToFront(e)
+	return e.Value.(*fakeIPEntry).domain
+}
+
+// Len returns the number of the domains mapped.
+func (p *FakeIPPool) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.offsets)
+}
+
+// Answer builds the response of a query of type A or AAAA with the
+// fake address of the domain queried.
+func (p *FakeIPPool) Answer(header dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	ip4, ip6 := p.Lookup(q.Name.String())
+	header.Response = true
+	header.RecursionAvailable = true
+	header.RCode = dnsmessage.RCodeSuccess
+	msg := dnsmessage.Message{Header: header, Questions: []dnsmessage.Question{q}}
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: FAKE_IP_TTL}
+	if q.Type == dnsmessage.TypeA && ip4 != nil {
+		r := &dnsmessage.AResource{}
+		copy(r.A[:], ip4)
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: rh, Body: r})
+	} else if q.Type == dnsmessage.TypeAAAA && ip6 != nil {
+		r := &dnsmessage.AAAAResource{}
+		copy(r.AAAA[:], ip6)
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: rh, Body: r})
+	}
+	return msg.Pack()
+}
+
+type fakeIPRecord struct {
+	Domain string `json:"domain"`
+	IP     string `json:"ip"`
+}
+
+// Load loads the mappings persisted in path, and saves the mappings
+// to path shortly after they change. A missing file is not an error,
+// and the mappings out of the ranges are dropped.
+func (p *FakeIPPool) Load(path string) (err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.path = path
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	var records []fakeIPRecord // the least recently used first
+	if err = json.Unmarshal(data, &records); err != nil {
+		return
+	}
+	for _, r := range records {
+		ip := net.ParseIP(r.IP)
+		if ip == nil {
+			continue
+		}
+		offset := p.offsetOf(ip)
+		if offset == 0 || p.domains[r.Domain] != nil || p.offsets[offset] != nil {
+			continue
+		}
+		p.add(r.Domain, offset)
+		if offset >= p.next {
+			p.next = offset%p.capacity + 1
+		}
+	}
+	return
+}
+
+// changed schedules saving the mappings. It must be called with the
+// lock held.
+func (p *FakeIPPool) changed() {
+	if p.path == "" || p.timer != nil {
+		return
+	}
+	p.timer = time.AfterFunc(FAKE_IP_SAVE_DELAY, func() {
+		p.Save() // ignoring errors, the mappings work anyway
+	})
+}
+
+// Save writes the mappings to the file loaded. The mappings are copied
+// with the lock held, and written without blocking the lookups.
+func (p *FakeIPPool) Save() error {
+	p.saving.Lock()
+	defer p.saving.Unlock()
+	p.lock.Lock()
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	path := p.path
+	if path == "" {
+		p.lock.Unlock()
+		return nil
+	}
+	entries := make([]fakeIPEntry, 0, p.lru.Len())
+	for e := p.lru.Back(); e != nil; e = e.Prev() {
+		entries = append(entries, *e.Value.(*fakeIPEntry))
+	}
+	p.lock.Unlock()
+	records := make([]fakeIPRecord, 0, len(entries))
+	for _, entry := range entries {
+		ip4, ip6 := p.addresses(entry.offset)
+		ip := ip4
+		if ip == nil {
+			ip = ip6
+		}
+		records = append(records, fakeIPRecord{Domain: entry.domain, IP: ip.String()})
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
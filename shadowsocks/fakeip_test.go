@@ -0,0 +1,193 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"golang.org/x/net/dns/dnsmessage"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fakeip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fakeip.json")
+
+	// 2 mappings without the network and the broadcast addresses
+	pool, err := NewFakeIPPool("198.18.0.0/30", "fc00::/120", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pool.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	ip4, ip6 := pool.Lookup("Example.COM.")
+	if !ip4.Equal(net.ParseIP("198.18.0.1")) || !ip6.Equal(net.ParseIP("fc00::1")) {
+		t.Fatal("Wrong fake addresses:", ip4, ip6)
+	}
+	if ip4, _ = pool.Lookup("example.org"); !ip4.Equal(net.ParseIP("198.18.0.2")) {
+		t.Fatal("Wrong fake address:", ip4)
+	}
+	// example.org is evicted as the least recently used
+	pool.Lookup("example.com")
+	if ip4, _ = pool.Lookup("example.net"); !ip4.Equal(net.ParseIP("198.18.0.2")) {
+		t.Fatal("Wrong fake address:", ip4)
+	}
+	for ip, domain := range map[string]string{
+		"198.18.0.1": "example.com",
+		"fc00::1":    "example.com",
+		"198.18.0.2": "example.net",
+		"198.18.0.3": "",
+		"fc00::3":    "",
+		"10.0.0.1":   "",
+	} {
+		if d := pool.Domain(net.ParseIP(ip)); d != domain {
+			t.Fatalf("Wrong domain of %s: %q", ip, d)
+		}
+	}
+	if !pool.Contains(net.ParseIP("198.18.0.3")) || pool.Contains(net.ParseIP("10.0.0.1")) {
+		t.Fatal("Wrong fake IP ranges")
+	}
+
+	// example.com is the least recently used after restoring
+	if err = pool.Save(); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := NewFakeIPPool("198.18.0.0/30", "fc00::/120", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = restored.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if n := restored.Len(); n != 2 {
+		t.Fatal("Wrong number of restored mappings:", n)
+	}
+	if d := restored.Domain(net.ParseIP("198.18.0.1")); d != "example.com" {
+		t.Fatal("Wrong restored domain:", d)
+	}
+	if ip4, _ = restored.Lookup("example.edu"); !ip4.Equal(net.ParseIP("198.18.0.2")) {
+		t.Fatal("Wrong fake address:", ip4)
+	}
+
+	if _, err = NewFakeIPPool("", "", 0); err == nil {
+		t.Fatal("Pool without ranges is created")
+	}
+	if _, err = NewFakeIPPool("fc00::/18", "", 0); err == nil {
+		t.Fatal("Pool with an IPv6 range of IPv4 is created")
+	}
+	if _, err = NewFakeIPPool(DEFAULT_FAKE_IP_RANGE, "", MAX_FAKE_IP_ENTRIES+1); err == nil {
+		t.Fatal("Pool with too many entries is created")
+	}
+	// the least recently used mapping is evicted at the capacity
+	if pool, err = NewFakeIPPool(DEFAULT_FAKE_IP_RANGE, DEFAULT_FAKE_IP6_RANGE, 2); err != nil {
+		t.Fatal(err)
+	}
+	pool.Lookup("example.com")
+	pool.Lookup("example.org")
+	if ip4, _ = pool.Lookup("example.net"); !ip4.Equal(net.ParseIP("198.18.0.1")) || pool.Len() != 2 {
+		t.Fatal("Wrong fake address at the capacity:", ip4)
+	}
+}
+
+func TestFakeIPClient(t *testing.T) {
+	clientConfig := DefaultConfig()
+	clientConfig.ServerHost = "127.0.0.1"
+	clientConfig.ServerPort = 7170
+	clientConfig.LocalPort = 6170
+	clientConfig.Method = "aes-128-gcm"
+	clientConfig.KeyDeriver = NewKeyDeriver([]byte("fakeip"))
+	clientConfig.DNSListen = "127.0.0.1:6171"
+	clientConfig.FakeIP = true
+	client, err := NewClientContext(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+	defer client.Wait()
+	defer client.Stop()
+
+	// the answers are fake without querying the resolver
+	var msg dnsmessage.Message
+	resp, err := client.DNS().Resolve(newDNSQuery(t, 1, "example.com."))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDNSAnswer(t, resp, 1, [4]byte{198, 18, 0, 1})
+	query, err := (&dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 2, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET},
+		},
+	}).Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err = client.DNS().Resolve(query); err != nil {
+		t.Fatal(err)
+	}
+	if err = msg.Unpack(resp); err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := msg.Answers[0].Body.(*dnsmessage.AAAAResource); !ok || !net.IP(a.AAAA[:]).Equal(net.ParseIP("fc00::1")) {
+		t.Fatal("Wrong DNS answer:", msg.Answers[0].Body)
+	}
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	target := func(addr *net.TCPAddr, data string) ([]byte, error) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write([]byte(data))
+		accepted, err := l.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer accepted.Close()
+		buf := NewBuffer()
+		err = client.transparentTarget(PlainConn{TCPConn: accepted}, addr, buf)
+		return buf.buf, err
+	}
+	expect := func(host string, port uint16, data string) []byte {
+		header, _ := AppendAddress(nil, host, port)
+		return append(header, data...)
+	}
+
+	// mapped back to the domain
+	header, err := target(&net.TCPAddr{IP: net.ParseIP("198.18.0.1"), Port: 443}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(header, expect("example.com", 443, "")) {
+		t.Fatal("Wrong header of a fake address:", header)
+	}
+	// sniffed if not mapped
+	request := "GET / HTTP/1.1\r\nHost: example.org\r\n\r\n"
+	if header, err = target(&net.TCPAddr{IP: net.ParseIP("198.18.0.2"), Port: 80}, request); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(header, expect("example.org", 80, request)) {
+		t.Fatal("Wrong header of a sniffed host:", header)
+	}
+	if _, err = target(&net.TCPAddr{IP: net.ParseIP("198.18.0.3"), Port: 80}, "\x00"); err != ERR_FAKE_IP_NOT_MAPPED {
+		t.Fatal("Wrong error of an unmapped fake address:", err)
+	}
+	// real addresses are kept
+	if header, err = target(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}, "SSH-2.0-test\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(header, expect("192.0.2.1", 22, "SSH-2.0-test\r\n")) {
+		t.Fatal("Wrong header of a real address:", header)
+	}
+}
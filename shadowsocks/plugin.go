@@ -0,0 +1,159 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PLUGIN_RESTART_DELAY is the delay before restarting a plugin which
+// exits.
+const PLUGIN_RESTART_DELAY = time.Second
+
+// Plugin is a SIP003 plugin process, e.g. simple-obfs or
+// v2ray-plugin, which transports the traffic between the client and
+// the server. On the client, the plugin listens on the local address
+// and connects to the remote server. On the server, the plugin listens
+// on the remote address and connects to the local server.
+// The plugin is restarted if it exits until stopped.
+// Specification: https://shadowsocks.org/doc/sip003.html
+type Plugin struct {
+	name       string
+	opts       string
+	remoteHost string
+	remotePort uint16
+	localHost  string
+	localPort  uint16
+	lock       sync.Mutex
+	cmd        *exec.Cmd
+	stop       chan bool
+}
+
+// NewPlugin creates a plugin running the executable name with the
+// options opts.
+func NewPlugin(name, opts, remoteHost string, remotePort uint16, localHost string, localPort uint16) *Plugin {
+	return &Plugin{
+		name:       name,
+		opts:       opts,
+		remoteHost: remoteHost,
+		remotePort: remotePort,
+		localHost:  localHost,
+		localPort:  localPort,
+	}
+}
+
+// FreePort returns a TCP port free on host, for a plugin to listen on.
+func FreePort(host string) (port uint16, err error) {
+	var l net.Listener
+	if l, err = net.Listen("tcp", WrapAddr(host, 0)); err != nil {
+		return
+	}
+	port = uint16(l.Addr().(*net.TCPAddr).Port)
+	err = l.Close()
+	return
+}
+
+// LocalAddr returns the local address of the plugin.
+func (p *Plugin) LocalAddr() string {
+	return WrapAddr(p.localHost, p.localPort)
+}
+
+// Start starts the plugin process, and keeps it running in a new
+// goroutine.
+func (p *Plugin) Start() (err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stop != nil {
+		return
+	}
+	if err = p.spawn(); err != nil {
+		return
+	}
+	p.stop = make(chan bool)
+	go p.run(p.cmd, p.stop)
+	return
+}
+
+// Stop kills the plugin process.
+func (p *Plugin) Stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+		p.cmd.Process.Kill()
+	}
+}
+
+// spawn starts a plugin process, with the lock held.
+func (p *Plugin) spawn() error {
+	cmd := exec.Command(p.name)
+	cmd.Env = append(os.Environ(),
+		"SS_REMOTE_HOST="+p.remoteHost,
+		fmt.Sprint("SS_REMOTE_PORT=", p.remotePort),
+		"SS_LOCAL_HOST="+p.localHost,
+		fmt.Sprint("SS_LOCAL_PORT=", p.localPort),
+		"SS_PLUGIN_OPTIONS="+p.opts,
+	)
+	cmd.Stderr = &pluginLogger{name: filepath.Base(p.name)}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	p.cmd = cmd
+	return nil
+}
+
+func (p *Plugin) run(cmd *exec.Cmd, stop chan bool) {
+	err := cmd.Wait()
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Printf("Plugin %s is down, restarting: %v", p.name, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(PLUGIN_RESTART_DELAY):
+		}
+		p.lock.Lock()
+		select {
+		case <-stop:
+			p.lock.Unlock()
+			return
+		default:
+		}
+		err = p.spawn()
+		cmd = p.cmd
+		p.lock.Unlock()
+		if err == nil {
+			err = cmd.Wait()
+		}
+	}
+}
+
+// pluginLogger writes the output of a plugin to the log line by line.
+type pluginLogger struct {
+	name string
+	buf  []byte
+}
+
+func (l *pluginLogger) Write(b []byte) (int, error) {
+	l.buf = append(l.buf, b...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i == -1 {
+			break
+		}
+		log.Printf("[%s] %s", l.name, bytes.TrimRight(l.buf[:i], "\r"))
+		l.buf = l.buf[i+1:]
+	}
+	return len(b), nil
+}
@@ -0,0 +1,147 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"golang.org/x/net/proxy"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+// runTestPlugin forwards connections as a SIP003 plugin, from the
+// remote address to the local address on the server if opts is
+// "server", or the reverse on the client.
+func runTestPlugin(opts string) {
+	local := net.JoinHostPort(os.Getenv("SS_LOCAL_HOST"), os.Getenv("SS_LOCAL_PORT"))
+	remote := net.JoinHostPort(os.Getenv("SS_REMOTE_HOST"), os.Getenv("SS_REMOTE_PORT"))
+	if opts == "server" {
+		local, remote = remote, local
+	}
+	l, err := net.Listen("tcp", local)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintln(os.Stderr, "forwarding", local, "to", remote)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			defer conn.Close()
+			rconn, err := net.Dial("tcp", remote)
+			if err != nil {
+				return
+			}
+			defer rconn.Close()
+			go io.Copy(rconn, conn)
+			io.Copy(conn, rconn)
+		}()
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	serverConfig := DefaultConfig()
+	serverConfig.ServerHost = "127.0.0.1"
+	serverConfig.ServerPort = 7130
+	serverConfig.Method = "aes-128-gcm"
+	serverConfig.KeyDeriver = NewKeyDeriver([]byte("plugin"))
+	serverConfig.Plugin = os.Args[0]
+	serverConfig.PluginOpts = "server"
+	// ignored, as every connection comes from the plugin
+	serverConfig.MaxConnsPerIP = 1
+	server, err := NewServerContext(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+	defer server.Wait()
+	defer server.Stop()
+	if server.Port() != 7130 {
+		t.Fatal("Wrong server port:", server.Port())
+	}
+
+	clientConfig := DefaultConfig()
+	clientConfig.LocalPort = 6130
+	clientConfig.Servers = []ServerConfig{{
+		Host:       "127.0.0.1",
+		Port:       7130,
+		Method:     "aes-128-gcm",
+		KeyDeriver: NewKeyDeriver([]byte("plugin")),
+		Plugin:     os.Args[0],
+		PluginOpts: "client",
+	}}
+	client, err := NewClientContext(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+
+	socks, _ := proxy.SOCKS5("tcp", "127.0.0.1:6130", nil, proxy.Direct)
+	requester := &http.Client{
+		Transport: &http.Transport{Dial: socks.Dial, DisableKeepAlives: true},
+		Timeout:   time.Second,
+	}
+	// the plugins take a while to start
+	get := func() {
+		var err error
+		for i := 0; i < 50; i++ {
+			var request *http.Response
+			if request, err = requester.Get("http://127.0.0.1:8000/hello"); err != nil {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			content, _ := ioutil.ReadAll(request.Body)
+			request.Body.Close()
+			if string(content) != "Hello" {
+				t.Fatal("Wrong content:", string(content))
+			}
+			return
+		}
+		t.Fatal(err)
+	}
+	get()
+
+	// a connection is kept open through the plugin
+	held, err := socks.Dial("tcp", "127.0.0.1:8000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	held.SetDeadline(time.Now().Add(time.Second))
+	if _, err = held.Write([]byte("GET /hello HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = held.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	get()
+	held.Close()
+
+	// the plugin is restarted
+	plugin := client.Servers().Servers()[0].plugin
+	plugin.lock.Lock()
+	process := plugin.cmd.Process
+	plugin.lock.Unlock()
+	process.Kill()
+	time.Sleep(100 * time.Millisecond)
+	get()
+	plugin.lock.Lock()
+	restarted := plugin.cmd.Process != process
+	plugin.lock.Unlock()
+	if !restarted {
+		t.Fatal("Plugin is not restarted")
+	}
+
+	client.Stop()
+	client.Wait()
+	plugin.lock.Lock()
+	defer plugin.lock.Unlock()
+	if plugin.stop != nil {
+		t.Fatal("Plugin is not stopped")
+	}
+}
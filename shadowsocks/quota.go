@@ -0,0 +1,159 @@
+package shadowsocks
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Quota limits the traffic, the lifetime and the simultaneous
+// connections of a server or a user. The traffic used is the traffic
+// counted by its stats since the quota was last renewed, whether the
+// stats are reset or not. Once the quota is exhausted or expired,
+// new connections are rejected and the alive ones are closed.
+type Quota struct {
+	stats    *TrafficStats
+	limit    int64 // bytes, 0 for unlimited
+	expiry   int64 // unix nanoseconds, 0 for never
+	lock     sync.Mutex
+	conns    map[SSConn]bool
+	maxConns int // 0 for unlimited
+	timer    *time.Timer
+}
+
+// QuotaState is the state of a Quota reported by the manager.
+type QuotaState struct {
+	Limit    int64 `json:"limit"`
+	Used     int64 `json:"used"`
+	Expiry   int64 `json:"expiry"` // unix seconds
+	Exceeded bool  `json:"exceeded"`
+	MaxConns int   `json:"max_conns"`
+	// connections rejected by the limits since the stats were reset
+	Rejected int64 `json:"rejected"`
+}
+
+// NewQuota creates an unlimited quota on the traffic of stats.
+func NewQuota(stats *TrafficStats) *Quota {
+	return &Quota{stats: stats, conns: map[SSConn]bool{}}
+}
+
+// Set sets the limit of bytes and the expiry time. A zero limit
+// or a zero expiry time means unlimited.
+func (q *Quota) Set(limit int64, expiry time.Time) {
+	var exp int64
+	if !expiry.IsZero() {
+		exp = expiry.UnixNano()
+	}
+	atomic.StoreInt64(&q.limit, limit)
+	atomic.StoreInt64(&q.expiry, exp)
+	q.Stop()
+	q.lock.Lock()
+	if exp != 0 {
+		q.timer = time.AfterFunc(time.Until(expiry), q.terminate)
+	}
+	q.lock.Unlock()
+	if q.Exceeded() {
+		q.terminate()
+	}
+}
+
+// SetMaxConns sets the maximum number of simultaneous connections,
+// 0 for unlimited. Alive connections over the limit are kept.
+func (q *Quota) SetMaxConns(max int) {
+	q.lock.Lock()
+	q.maxConns = max
+	q.lock.Unlock()
+}
+
+// Renew starts counting the traffic used from zero again, and
+// returns the traffic used before.
+func (q *Quota) Renew() int64 {
+	return atomic.SwapInt64(&q.stats.used, 0)
+}
+
+// Stop stops the timer of the expiry, which is started again by Set.
+func (q *Quota) Stop() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+}
+
+func (q *Quota) used() int64 {
+	return atomic.LoadInt64(&q.stats.used)
+}
+
+// Exceeded checks whether the quota is exhausted or expired.
+func (q *Quota) Exceeded() bool {
+	if limit := atomic.LoadInt64(&q.limit); limit > 0 && q.used() >= limit {
+		return true
+	}
+	exp := atomic.LoadInt64(&q.expiry)
+	return exp != 0 && time.Now().UnixNano() >= exp
+}
+
+// State returns the state of the quota.
+func (q *Quota) State() QuotaState {
+	s := QuotaState{
+		Limit:    atomic.LoadInt64(&q.limit),
+		Used:     q.used(),
+		Exceeded: q.Exceeded(),
+		Rejected: atomic.LoadInt64(&q.stats.rejected),
+	}
+	if exp := atomic.LoadInt64(&q.expiry); exp != 0 {
+		s.Expiry = exp / int64(time.Second)
+	}
+	q.lock.Lock()
+	s.MaxConns = q.maxConns
+	q.lock.Unlock()
+	return s
+}
+
+// acquire registers conn to be closed once the quota is exceeded,
+// or returns ERR_QUOTA_EXCEEDED if it already is, or
+// ERR_TOO_MANY_CONNS if too many connections are alive. Rejected
+// connections are counted in the stats.
+func (q *Quota) acquire(conn SSConn) error {
+	if q.Exceeded() {
+		q.stats.reject()
+		return ERR_QUOTA_EXCEEDED
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.maxConns > 0 && len(q.conns) >= q.maxConns {
+		q.stats.reject()
+		return ERR_TOO_MANY_CONNS
+	}
+	q.conns[conn] = true
+	return nil
+}
+
+func (q *Quota) release(conn SSConn) {
+	q.lock.Lock()
+	delete(q.conns, conn)
+	q.lock.Unlock()
+}
+
+// check is called on every transfer. It only checks the limit of
+// bytes, as the expiry is enforced by a timer.
+func (q *Quota) check() error {
+	if limit := atomic.LoadInt64(&q.limit); limit > 0 && q.used() >= limit {
+		go q.terminate()
+		return ERR_QUOTA_EXCEEDED
+	}
+	return nil
+}
+
+func (q *Quota) terminate() {
+	q.lock.Lock()
+	conns := make([]SSConn, 0, len(q.conns))
+	for conn := range q.conns {
+		conns = append(conns, conn)
+	}
+	q.lock.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
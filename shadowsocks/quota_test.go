@@ -0,0 +1,89 @@
+package shadowsocks
+
+import (
+	"golang.org/x/net/proxy"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQuota(t *testing.T) {
+	serverConfig := DefaultConfig()
+	serverConfig.ServerHost = "127.0.0.1"
+	serverConfig.ServerPort = 7040
+	serverConfig.KeyDeriver = NewKeyDeriver([]byte("quota"))
+	server, err := NewServerContext(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+	defer server.Wait()
+	defer server.Stop()
+
+	clientConfig := DefaultConfig()
+	clientConfig.ServerHost = "127.0.0.1"
+	clientConfig.ServerPort = 7040
+	clientConfig.LocalPort = 6040
+	clientConfig.KeyDeriver = NewKeyDeriver([]byte("quota"))
+	client, err := NewClientContext(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+	defer client.Wait()
+	defer client.Stop()
+
+	socks, _ := proxy.SOCKS5("tcp", "127.0.0.1:6040", nil, proxy.Direct)
+	requester := &http.Client{
+		Transport: &http.Transport{
+			Dial:              socks.Dial,
+			DisableKeepAlives: true,
+		},
+		Timeout: time.Second,
+	}
+	get := func() error {
+		request, err := requester.Get("http://127.0.0.1:8000/hello")
+		if err != nil {
+			return err
+		}
+		_, err = ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		return err
+	}
+
+	if err = get(); err != nil {
+		t.Fatal(err)
+	}
+	used := server.Stats().Total()
+	server.Quota().Set(used+1, time.Time{})
+	get() // exhausts the quota
+	if !server.Quota().Exceeded() {
+		t.Fatal("Quota is not exceeded:", server.Quota().State())
+	}
+	if err = get(); err == nil {
+		t.Fatal("Connection is accepted after quota exceeded")
+	}
+
+	server.Stats().Reset()
+	if !server.Quota().Exceeded() {
+		t.Fatal("Quota is renewed after reset")
+	}
+	server.Quota().Renew()
+	if err = get(); err != nil {
+		t.Fatal("Quota is not renewed:", err)
+	}
+	if server.Stats().Total() == 0 {
+		t.Fatal("Stats are reset after renewal")
+	}
+	server.Quota().Set(0, time.Now().Add(-time.Second))
+	if err = get(); err == nil {
+		t.Fatal("Connection is accepted after quota expired")
+	}
+
+	server.Quota().Set(0, time.Now().Add(time.Hour))
+	server.Stop()
+	if server.Quota().timer != nil {
+		t.Fatal("Expiry timer is not stopped")
+	}
+}
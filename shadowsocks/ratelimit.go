@@ -0,0 +1,158 @@
+package shadowsocks
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting the bytes transferred per
+// second. It may be shared by several connections, which then share
+// the rate fairly, as every transfer reserves its tokens in order.
+type RateLimiter struct {
+	rate   int64 // bytes per second, 0 for unlimited
+	lock   sync.Mutex
+	burst  int64
+	tokens float64
+	last   time.Time
+}
+
+// Set sets the rate in bytes per second and the size of the bucket.
+// A zero rate means unlimited, and a burst not greater than zero
+// defaults to the bytes of one second. The bucket starts full if the
+// rate was unlimited, and keeps its tokens up to the new burst
+// otherwise, so that changing the rate does not allow a new burst.
+func (l *RateLimiter) Set(rate, burst int64) {
+	if burst <= 0 {
+		burst = rate
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.refill() == 0 {
+		l.tokens = float64(burst)
+	} else if l.tokens > float64(burst) {
+		l.tokens = float64(burst)
+	}
+	atomic.StoreInt64(&l.rate, rate)
+	l.burst = burst
+}
+
+// Rate returns the rate and the burst of the limiter.
+func (l *RateLimiter) Rate() (rate, burst int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return atomic.LoadInt64(&l.rate), l.burst
+}
+
+// refill adds the tokens accumulated since the last call, and
+// returns the rate. It must be called with the lock held.
+func (l *RateLimiter) refill() int64 {
+	rate := atomic.LoadInt64(&l.rate)
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	if l.tokens > float64(l.burst) {
+		l.tokens = float64(l.burst)
+	}
+	l.last = now
+	return rate
+}
+
+// Wait blocks until n bytes may be transferred.
+func (l *RateLimiter) Wait(n int) {
+	for n > 0 {
+		if atomic.LoadInt64(&l.rate) == 0 {
+			return
+		}
+		l.lock.Lock()
+		rate := l.refill()
+		if rate == 0 {
+			l.lock.Unlock()
+			return
+		}
+		take := int64(n)
+		if take > l.burst {
+			take = l.burst
+		}
+		l.tokens -= float64(take)
+		tokens := l.tokens
+		l.lock.Unlock()
+		n -= int(take)
+		if tokens < 0 {
+			time.Sleep(time.Duration(-tokens / float64(rate) * float64(time.Second)))
+		}
+	}
+}
+
+// Allow reports whether n bytes may be transferred now, and takes
+// the tokens if so. It is used where waiting is not an option,
+// e.g. relaying UDP packets. More bytes than the burst are allowed
+// once the bucket is full, and the tokens owed delay what follows.
+func (l *RateLimiter) Allow(n int) bool {
+	if atomic.LoadInt64(&l.rate) == 0 {
+		return true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.refill() == 0 {
+		return true
+	}
+	need := int64(n)
+	if need > l.burst {
+		need = l.burst
+	}
+	if l.tokens < float64(need) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// Bandwidth limits the upload and download rates of a server or
+// a user.
+type Bandwidth struct {
+	Upload   RateLimiter
+	Download RateLimiter
+}
+
+// NewBandwidth creates a bandwidth limit with the rates in bytes
+// per second, 0 for unlimited. burst is the size of both buckets in
+// bytes, 0 for the bytes of one second.
+func NewBandwidth(upload, download, burst int64) *Bandwidth {
+	b := &Bandwidth{}
+	b.Set(upload, download, burst)
+	return b
+}
+
+// Set sets the rates and the size of the buckets like NewBandwidth.
+func (b *Bandwidth) Set(upload, download, burst int64) {
+	b.Upload.Set(upload, burst)
+	b.Download.Set(download, burst)
+}
+
+// RateLimitedConn is a SSConn whose reads and writes are limited
+// by the upload and download rates of every bandwidth limit given.
+type RateLimitedConn struct {
+	SSConn
+	limits []*Bandwidth
+}
+
+// NewRateLimitedConn wraps conn with the bandwidth limits.
+func NewRateLimitedConn(conn SSConn, limits ...*Bandwidth) *RateLimitedConn {
+	return &RateLimitedConn{SSConn: conn, limits: limits}
+}
+
+func (c *RateLimitedConn) SSRead(b *SSBuffer) error {
+	n := len(b.buf)
+	err := c.SSConn.SSRead(b)
+	for _, l := range c.limits {
+		l.Upload.Wait(len(b.buf) - n)
+	}
+	return err
+}
+
+func (c *RateLimitedConn) SSWrite(b *SSBuffer) error {
+	for _, l := range c.limits {
+		l.Download.Wait(len(b.buf))
+	}
+	return c.SSConn.SSWrite(b)
+}
@@ -0,0 +1,78 @@
+package shadowsocks
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var l RateLimiter
+	l.Set(100000, 10000)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ { // the rate is shared by all the waiters
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				l.Wait(2000)
+			}
+		}()
+	}
+	wg.Wait()
+	// 60000 bytes at 100000 bytes/s with the first 10000 bytes in burst
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatal("Wrong rate, elapsed:", elapsed)
+	}
+
+	var m RateLimiter
+	m.Set(1000, 0)
+	if !m.Allow(1000) {
+		t.Fatal("Burst is not allowed")
+	}
+	if m.Allow(1000) {
+		t.Fatal("Rate is exceeded")
+	}
+	m.Set(1000, 500) // the tokens are kept
+	if m.Allow(100) {
+		t.Fatal("Bucket is refilled by Set")
+	}
+	m.Set(0, 0)
+	m.Set(100000, 1000) // full again after unlimited
+	if !m.Allow(5000) {
+		t.Fatal("Packet larger than the burst is not allowed")
+	}
+	if m.Allow(100) {
+		t.Fatal("Tokens owed are not taken")
+	}
+	l.Set(0, 0)
+	if !l.Allow(1000000) {
+		t.Fatal("Unlimited rate is limited")
+	}
+	start = time.Now()
+	l.Wait(1000000)
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatal("Unlimited rate is limited")
+	}
+}
+
+func TestBandwidth(t *testing.T) {
+	b := NewBandwidth(1000, 2000, 5000)
+	if rate, burst := b.Upload.Rate(); rate != 1000 || burst != 5000 {
+		t.Fatal("Wrong upload rate:", rate, burst)
+	}
+	if rate, burst := b.Download.Rate(); rate != 2000 || burst != 5000 {
+		t.Fatal("Wrong download rate:", rate, burst)
+	}
+	if !b.Download.Allow(5000) {
+		t.Fatal("Burst is not allowed")
+	}
+	b.Set(1000, 2000, 0) // the bytes of one second
+	if _, burst := b.Upload.Rate(); burst != 1000 {
+		t.Fatal("Wrong default upload burst:", burst)
+	}
+	if _, burst := b.Download.Rate(); burst != 2000 {
+		t.Fatal("Wrong default download burst:", burst)
+	}
+}
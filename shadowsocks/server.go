@@ -10,24 +10,40 @@ import (
 
 // ServerContext represents an instance of Shadowsocks server
 // which listens on a single port and accept a single kind of
-// encryption.
+// encryption. It relays UDP packets on the same port if UDP
+// relay is enabled and supported by the cipher.
 type ServerContext struct {
 	server         net.Listener
+	udpServer      *net.UDPConn
+	udpCipher      PacketCipher
+	nat            *NATTable
+	resolving      chan struct{} // a slot per packet resolving its target
 	running        chan bool
 	err            chan error
 	cipherFactory  CipherFactory
+	users          *UserTable
+	stats          *TrafficStats
+	quota          *Quota
+	bandwidth      *Bandwidth
+	sources        *SourceLimiter
+	banList        *BanList
+	fallbackMode   FallbackMode
+	fallbackDecoy  string
+	fallbackDelay  time.Duration
+	destPolicy     *DestPolicy
+	resolver       *net.Resolver
+	plugin         *Plugin
 	connectV4Only  bool
 	connectTimeout time.Duration
 	timeout        time.Duration
 }
 
-// NewServerContext creates a new instance of ServerContext
-// with specified arguments.
-func NewServerContext(config Config) (ctx ServerContext, err error) {
-	var server net.Listener
-	server, err = net.Listen("tcp", WrapAddr(config.ServerHost, config.ServerPort))
-	if err != nil {
-		return
+func newServerCipherFactory(config Config) (factory CipherFactory, users *UserTable, err error) {
+	if len(config.Users) > 0 {
+		if users, err = NewUserTable(config); err != nil {
+			return
+		}
+		return &MultiUserCipherFactory{users: users}, users, nil
 	}
 	cipherInfo, ok := Ciphers[config.Method]
 	if !ok {
@@ -44,10 +60,98 @@ func NewServerContext(config Config) (ctx ServerContext, err error) {
 		err = fmt.Errorf("Insufficient key size")
 		return
 	}
+	return cipherInfo.newFactory(key), nil, nil
+}
+
+// NewServerContext creates a new instance of ServerContext
+// with specified arguments.
+func NewServerContext(config Config) (ctx ServerContext, err error) {
+	if config.Fallback == FALLBACK_DECOY && config.FallbackDecoy == "" {
+		err = fmt.Errorf("No decoy address for fallback")
+		return
+	}
+	cipherFactory, users, err := newServerCipherFactory(config)
+	if err != nil {
+		return
+	}
+	var server net.Listener
+	var plugin *Plugin
+	if config.Plugin != "" {
+		// the plugin listens on the server address, and connects to
+		// the server on loopback
+		if server, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			return
+		}
+		plugin = NewPlugin(config.Plugin, config.PluginOpts, config.ServerHost, config.ServerPort,
+			"127.0.0.1", uint16(server.Addr().(*net.TCPAddr).Port))
+		if err = plugin.Start(); err != nil {
+			server.Close()
+			return
+		}
+		// every connection comes from the plugin on loopback
+		log.Printf("Source bans, limits and user hints are disabled on TCP behind plugin %s", config.Plugin)
+		if users != nil {
+			users.DisableHints()
+		}
+	} else if server, err = net.Listen("tcp", WrapAddr(config.ServerHost, config.ServerPort)); err != nil {
+		return
+	}
+	var udpServer *net.UDPConn
+	var udpCipher PacketCipher
+	if config.UDPRelay {
+		var ok bool
+		// multi-user servers identify the users of the packets
+		if udpCipher, ok = cipherFactory.(PacketCipher); ok || users != nil {
+			var addr *net.UDPAddr
+			addr, err = net.ResolveUDPAddr("udp", WrapAddr(config.ServerHost, config.ServerPort))
+			if err == nil {
+				udpServer, err = net.ListenUDP("udp", addr)
+			}
+			if err != nil {
+				server.Close()
+				if plugin != nil {
+					plugin.Stop()
+				}
+				return
+			}
+		} else {
+			log.Printf("UDP relay is not supported by %s", config.Method)
+		}
+	}
+	udpTimeout := config.UDPTimeout
+	if udpTimeout == 0 {
+		udpTimeout = DEFAULT_UDP_TIMEOUT
+	}
+	destPolicy, resolver := config.DestPolicy, net.DefaultResolver
+	if config.Nameserver != "" {
+		resolver = newResolver(config.Nameserver)
+		if destPolicy == nil { // resolve destinations to use the nameserver
+			destPolicy = NewDestPolicy()
+		}
+	}
+	stats := &TrafficStats{}
+	quota := NewQuota(stats)
+	quota.SetMaxConns(config.MaxConns)
 	ctx = ServerContext{
 		server:         server,
+		udpServer:      udpServer,
+		udpCipher:      udpCipher,
+		nat:            NewNATTable(udpTimeout),
+		resolving:      make(chan struct{}, MAX_UDP_RESOLVING),
 		running:        make(chan bool, 1),
-		cipherFactory:  cipherInfo.newFactory(key),
+		cipherFactory:  cipherFactory,
+		users:          users,
+		stats:          stats,
+		quota:          quota,
+		bandwidth:      NewBandwidth(config.UploadRate, config.DownloadRate, config.RateBurst),
+		sources:        NewSourceLimiter(config.MaxConnsPerIP),
+		banList:        config.BanList,
+		fallbackMode:   config.Fallback,
+		fallbackDecoy:  config.FallbackDecoy,
+		fallbackDelay:  config.FallbackDelay,
+		destPolicy:     destPolicy,
+		resolver:       resolver,
+		plugin:         plugin,
 		connectV4Only:  config.ConnectV4Only,
 		err:            make(chan error, 1),
 		connectTimeout: config.ConnectTimeout,
@@ -71,11 +175,15 @@ func (ctx *ServerContext) Run() {
 	case <-ctx.err:
 	default:
 	}
+	go ctx.RunUDP()
 	for {
 		FDAttain()
 		conn, err := ctx.server.Accept()
 		if err != nil {
 			FDRelease()
+			if ctx.plugin != nil {
+				ctx.plugin.Stop()
+			}
 			running = <-ctx.running
 			ctx.running <- false
 			if !running {
@@ -92,14 +200,68 @@ func (ctx *ServerContext) Run() {
 	}
 }
 
-// Stop stops the running server.
+// Stop stops the running server, and the expiry timers of its quotas.
 func (ctx *ServerContext) Stop() {
 	running := <-ctx.running
 	ctx.running <- running
+	ctx.quota.Stop()
+	for _, user := range ctx.Users() {
+		user.quota.Stop()
+	}
 	if !running {
 		return
 	}
 	ctx.server.Close()
+	if ctx.udpServer != nil {
+		ctx.udpServer.Close()
+	}
+}
+
+// Port returns the TCP port the server listens on, or the plugin of
+// the server listens on.
+func (ctx *ServerContext) Port() uint16 {
+	if ctx.plugin != nil {
+		return ctx.plugin.remotePort
+	}
+	return uint16(ctx.server.Addr().(*net.TCPAddr).Port)
+}
+
+// Stats returns the traffic stats of the server.
+func (ctx *ServerContext) Stats() *TrafficStats {
+	return ctx.stats
+}
+
+// Quota returns the quota of the server.
+func (ctx *ServerContext) Quota() *Quota {
+	return ctx.quota
+}
+
+// Bandwidth returns the bandwidth limit of the server, shared by
+// all the connections of the server.
+func (ctx *ServerContext) Bandwidth() *Bandwidth {
+	return ctx.bandwidth
+}
+
+// Sources returns the limiter of the connections from each source
+// address.
+func (ctx *ServerContext) Sources() *SourceLimiter {
+	return ctx.sources
+}
+
+// User returns the user named name of a multi-user server, or nil.
+func (ctx *ServerContext) User(name string) *ServerUser {
+	if ctx.users == nil {
+		return nil
+	}
+	return ctx.users.User(name)
+}
+
+// Users returns the users of a multi-user server, or nil.
+func (ctx *ServerContext) Users() []*ServerUser {
+	if ctx.users == nil {
+		return nil
+	}
+	return ctx.users.Users()
 }
 
 // Wait waits the server to stop and return its error.
@@ -112,35 +274,65 @@ func (ctx *ServerContext) Wait() (err error) {
 func (ctx *ServerContext) HandleConnection(conn net.Conn) {
 	defer FDRelease()
 	var err error
+	var wconn SSConn
+	source := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+	// behind a plugin, every source is the plugin on loopback
+	sourced := ctx.plugin == nil
+	// the handshake is recorded to be replayed to the decoy server
+	recorder := &Recorder{}
+	if ctx.fallbackMode != FALLBACK_DECOY {
+		recorder.Stop()
+	}
 	defer func() {
-		if err != nil {
-			log.Print(err.Error() + "(" + conn.(*net.TCPConn).RemoteAddr().String() + ")")
+		if err != nil && err != ERR_BANNED {
+			raddr := conn.RemoteAddr().String()
+			if user := ConnUser(wconn); user != nil {
+				raddr += ", user " + user.Name
+			}
+			log.Print(err.Error() + "(" + raddr + ")")
+		}
+		if sourced && ctx.banList != nil && (err == ERR_AUTH_FAIL || err == ERR_DUP_SALT) {
+			if ctx.banList.Fail(source) {
+				log.Printf("Banned %s", source)
+			}
 		}
 		if !IsAuthError(err) {
 			conn.Close()
+		} else if err == ERR_BANNED {
+			go ctx.fallback(conn.(*net.TCPConn), nil, true)
 		} else {
-			// drain all data but keep the connection
-			go func(conn net.Conn) {
-				defer conn.Close()
-				devnull := make([]byte, DEFAULT_BUF_SIZE)
-				var err error = nil
-				for err == nil {
-					_, err = conn.Read(devnull)
-				}
-			}(conn)
+			received, replayable := recorder.Data()
+			go ctx.fallback(conn.(*net.TCPConn), received, replayable)
 		}
 	}()
-	tconn := PlainConn{conn.(*net.TCPConn)}
+	if sourced && ctx.banList != nil && ctx.banList.Banned(source) {
+		err = ERR_BANNED
+		return
+	}
+	if sourced {
+		if !ctx.sources.Acquire(source) {
+			ctx.stats.reject()
+			err = ERR_TOO_MANY_CONNS
+			return
+		}
+		defer ctx.sources.Release(source)
+	}
+	tconn := PlainConn{TCPConn: conn.(*net.TCPConn), Recorder: recorder}
 	tconn.TCPConn.SetNoDelay(true)
 	tconn.TCPConn.SetKeepAlivePeriod(ctx.timeout)
 	tconn.TCPConn.SetKeepAlive(true)
-	wconn := ctx.cipherFactory.Wrap(tconn)
+	wconn = WrapServer(ctx.cipherFactory, tconn)
+	var cconn *TrafficConn
+	if cconn, err = NewTrafficConn(wconn, ctx.stats, ctx.quota); err != nil {
+		return
+	}
+	defer cconn.Release()
 
 	buf := NewBuffer()
 	var addr string
 	var ln int
 	for {
-		err = wconn.SSRead(buf)
+		err = cconn.SSRead(buf)
 		if err != nil {
 			return
 		}
@@ -152,6 +344,7 @@ func (ctx *ServerContext) HandleConnection(conn net.Conn) {
 			break
 		}
 	}
+	recorder.Stop()
 	copy(buf.buf[:], buf.buf[ln:])
 	buf.buf = buf.buf[:len(buf.buf)-ln]
 
@@ -161,18 +354,25 @@ func (ctx *ServerContext) HandleConnection(conn net.Conn) {
 	} else {
 		netType = "tcp"
 	}
+	if addr, err = ctx.resolveDest(netType, addr); err != nil {
+		return
+	}
 	var rconn net.Conn
 	rconn, err = net.DialTimeout(netType, addr, ctx.connectTimeout)
 	if err != nil {
 		return
 	}
 	defer rconn.Close()
-	trconn := PlainConn{rconn.(*net.TCPConn)}
+	trconn := PlainConn{TCPConn: rconn.(*net.TCPConn)}
 	trconn.TCPConn.SetNoDelay(true)
 
+	limits := []*Bandwidth{ctx.bandwidth}
+	if user := ConnUser(wconn); user != nil {
+		limits = append(limits, user.bandwidth)
+	}
 	rbuf := NewBuffer()
 	res := make(chan error, 1)
-	DPipe(wconn, trconn, buf, rbuf, res)
+	DPipe(NewRateLimitedConn(cconn, limits...), trconn, buf, rbuf, res)
 
 	err = <-res
 }
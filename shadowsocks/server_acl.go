@@ -0,0 +1,242 @@
+package shadowsocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// PRIVATE_NETWORKS are the networks denied by DenyPrivate: loopback,
+// private, link-local (including the metadata endpoint of most
+// clouds), shared address space, IETF protocol assignments,
+// benchmarking, reserved, unspecified, broadcast, multicast and
+// NAT64, which may reach any of them.
+var PRIVATE_NETWORKS = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"255.255.255.255/32",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Low, High uint16
+}
+
+// ParsePortRange parses a port like "25" or a range like "6000-7000".
+func ParsePortRange(s string) (r PortRange, err error) {
+	low, high := s, s
+	if p := strings.Index(s, "-"); p != -1 {
+		low, high = s[:p], s[p+1:]
+	}
+	var l, h int
+	if l, err = strconv.Atoi(strings.TrimSpace(low)); err != nil {
+		return
+	}
+	if h, err = strconv.Atoi(strings.TrimSpace(high)); err != nil {
+		return
+	}
+	if l <= 0 || h > 65535 || l > h {
+		err = fmt.Errorf("Invalid port range: %s", s)
+		return
+	}
+	return PortRange{uint16(l), uint16(h)}, nil
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return port >= r.Low && port <= r.High
+}
+
+// DestPolicy decides which destinations a server may connect to.
+// A destination is denied if it matches any deny list, or if an
+// allow list is not empty and it does not match the list. The
+// policy must not be modified once used by a server.
+type DestPolicy struct {
+	allowNets  []*net.IPNet
+	denyNets   []*net.IPNet
+	allowPorts []PortRange
+	denyPorts  []PortRange
+}
+
+// NewDestPolicy creates a policy allowing every destination.
+func NewDestPolicy() *DestPolicy {
+	return &DestPolicy{}
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid IP address: %s", s)
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// AllowNet adds a network in CIDR notation, or a single address,
+// to the allow list.
+func (p *DestPolicy) AllowNet(cidr string) error {
+	n, err := parseCIDR(cidr)
+	if err == nil {
+		p.allowNets = append(p.allowNets, n)
+	}
+	return err
+}
+
+// DenyNet adds a network in CIDR notation, or a single address,
+// to the deny list.
+func (p *DestPolicy) DenyNet(cidr string) error {
+	n, err := parseCIDR(cidr)
+	if err == nil {
+		p.denyNets = append(p.denyNets, n)
+	}
+	return err
+}
+
+// DenyPrivate adds PRIVATE_NETWORKS to the deny list.
+func (p *DestPolicy) DenyPrivate() {
+	for _, cidr := range PRIVATE_NETWORKS {
+		if err := p.DenyNet(cidr); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// AllowPort adds a port or a port range to the allow list.
+func (p *DestPolicy) AllowPort(spec string) error {
+	r, err := ParsePortRange(spec)
+	if err == nil {
+		p.allowPorts = append(p.allowPorts, r)
+	}
+	return err
+}
+
+// DenyPort adds a port or a port range to the deny list.
+func (p *DestPolicy) DenyPort(spec string) error {
+	r, err := ParsePortRange(spec)
+	if err == nil {
+		p.denyPorts = append(p.denyPorts, r)
+	}
+	return err
+}
+
+// AllowedPort checks whether port is allowed.
+func (p *DestPolicy) AllowedPort(port uint16) bool {
+	for _, r := range p.denyPorts {
+		if r.contains(port) {
+			return false
+		}
+	}
+	if len(p.allowPorts) == 0 {
+		return true
+	}
+	for _, r := range p.allowPorts {
+		if r.contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowedIP checks whether ip is allowed.
+func (p *DestPolicy) AllowedIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4 // IPv4-mapped IPv6 addresses are checked as IPv4
+	}
+	for _, n := range p.denyNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(p.allowNets) == 0 {
+		return true
+	}
+	for _, n := range p.allowNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newResolver creates a resolver querying nameserver, an address
+// with an optional port which defaults to 53.
+func newResolver(nameserver string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(nameserver); err != nil {
+		nameserver = net.JoinHostPort(nameserver, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(c context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(c, network, nameserver)
+		},
+	}
+}
+
+// resolveDest resolves addr as host:port to an address of network,
+// e.g. "tcp4", allowed by the destination policy of the server. The
+// address returned is an IP address so that it is not resolved again
+// when dialed. Denied destinations are counted in the stats.
+func (ctx *ServerContext) resolveDest(network, addr string) (string, error) {
+	if ctx.destPolicy == nil {
+		return addr, nil
+	}
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	port, err := strconv.Atoi(sport)
+	if err != nil {
+		return "", err
+	}
+	if ctx.destPolicy.AllowedPort(uint16(port)) {
+		var ips []net.IP
+		if ip := net.ParseIP(host); ip != nil {
+			ips = []net.IP{ip}
+		} else {
+			c, cancel := context.WithTimeout(context.Background(), ctx.connectTimeout)
+			addrs, err := ctx.resolver.LookupIPAddr(c, host)
+			cancel()
+			if err != nil {
+				return "", err
+			}
+			for _, a := range addrs {
+				ips = append(ips, a.IP)
+			}
+		}
+		v4only := strings.HasSuffix(network, "4")
+		for _, ip := range ips {
+			if v4only && ip.To4() == nil {
+				continue
+			}
+			if ctx.destPolicy.AllowedIP(ip) {
+				return net.JoinHostPort(ip.String(), sport), nil
+			}
+		}
+	}
+	atomic.AddInt64(&ctx.stats.denied, 1)
+	return "", NewError(fmt.Sprintf("Destination %s denied", addr))
+}
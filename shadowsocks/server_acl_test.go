@@ -0,0 +1,110 @@
+package shadowsocks
+
+import (
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDestPolicy(t *testing.T) {
+	policy := NewDestPolicy()
+	policy.DenyPrivate()
+	if err := policy.DenyPort("25"); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.DenyPort("6000-6100"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		ip      string
+		allowed bool
+	}{
+		{"8.8.8.8", true},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"192.168.1.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::1", false},
+		{"192.0.0.170", false},
+		{"198.19.255.1", false},
+		{"240.0.0.1", false},
+		{"255.255.255.255", false},
+		{"64:ff9b::7f00:1", false},
+		{"198.20.0.1", true},
+		{"2001:db8::1", true},
+	} {
+		if policy.AllowedIP(net.ParseIP(c.ip)) != c.allowed {
+			t.Fatal("Wrong policy of", c.ip)
+		}
+	}
+	for _, c := range []struct {
+		port    uint16
+		allowed bool
+	}{{25, false}, {80, true}, {6050, false}, {6101, true}} {
+		if policy.AllowedPort(c.port) != c.allowed {
+			t.Fatal("Wrong policy of port", c.port)
+		}
+	}
+
+	policy = NewDestPolicy()
+	policy.AllowNet("203.0.113.0/24")
+	policy.AllowPort("443")
+	if !policy.AllowedIP(net.ParseIP("203.0.113.7")) || policy.AllowedIP(net.ParseIP("8.8.8.8")) {
+		t.Fatal("Wrong allow list of networks")
+	}
+	if !policy.AllowedPort(443) || policy.AllowedPort(80) {
+		t.Fatal("Wrong allow list of ports")
+	}
+	for _, spec := range []string{"0", "70000", "20-10", "http"} {
+		if _, err := ParsePortRange(spec); err == nil {
+			t.Fatal("Invalid port range is parsed:", spec)
+		}
+	}
+}
+
+func TestServerDestPolicy(t *testing.T) {
+	serverConfig := DefaultConfig()
+	serverConfig.ServerHost = "127.0.0.1"
+	serverConfig.ServerPort = 7080
+	serverConfig.KeyDeriver = NewKeyDeriver([]byte("acl"))
+	serverConfig.DestPolicy = NewDestPolicy()
+	serverConfig.DestPolicy.DenyPrivate()
+	server, err := NewServerContext(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+	defer server.Wait()
+	defer server.Stop()
+
+	clientConfig := DefaultConfig()
+	clientConfig.ServerHost = "127.0.0.1"
+	clientConfig.ServerPort = 7080
+	clientConfig.LocalPort = 6080
+	clientConfig.KeyDeriver = NewKeyDeriver([]byte("acl"))
+	client, err := NewClientContext(clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+	defer client.Wait()
+	defer client.Stop()
+
+	socks, _ := proxy.SOCKS5("tcp", "127.0.0.1:6080", nil, proxy.Direct)
+	requester := &http.Client{
+		Transport: &http.Transport{
+			Dial: socks.Dial,
+		},
+		Timeout: time.Second,
+	}
+	for _, url := range []string{"http://127.0.0.1:8000/hello", "http://localhost:8000/hello"} {
+		if _, err = requester.Get(url); err == nil {
+			t.Fatal("Private destination is allowed:", url)
+		}
+	}
+	if denied := server.Stats().Snapshot().Denied; denied != 2 {
+		t.Fatal("Wrong denied destinations:", denied)
+	}
+}
@@ -0,0 +1,83 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// FallbackMode is how a server handles the connections failing
+// authentication. Closing them at once would be a fingerprint
+// for active probing.
+type FallbackMode int
+
+const (
+	// Read and discard everything until the client closes
+	FALLBACK_DRAIN FallbackMode = iota
+	// Read and discard everything, and close after a random delay
+	FALLBACK_CLOSE
+	// Replay the data received to a decoy server, e.g. an ordinary
+	// web server, and relay the rest
+	FALLBACK_DECOY
+)
+
+var fallbackModeNames = map[FallbackMode]string{
+	FALLBACK_DRAIN: "drain",
+	FALLBACK_CLOSE: "close",
+	FALLBACK_DECOY: "decoy",
+}
+
+func (m FallbackMode) String() string {
+	if name, ok := fallbackModeNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("FallbackMode(%d)", int(m))
+}
+
+// ParseFallbackMode parses "drain", "close" or "decoy".
+func ParseFallbackMode(name string) (FallbackMode, error) {
+	for m, n := range fallbackModeNames {
+		if n == name {
+			return m, nil
+		}
+	}
+	return FALLBACK_DRAIN, fmt.Errorf("Unknown fallback mode: %s", name)
+}
+
+// fallback handles conn which failed authentication, and closes it
+// when done. received is the data read from conn so far, which is
+// replayed to the decoy server if replayable.
+func (ctx *ServerContext) fallback(conn *net.TCPConn, received []byte, replayable bool) {
+	defer conn.Close()
+	switch ctx.fallbackMode {
+	case FALLBACK_CLOSE:
+		delay := ctx.fallbackDelay
+		if delay <= 0 {
+			delay = DEFAULT_FALLBACK_DELAY
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Duration(rand.Int63n(int64(delay)))))
+	case FALLBACK_DECOY:
+		if !replayable {
+			break
+		}
+		dconn, err := net.DialTimeout("tcp", ctx.fallbackDecoy, ctx.connectTimeout)
+		if err != nil {
+			log.Print(err)
+			break
+		}
+		defer dconn.Close()
+		buf := &SSBuffer{buf: make([]byte, 0, len(received)+DEFAULT_BUF_SIZE)}
+		buf.buf = append(buf.buf, received...)
+		res := make(chan error, 1)
+		DPipe(PlainConn{TCPConn: conn}, PlainConn{TCPConn: dconn.(*net.TCPConn)}, buf, NewBuffer(), res)
+		<-res
+		return
+	}
+	devnull := make([]byte, DEFAULT_BUF_SIZE)
+	var err error
+	for err == nil {
+		_, err = conn.Read(devnull)
+	}
+}
@@ -0,0 +1,93 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFallbackDecoy(t *testing.T) {
+	decoy, err := net.Listen("tcp", "127.0.0.1:7071")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer decoy.Close()
+	go func() { // an echo server
+		for {
+			conn, err := decoy.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	serverConfig := DefaultConfig()
+	serverConfig.ServerHost = "127.0.0.1"
+	serverConfig.ServerPort = 7070
+	serverConfig.KeyDeriver = NewKeyDeriver([]byte("fallback"))
+	serverConfig.Fallback = FALLBACK_DECOY
+	serverConfig.FallbackDecoy = "127.0.0.1:7071"
+	server, err := NewServerContext(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+	defer server.Wait()
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:7070")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	probe := bytes.Repeat([]byte("GET / HTTP/1.1\r\n"), 8)
+	conn.Write(probe)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply := make([]byte, len(probe))
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply, probe) {
+		t.Fatal("Wrong data replayed to the decoy:", string(reply))
+	}
+}
+
+func TestFallbackClose(t *testing.T) {
+	serverConfig := DefaultConfig()
+	serverConfig.ServerHost = "127.0.0.1"
+	serverConfig.ServerPort = 7072
+	serverConfig.KeyDeriver = NewKeyDeriver([]byte("fallback"))
+	serverConfig.Fallback = FALLBACK_CLOSE
+	serverConfig.FallbackDelay = 200 * time.Millisecond
+	server, err := NewServerContext(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+	defer server.Wait()
+	defer server.Stop()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:7072")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(make([]byte, 100))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("Connection is not closed:", err)
+	}
+
+	if _, err = ParseFallbackMode("decoy"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseFallbackMode("reset"); err == nil {
+		t.Fatal("Unknown fallback mode is parsed")
+	}
+}
@@ -1,12 +1,36 @@
 package shadowsocks
 
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MANAGER_STAT_INTERVAL = 10 * time.Second
+
+// ServerManager manages servers listening on different ports.
+// The servers can be added and removed through the manager API
+// used by shadowsocks-libev, see Listen.
 type ServerManager struct {
-	servers map[string]*ServerContext
+	servers     map[string]*ServerContext
+	template    Config
+	lock        sync.Mutex
+	conn        net.PacketConn
+	subscribers map[string]net.Addr
 }
 
-func NewServerManager() ServerManager {
-	return ServerManager{
-		servers: make(map[string]*ServerContext),
+// NewServerManager creates a new manager. config is the template
+// of the servers added through the manager API.
+func NewServerManager(config Config) *ServerManager {
+	return &ServerManager{
+		servers:     make(map[string]*ServerContext),
+		template:    config,
+		subscribers: make(map[string]net.Addr),
 	}
 }
 
@@ -18,21 +42,611 @@ func (m *ServerManager) Add(config Config) (err error) {
 		return
 	}
 	go ctx.Run()
+	m.lock.Lock()
 	m.servers[key] = &ctx
+	m.lock.Unlock()
 	return
 }
 
-func (m *ServerManager) Remove(host string, port uint16) (err error) {
-	key := WrapAddr(host, port)
-	ctx, ok := m.servers[key]
-	if !ok {
+// Remove stops the servers on port, whatever host they listen on.
+func (m *ServerManager) Remove(port uint16) (err error) {
+	var removed []*ServerContext
+	m.lock.Lock()
+	for key, ctx := range m.servers {
+		if ctx.Port() == port {
+			removed = append(removed, ctx)
+			delete(m.servers, key)
+		}
+	}
+	m.lock.Unlock()
+	if len(removed) == 0 {
 		return ERR_SERVER_NOT_EXIST
 	}
-	ctx.Stop() // ignoring errors
-	delete(m.servers, key)
+	for _, ctx := range removed {
+		ctx.Stop() // ignoring errors
+	}
+	return
+}
+
+// Traffic returns the bytes relayed by the servers, keyed by port.
+func (m *ServerManager) Traffic() map[uint16]int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := make(map[uint16]int64, len(m.servers))
+	for _, ctx := range m.servers {
+		res[ctx.Port()] += ctx.Stats().Total()
+	}
+	return res
+}
+
+// Stats returns the traffic stats of the servers, keyed by port.
+func (m *ServerManager) Stats() map[uint16]TrafficSnapshot {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := make(map[uint16]TrafficSnapshot, len(m.servers))
+	for _, ctx := range m.servers {
+		res[ctx.Port()] = ctx.Stats().Snapshot()
+	}
+	return res
+}
+
+// ResetStats resets the traffic stats of the servers and their
+// users, and returns the stats of the servers before reset.
+func (m *ServerManager) ResetStats() map[uint16]TrafficSnapshot {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := make(map[uint16]TrafficSnapshot, len(m.servers))
+	for _, ctx := range m.servers {
+		res[ctx.Port()] = ctx.Stats().Reset()
+		for _, user := range ctx.Users() {
+			user.Stats().Reset()
+		}
+	}
+	return res
+}
+
+// UserStats returns the traffic stats of the users of the server
+// on port, keyed by user name.
+func (m *ServerManager) UserStats(port uint16) (res map[string]TrafficSnapshot, err error) {
+	var ctx *ServerContext
+	if ctx, err = m.server(port); err != nil {
+		return
+	}
+	res = map[string]TrafficSnapshot{}
+	for _, user := range ctx.Users() {
+		res[user.Name] = user.Stats().Snapshot()
+	}
+	return
+}
+
+// ResetUserStats resets the traffic stats of the users of the
+// server on port, and returns the stats before reset.
+func (m *ServerManager) ResetUserStats(port uint16) (res map[string]TrafficSnapshot, err error) {
+	var ctx *ServerContext
+	if ctx, err = m.server(port); err != nil {
+		return
+	}
+	res = map[string]TrafficSnapshot{}
+	for _, user := range ctx.Users() {
+		res[user.Name] = user.Stats().Reset()
+	}
+	return
+}
+
+// SetQuota sets the limit of bytes and the expiry time of the
+// server on port. A zero limit or a zero expiry time means unlimited.
+func (m *ServerManager) SetQuota(port uint16, limit int64, expiry time.Time) error {
+	ctx, err := m.server(port)
+	if err != nil {
+		return err
+	}
+	ctx.Quota().Set(limit, expiry)
+	return nil
+}
+
+// SetUserQuota sets the limit of bytes and the expiry time of the
+// user named name of the server on port.
+func (m *ServerManager) SetUserQuota(port uint16, name string, limit int64, expiry time.Time) error {
+	ctx, err := m.server(port)
+	if err != nil {
+		return err
+	}
+	user := ctx.User(name)
+	if user == nil {
+		return ERR_USER_NOT_EXIST
+	}
+	user.Quota().Set(limit, expiry)
+	return nil
+}
+
+// RenewQuota starts counting the traffic of the quota of the server
+// on port from zero again. The traffic stats are not reset.
+func (m *ServerManager) RenewQuota(port uint16) error {
+	ctx, err := m.server(port)
+	if err != nil {
+		return err
+	}
+	ctx.Quota().Renew()
+	return nil
+}
+
+// RenewUserQuota renews the quota of the user named name of the
+// server on port.
+func (m *ServerManager) RenewUserQuota(port uint16, name string) error {
+	ctx, err := m.server(port)
+	if err != nil {
+		return err
+	}
+	user := ctx.User(name)
+	if user == nil {
+		return ERR_USER_NOT_EXIST
+	}
+	user.Quota().Renew()
+	return nil
+}
+
+// SetRateLimit sets the upload and download rates of the server
+// on port in bytes per second, 0 for unlimited, and the size of their
+// buckets in bytes, 0 for the bytes of one second. The rates are
+// shared by all the connections of the server, including the alive
+// ones.
+func (m *ServerManager) SetRateLimit(port uint16, upload, download, burst int64) error {
+	ctx, err := m.server(port)
+	if err != nil {
+		return err
+	}
+	ctx.Bandwidth().Set(upload, download, burst)
+	return nil
+}
+
+// SetUserRateLimit sets the upload and download rates and the burst
+// of the user named name of the server on port.
+func (m *ServerManager) SetUserRateLimit(port uint16, name string, upload, download, burst int64) error {
+	ctx, err := m.server(port)
+	if err != nil {
+		return err
+	}
+	user := ctx.User(name)
+	if user == nil {
+		return ERR_USER_NOT_EXIST
+	}
+	user.Bandwidth().Set(upload, download, burst)
+	return nil
+}
+
+// SetMaxConns sets the maximum simultaneous connections of the
+// server on port, and from each source address. 0 means unlimited.
+func (m *ServerManager) SetMaxConns(port uint16, perPort, perIP int) error {
+	ctx, err := m.server(port)
+	if err != nil {
+		return err
+	}
+	ctx.Quota().SetMaxConns(perPort)
+	ctx.Sources().SetMax(perIP)
+	return nil
+}
+
+// SetUserMaxConns sets the maximum simultaneous connections of the
+// user named name of the server on port, 0 for unlimited.
+func (m *ServerManager) SetUserMaxConns(port uint16, name string, max int) error {
+	ctx, err := m.server(port)
+	if err != nil {
+		return err
+	}
+	user := ctx.User(name)
+	if user == nil {
+		return ERR_USER_NOT_EXIST
+	}
+	user.Quota().SetMaxConns(max)
+	return nil
+}
+
+// BanList returns the ban list shared by the servers, which is
+// the one of the template config, or nil if banning is disabled.
+func (m *ServerManager) BanList() *BanList {
+	return m.template.BanList
+}
+
+// Quotas returns the quota states of the servers, keyed by port.
+func (m *ServerManager) Quotas() map[uint16]QuotaState {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := make(map[uint16]QuotaState, len(m.servers))
+	for _, ctx := range m.servers {
+		res[ctx.Port()] = ctx.Quota().State()
+	}
+	return res
+}
+
+// UserQuotas returns the quota states of the users of the server
+// on port, keyed by user name.
+func (m *ServerManager) UserQuotas(port uint16) (res map[string]QuotaState, err error) {
+	var ctx *ServerContext
+	if ctx, err = m.server(port); err != nil {
+		return
+	}
+	res = map[string]QuotaState{}
+	for _, user := range ctx.Users() {
+		res[user.Name] = user.Quota().State()
+	}
 	return
 }
 
+func (m *ServerManager) server(port uint16) (*ServerContext, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, ctx := range m.servers {
+		if ctx.Port() == port {
+			return ctx, nil
+		}
+	}
+	return nil, ERR_SERVER_NOT_EXIST
+}
+
+// managerPort is a port in the manager API, which may be either
+// a number or a string.
+type managerPort uint16
+
+func (p *managerPort) UnmarshalJSON(b []byte) error {
+	port, err := strconv.Atoi(strings.Trim(string(b), "\""))
+	if err != nil || port <= 0 || port > 65535 {
+		return ERR_INVALID_ADDR
+	}
+	*p = managerPort(port)
+	return nil
+}
+
+type managerRequest struct {
+	ServerPort    managerPort `json:"server_port"`
+	Password      string      `json:"password"`
+	Method        string      `json:"method"`
+	User          string      `json:"user"`
+	Limit         *int64      `json:"limit"`
+	Expiry        *int64      `json:"expiry"`
+	Upload        int64       `json:"upload"`
+	Download      int64       `json:"download"`
+	Burst         int64       `json:"burst"`
+	MaxConns      *int        `json:"max_conns"`
+	MaxConnsPerIP *int        `json:"max_conns_per_ip"`
+}
+
+func (req *managerRequest) limit() int64 {
+	if req.Limit == nil {
+		return 0
+	}
+	return *req.Limit
+}
+
+func (req *managerRequest) expiry() time.Time {
+	if req.Expiry == nil || *req.Expiry == 0 {
+		return time.Time{}
+	}
+	return time.Unix(*req.Expiry, 0)
+}
+
+// managerQuota is the reply of a quota query.
+type managerQuota struct {
+	QuotaState
+	MaxConnsPerIP int                   `json:"max_conns_per_ip"`
+	Users         map[string]QuotaState `json:"users,omitempty"`
+}
+
+// Listen serves the manager API on addr, which is either a UDP
+// address or the path of a unix datagram socket, and blocks until
+// the manager is closed. The commands are:
+//
+//	add: {"server_port": 8001, "password": "7cd308cc059"}
+//	remove: {"server_port": 8001}
+//	quota: {"server_port": 8001, "limit": 1073741824, "expiry": 1700000000}
+//	quota: {"server_port": 8001}
+//	renew: {"server_port": 8001}
+//	limit: {"server_port": 8001, "upload": 1048576, "download": 1048576, "burst": 4194304}
+//	max_conns: {"server_port": 8001, "max_conns": 100, "max_conns_per_ip": 10}
+//	bans
+//	unban: {"ip": "192.0.2.1"}
+//	clear_bans
+//	ping
+//
+// add and remove are answered with "ok" or "err", and ping with
+// "pong". Every client which pings is then sent the traffic of
+// each port periodically, e.g. stat: {"8001": 11370}
+//
+// add also accepts "limit" (bytes) and "expiry" (unix seconds) to
+// set the quota of the new server, and so does quota, which sets the
+// quota of a server, or of one of its users if "user" is given. A
+// quota without limit and expiry is a query, answered with e.g.
+// {"limit": 1073741824, "used": 11370, "expiry": 0, "exceeded": false,
+// "max_conns": 100, "rejected": 3, "max_conns_per_ip": 10}
+// which also has the quotas of the users of a multi-user server.
+// rejected counts the connections rejected by the quota and the
+// connection limits since the stats were last reported.
+// renew counts the traffic used by the quota of a server, or of one
+// of its users if "user" is given, from zero again. The traffic used
+// is not reset with the stats, nor the stats with renew.
+//
+// limit sets the upload and download rates in bytes per second of a
+// server, or of one of its users if "user" is given, and the size of
+// their buckets in bytes. 0 or no rate means unlimited, and 0 or no
+// burst means the bytes of one second. add also accepts the rates and
+// the burst of the new server, which default to those of the template.
+//
+// max_conns sets the maximum simultaneous connections of a server and
+// from each source address, or of one of its users if "user" is given.
+// 0 means unlimited, and the limits absent are kept. add also accepts
+// the limits of the new server.
+//
+// bans is answered with the banned addresses and the expiry of their
+// bans in unix seconds, e.g. {"192.0.2.1": 1700000000}. unban lifts
+// the ban of an address, and clear_bans lifts all bans. They are
+// answered with "err" if banning is disabled.
+// Specification:
+// https://github.com/shadowsocks/shadowsocks-libev#advanced-usage
 func (m *ServerManager) Listen(addr string) (err error) {
-	return ERR_UNIMPLEMENTED
+	var conn net.PacketConn
+	if _, _, e := UnwrapAddr(addr); e == nil {
+		conn, err = net.ListenPacket("udp", addr)
+	} else {
+		if fi, e := os.Stat(addr); e == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr) // stale socket
+		}
+		conn, err = net.ListenPacket("unixgram", addr)
+	}
+	if err != nil {
+		return
+	}
+	m.lock.Lock()
+	m.conn = conn
+	m.lock.Unlock()
+	defer conn.Close()
+
+	done := make(chan bool)
+	defer close(done)
+	go m.reportStats(conn, done)
+
+	buf := make([]byte, MAX_UDP_PACKET_SIZE)
+	for {
+		var n int
+		var from net.Addr
+		n, from, err = conn.ReadFrom(buf)
+		if err != nil {
+			if isClosedError(err) {
+				err = nil
+			}
+			return
+		}
+		res := m.HandleCommand(strings.Trim(string(buf[:n]), " \r\n\x00"), from)
+		if from != nil && from.String() != "" {
+			conn.WriteTo([]byte(res), from)
+		}
+	}
+}
+
+// Close stops the manager API.
+func (m *ServerManager) Close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.conn != nil {
+		m.conn.Close()
+	}
+}
+
+// HandleCommand executes a command of the manager API received
+// from addr, and returns the reply.
+func (m *ServerManager) HandleCommand(command string, from net.Addr) string {
+	name, arg := command, ""
+	if p := strings.Index(command, ":"); p != -1 {
+		name, arg = command[:p], strings.TrimSpace(command[p+1:])
+	}
+	switch name {
+	case "ping":
+		if from != nil && from.String() != "" {
+			m.lock.Lock()
+			m.subscribers[from.String()] = from
+			m.lock.Unlock()
+		}
+		return "pong"
+	case "add", "remove":
+		var req managerRequest
+		if err := json.Unmarshal([]byte(arg), &req); err != nil || req.ServerPort == 0 {
+			log.Printf("Invalid manager command: %s", command)
+			return "err"
+		}
+		var err error
+		if name == "add" {
+			config := m.template
+			config.ServerPort = uint16(req.ServerPort)
+			if req.Upload != 0 || req.Download != 0 || req.Burst != 0 {
+				config.UploadRate, config.DownloadRate, config.RateBurst = req.Upload, req.Download, req.Burst
+			}
+			if req.Method != "" {
+				config.Method = req.Method
+			}
+			if req.MaxConns != nil {
+				config.MaxConns = *req.MaxConns
+			}
+			if req.MaxConnsPerIP != nil {
+				config.MaxConnsPerIP = *req.MaxConnsPerIP
+			}
+			if config.KeyDeriver, err = NewKeyReader(config.Method, req.Password); err == nil {
+				err = m.Add(config)
+			}
+			if err == nil && (req.Limit != nil || req.Expiry != nil) {
+				err = m.SetQuota(config.ServerPort, req.limit(), req.expiry())
+			}
+		} else {
+			err = m.Remove(uint16(req.ServerPort))
+		}
+		if err != nil {
+			log.Print(err)
+			return "err"
+		}
+		return "ok"
+	case "limit":
+		var req managerRequest
+		if err := json.Unmarshal([]byte(arg), &req); err != nil || req.ServerPort == 0 {
+			log.Printf("Invalid manager command: %s", command)
+			return "err"
+		}
+		var err error
+		if req.User == "" {
+			err = m.SetRateLimit(uint16(req.ServerPort), req.Upload, req.Download, req.Burst)
+		} else {
+			err = m.SetUserRateLimit(uint16(req.ServerPort), req.User, req.Upload, req.Download, req.Burst)
+		}
+		if err != nil {
+			log.Print(err)
+			return "err"
+		}
+		return "ok"
+	case "max_conns":
+		var req managerRequest
+		if err := json.Unmarshal([]byte(arg), &req); err != nil || req.ServerPort == 0 ||
+			req.MaxConns == nil && req.MaxConnsPerIP == nil || req.User != "" && req.MaxConnsPerIP != nil {
+			log.Printf("Invalid manager command: %s", command)
+			return "err"
+		}
+		if err := m.setMaxConns(req); err != nil {
+			log.Print(err)
+			return "err"
+		}
+		return "ok"
+	case "bans":
+		if m.BanList() == nil {
+			return "err"
+		}
+		bans := map[string]int64{}
+		for source, expiry := range m.BanList().Bans() {
+			bans[source] = expiry.Unix()
+		}
+		data, _ := json.Marshal(bans)
+		return string(data)
+	case "unban":
+		var req struct {
+			IP string `json:"ip"`
+		}
+		if err := json.Unmarshal([]byte(arg), &req); err != nil || req.IP == "" {
+			log.Printf("Invalid manager command: %s", command)
+			return "err"
+		}
+		if m.BanList() == nil || !m.BanList().Unban(req.IP) {
+			return "err"
+		}
+		return "ok"
+	case "clear_bans":
+		if m.BanList() == nil {
+			return "err"
+		}
+		m.BanList().Clear()
+		return "ok"
+	case "quota":
+		var req managerRequest
+		if err := json.Unmarshal([]byte(arg), &req); err != nil || req.ServerPort == 0 {
+			log.Printf("Invalid manager command: %s", command)
+			return "err"
+		}
+		if req.Limit == nil && req.Expiry == nil {
+			return m.queryQuota(req)
+		}
+		var err error
+		if req.User == "" {
+			err = m.SetQuota(uint16(req.ServerPort), req.limit(), req.expiry())
+		} else {
+			err = m.SetUserQuota(uint16(req.ServerPort), req.User, req.limit(), req.expiry())
+		}
+		if err != nil {
+			log.Print(err)
+			return "err"
+		}
+		return "ok"
+	case "renew":
+		var req managerRequest
+		if err := json.Unmarshal([]byte(arg), &req); err != nil || req.ServerPort == 0 {
+			log.Printf("Invalid manager command: %s", command)
+			return "err"
+		}
+		var err error
+		if req.User == "" {
+			err = m.RenewQuota(uint16(req.ServerPort))
+		} else {
+			err = m.RenewUserQuota(uint16(req.ServerPort), req.User)
+		}
+		if err != nil {
+			log.Print(err)
+			return "err"
+		}
+		return "ok"
+	}
+	log.Printf("Unknown manager command: %s", command)
+	return "err"
+}
+
+// setMaxConns sets the connection limits given by req, keeping the
+// others.
+func (m *ServerManager) setMaxConns(req managerRequest) error {
+	if req.User != "" {
+		return m.SetUserMaxConns(uint16(req.ServerPort), req.User, *req.MaxConns)
+	}
+	ctx, err := m.server(uint16(req.ServerPort))
+	if err != nil {
+		return err
+	}
+	perPort, perIP := ctx.Quota().State().MaxConns, ctx.Sources().Max()
+	if req.MaxConns != nil {
+		perPort = *req.MaxConns
+	}
+	if req.MaxConnsPerIP != nil {
+		perIP = *req.MaxConnsPerIP
+	}
+	return m.SetMaxConns(uint16(req.ServerPort), perPort, perIP)
+}
+
+func (m *ServerManager) queryQuota(req managerRequest) string {
+	ctx, err := m.server(uint16(req.ServerPort))
+	if err != nil {
+		return "err"
+	}
+	var data []byte
+	if req.User != "" {
+		user := ctx.User(req.User)
+		if user == nil {
+			return "err"
+		}
+		data, err = json.Marshal(user.Quota().State())
+	} else {
+		res := managerQuota{QuotaState: ctx.Quota().State(), MaxConnsPerIP: ctx.Sources().Max()}
+		if users := ctx.Users(); users != nil {
+			res.Users = make(map[string]QuotaState, len(users))
+			for _, user := range users {
+				res.Users[user.Name] = user.Quota().State()
+			}
+		}
+		data, err = json.Marshal(res)
+	}
+	if err != nil {
+		return "err"
+	}
+	return string(data)
+}
+
+func (m *ServerManager) reportStats(conn net.PacketConn, done chan bool) {
+	ticker := time.NewTicker(MANAGER_STAT_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		stat := map[string]int64{}
+		for port, traffic := range m.Traffic() {
+			stat[strconv.Itoa(int(port))] = traffic
+		}
+		data, _ := json.Marshal(stat)
+		msg := append([]byte("stat: "), data...)
+		m.lock.Lock()
+		for _, addr := range m.subscribers {
+			conn.WriteTo(msg, addr)
+		}
+		m.lock.Unlock()
+	}
 }
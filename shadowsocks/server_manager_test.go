@@ -0,0 +1,107 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerManagerAPI(t *testing.T) {
+	template := DefaultConfig()
+	template.ServerHost = "127.0.0.1"
+	manager := NewServerManager(template)
+	res := make(chan error, 1)
+	go func() { res <- manager.Listen("127.0.0.1:7030") }()
+	defer func() {
+		manager.Close()
+		if err := <-res; err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	conn, err := net.Dial("udp", "127.0.0.1:7030")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	buf := make([]byte, 1024)
+	for _, c := range []struct{ command, reply string }{
+		{"ping", "pong"},
+		{`add: {"server_port": 7031, "password": "testkey"}`, "ok"},
+		{`add: {"server_port": 7031, "password": "testkey"}`, "err"},
+		{`quota: {"server_port": 7031, "limit": 100}`, "ok"},
+		{`quota: {"server_port": 7031}`, `{"limit":100,"used":0,"expiry":0,"exceeded":false,"max_conns":0,"rejected":0,"max_conns_per_ip":0}`},
+		{`max_conns: {"server_port": 7031, "max_conns": 10, "max_conns_per_ip": 2}`, "ok"},
+		{`max_conns: {"server_port": 7031, "max_conns": 5}`, "ok"},
+		{`quota: {"server_port": 7031}`, `{"limit":100,"used":0,"expiry":0,"exceeded":false,"max_conns":5,"rejected":0,"max_conns_per_ip":2}`},
+		{`max_conns: {"server_port": 7031}`, "err"},
+		{`max_conns: {"server_port": 7031, "user": "nobody", "max_conns": 1}`, "err"},
+		{`max_conns: {"server_port": 7032, "max_conns": 1}`, "err"},
+		{`quota: {"server_port": 7031, "user": "nobody", "limit": 100}`, "err"},
+		{`quota: {"server_port": 7032, "limit": 100}`, "err"},
+		{`renew: {"server_port": 7031}`, "ok"},
+		{`renew: {"server_port": 7031, "user": "nobody"}`, "err"},
+		{`renew: {"server_port": 7032}`, "err"},
+		{`limit: {"server_port": 7031, "upload": 1048576, "download": 1048576, "burst": 4194304}`, "ok"},
+		{`limit: {"server_port": 7031, "user": "nobody", "upload": 1}`, "err"},
+		{`remove: {"server_port": "7031"}`, "ok"},
+		{`remove: {"server_port": 7031}`, "err"},
+		{"nonsense", "err"},
+	} {
+		var n int
+		for i := 0; i < 10; i++ { // the manager may not be listening yet
+			conn.Write([]byte(c.command))
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if n, err = conn.Read(buf); err == nil {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(c.command, err)
+		}
+		if string(buf[:n]) != c.reply {
+			t.Fatal(c.command, "Wrong reply:", string(buf[:n]))
+		}
+	}
+
+	if res := manager.HandleCommand(`add: {"server_port": 7033, "password": "testkey", "upload": 1000, "burst": 5000}`, nil); res != "ok" {
+		t.Fatal("Wrong reply of add:", res)
+	}
+	defer manager.Remove(7033)
+	server, err := manager.server(7033)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate, burst := server.Bandwidth().Upload.Rate(); rate != 1000 || burst != 5000 {
+		t.Fatal("Wrong upload rate:", rate, burst)
+	}
+	manager.HandleCommand(`limit: {"server_port": 7033, "download": 2000, "burst": 8000}`, nil)
+	if rate, burst := server.Bandwidth().Download.Rate(); rate != 2000 || burst != 8000 {
+		t.Fatal("Wrong download rate:", rate, burst)
+	}
+}
+
+func TestServerManagerRemove(t *testing.T) {
+	template := DefaultConfig()
+	template.ServerHost = "" // as when the servers come from a config file
+	manager := NewServerManager(template)
+	serverConfig, _ := testConfigs(7210, "manager")
+	if err := manager.Add(serverConfig); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond) // a server is stopped once running
+	if res := manager.HandleCommand(`remove: {"server_port": 7210}`, nil); res != "ok" {
+		t.Fatal("Wrong reply of remove:", res)
+	}
+	if _, err := manager.server(7210); err != ERR_SERVER_NOT_EXIST {
+		t.Fatal("Server not removed:", err)
+	}
+	if conn, err := net.Dial("tcp", "127.0.0.1:7210"); err == nil {
+		conn.Close()
+		t.Fatal("Server still listening")
+	}
+	if res := manager.HandleCommand(`remove: {"server_port": 7210}`, nil); res != "err" {
+		t.Fatal("Wrong reply of remove:", res)
+	}
+}
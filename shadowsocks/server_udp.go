@@ -0,0 +1,159 @@
+package shadowsocks
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+// MAX_UDP_RESOLVING is the maximum number of packets of a server
+// resolving their target host names at the same time. More packets
+// with host names are dropped.
+const MAX_UDP_RESOLVING = 64
+
+// RunUDP relays UDP packets of the server, normally running in
+// a new goroutine. It returns when the UDP socket is closed. The
+// packets dropped are logged at most once per DROP_LOG_INTERVAL.
+// Specification:
+// https://shadowsocks.org/en/spec/AEAD-Ciphers.html
+func (ctx *ServerContext) RunUDP() {
+	if ctx.udpServer == nil {
+		return
+	}
+	defer ctx.nat.Close()
+	buf := make([]byte, MAX_UDP_PACKET_SIZE)
+	var drops dropLog
+	for {
+		n, caddr, err := ctx.udpServer.ReadFromUDP(buf)
+		if err != nil {
+			if !isClosedError(err) {
+				log.Print(err)
+			}
+			return
+		}
+		if err = ctx.HandlePacket(buf[:n], caddr); err != nil {
+			// e.g. probes and replays, which may be many
+			drops.Drop(fmt.Errorf("%v(%v, udp)", err, caddr))
+		}
+	}
+}
+
+// HandlePacket decrypts a packet from caddr and relays it to the
+// target in its address header.
+func (ctx *ServerContext) HandlePacket(pkt []byte, caddr *net.UDPAddr) (err error) {
+	if ctx.banList != nil && ctx.banList.Banned(caddr.IP.String()) {
+		return // dropped silently
+	}
+	if ctx.quota.Exceeded() {
+		return ERR_QUOTA_EXCEEDED
+	}
+	var plain []byte
+	var user *ServerUser
+	cipher := ctx.udpCipher
+	key := caddr.String()
+	if ctx.users != nil {
+		if plain, user, err = ctx.users.OpenPacket(caddr.IP.String(), pkt); err != nil {
+			return
+		}
+		if user.quota.Exceeded() {
+			return ERR_QUOTA_EXCEEDED
+		}
+		cipher, key = user.factory, key+"/"+user.Name
+	} else if sc, ok := cipher.(SessionPacketCipher); ok {
+		// the replies are sealed by the session of the client
+		if plain, cipher, err = sc.OpenSessionPacket(nil, pkt); err != nil {
+			return
+		}
+		key += "/" + fmt.Sprint(cipher)
+	} else if plain, err = cipher.OpenPacket(nil, pkt); err != nil {
+		return
+	}
+	var addr string
+	var ln int
+	if addr, ln, err = ParseAddress(plain); err != nil {
+		return
+	}
+	if len(plain) < ln {
+		return ERR_INVALID_ADDR
+	}
+	var netType string
+	if ctx.connectV4Only {
+		netType = "udp4"
+	} else {
+		netType = "udp"
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	literal := net.ParseIP(host) != nil
+	if literal { // hostnames are checked after resolution
+		if addr, err = ctx.resolveDest(netType, addr); err != nil {
+			return
+		}
+	}
+	payload := plain[ln:]
+	if !ctx.bandwidth.Upload.Allow(len(payload)) || user != nil && !user.bandwidth.Upload.Allow(len(payload)) {
+		return // dropped as the relay cannot wait
+	}
+	var session *UDPSession
+	session, err = ctx.nat.Get(key, cipher, func(s *UDPSession, pkt []byte, from *net.UDPAddr) {
+		ctx.replyPacket(pkt, from, caddr, s.Cipher(), user)
+	})
+	if err != nil {
+		return
+	}
+	if !literal {
+		select {
+		case ctx.resolving <- struct{}{}:
+		default:
+			return // dropped as the relay cannot wait
+		}
+	}
+	ctx.stats.addUpload(int64(len(payload)))
+	if user != nil {
+		user.stats.addUpload(int64(len(payload)))
+	}
+
+	if literal {
+		var raddr *net.UDPAddr
+		if raddr, err = net.ResolveUDPAddr(netType, addr); err != nil {
+			return
+		}
+		return session.WriteTo(payload, raddr)
+	}
+	// do not block the relay on name resolution
+	go func() {
+		defer func() { <-ctx.resolving }()
+		var raddr *net.UDPAddr
+		target, err := ctx.resolveDest(netType, addr)
+		if err == nil {
+			raddr, err = net.ResolveUDPAddr(netType, target)
+		}
+		if err == nil {
+			err = session.WriteTo(payload, raddr)
+		}
+		if err != nil {
+			log.Print(err.Error() + "(" + caddr.String() + ", udp)")
+		}
+	}()
+	return
+}
+
+// replyPacket seals a reply from the target from to caddr with
+// cipher, the one of user on multi-user servers.
+func (ctx *ServerContext) replyPacket(payload []byte, from, caddr *net.UDPAddr, cipher PacketCipher, user *ServerUser) {
+	if !ctx.bandwidth.Download.Allow(len(payload)) || user != nil && !user.bandwidth.Download.Allow(len(payload)) {
+		return
+	}
+	plain := make([]byte, 0, 19+len(payload))
+	plain, _ = AppendAddress(plain, from.IP.String(), uint16(from.Port))
+	plain = append(plain, payload...)
+	pkt, err := cipher.SealPacket(nil, plain)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	ctx.stats.addDownload(int64(len(payload)))
+	if user != nil {
+		user.stats.addDownload(int64(len(payload)))
+	}
+	ctx.udpServer.WriteToUDP(pkt, caddr)
+}
@@ -0,0 +1,73 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerUDPRelay(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, MAX_UDP_PACKET_SIZE)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	info := Ciphers["chacha20-ietf-poly1305"]
+	key := make([]byte, info.keySize)
+	DeriveKey(key, []byte("testkey"))
+	cipher := info.newFactory(key).(PacketCipher)
+
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	eaddr := echo.LocalAddr().(*net.UDPAddr)
+	header, _ := AppendAddress(nil, "127.0.0.1", uint16(eaddr.Port))
+	plain := append(append([]byte(nil), header...), []byte("Hello")...)
+	buf := make([]byte, MAX_UDP_PACKET_SIZE)
+	var pkt []byte
+	for i := 0; i < 3; i++ {
+		if pkt, err = cipher.SealPacket(nil, plain); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write(pkt); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		var n int
+		if n, err = conn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		var res []byte
+		if res, err = cipher.OpenPacket(nil, buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(res, plain) {
+			t.Fatal("Wrong content:", res)
+		}
+		// the replies are not accepted twice either
+		if _, err = cipher.OpenPacket(nil, buf[:n]); err != ERR_DUP_SALT {
+			t.Fatal("Wrong error of a replayed reply:", err)
+		}
+	}
+	// the replayed packet is dropped
+	conn.Write(pkt)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err = conn.Read(buf); err == nil {
+		t.Fatal("Replayed packet is relayed")
+	}
+}
@@ -0,0 +1,242 @@
+package shadowsocks
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of sources remembered, the least recently seen
+	// are forgotten first
+	MAX_USER_HINTS = 65536
+	// Failed trial decryptions allowed from a source in a
+	// USER_TRIAL_WINDOW, in rounds of trying all the users
+	USER_TRIAL_ROUNDS = 4
+	USER_TRIAL_WINDOW = time.Minute
+)
+
+// ServerUser is a user of a multi-user server.
+type ServerUser struct {
+	Name      string
+	factory   *AEADCipherFactory
+	stats     TrafficStats
+	quota     *Quota
+	bandwidth *Bandwidth
+}
+
+// Stats returns the traffic stats of the user.
+func (u *ServerUser) Stats() *TrafficStats {
+	return &u.stats
+}
+
+// Quota returns the quota of the user.
+func (u *ServerUser) Quota() *Quota {
+	return u.quota
+}
+
+// Bandwidth returns the bandwidth limit of the user, shared by all
+// the connections of the user.
+func (u *ServerUser) Bandwidth() *Bandwidth {
+	return u.bandwidth
+}
+
+// UserTable holds the users of a multi-user server. Users are
+// identified by trial decryption, which costs a key derivation for
+// every user tried, so the table remembers the user each source
+// address authenticated as and tries that user first. A returning
+// client is then identified with a single attempt however many
+// users there are. The failed attempts of a source are limited to
+// USER_TRIAL_ROUNDS rounds per USER_TRIAL_WINDOW, after which its
+// connections and packets are rejected without trying any user.
+type UserTable struct {
+	lock    sync.Mutex
+	users   []*ServerUser
+	lru     *list.List // of *userHint, the most recently seen first
+	hints   map[string]*list.Element
+	noHints bool
+}
+
+type userHint struct {
+	source string
+	user   *ServerUser
+	failed int // trials failed since start
+	start  time.Time
+}
+
+// NewUserTable creates the users of config with the cipher of
+// config.Method, which must be an AEAD cipher.
+func NewUserTable(config Config) (t *UserTable, err error) {
+	cipherInfo, ok := Ciphers[config.Method]
+	if !ok {
+		return nil, fmt.Errorf("Unknown cipher: %s", config.Method)
+	}
+	t = &UserTable{lru: list.New(), hints: map[string]*list.Element{}}
+	for _, user := range config.Users {
+		key := make([]byte, cipherInfo.keySize)
+		var n int
+		if n, err = user.KeyDeriver.Read(key); err != nil {
+			return
+		}
+		if n < cipherInfo.keySize {
+			return nil, fmt.Errorf("Insufficient key size of user %s", user.Name)
+		}
+		factory, ok := cipherInfo.newFactory(key).(*AEADCipherFactory)
+		if !ok {
+			return nil, fmt.Errorf("Multi-user is not supported by %s", config.Method)
+		}
+		u := &ServerUser{
+			Name:      user.Name,
+			factory:   factory,
+			bandwidth: NewBandwidth(user.UploadRate, user.DownloadRate, user.RateBurst),
+		}
+		u.quota = NewQuota(&u.stats)
+		u.quota.SetMaxConns(user.MaxConns)
+		t.users = append(t.users, u)
+	}
+	if len(t.users) == 0 {
+		return nil, fmt.Errorf("No users")
+	}
+	return
+}
+
+// DisableHints stops remembering the users of the sources, e.g. when
+// all the connections come from a plugin.
+func (t *UserTable) DisableHints() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.noHints = true
+	t.lru.Init()
+	t.hints = map[string]*list.Element{}
+}
+
+// hint returns the hint of source, creating it if create is set. It
+// must be called with the lock held.
+func (t *UserTable) hint(source string, create bool) *userHint {
+	now := time.Now()
+	var h *userHint
+	if e, ok := t.hints[source]; ok {
+		t.lru.MoveToFront(e)
+		h = e.Value.(*userHint)
+	} else if !create {
+		return nil
+	} else {
+		if t.lru.Len() >= MAX_USER_HINTS {
+			delete(t.hints, t.lru.Remove(t.lru.Back()).(*userHint).source)
+		}
+		h = &userHint{source: source, start: now}
+		t.hints[source] = t.lru.PushFront(h)
+	}
+	if now.Sub(h.start) >= USER_TRIAL_WINDOW {
+		h.failed, h.start = 0, now
+	}
+	return h
+}
+
+// Candidates returns the users in the order to be tried for source,
+// as many as the failed trials of source allow.
+func (t *UserTable) Candidates(source string) []*ServerUser {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.noHints {
+		return t.users
+	}
+	h := t.hint(source, false)
+	if h == nil {
+		return t.users
+	}
+	res := make([]*ServerUser, 0, len(t.users))
+	if h.user != nil {
+		res = append(res, h.user)
+	}
+	for _, u := range t.users {
+		if u != h.user {
+			res = append(res, u)
+		}
+	}
+	if budget := USER_TRIAL_ROUNDS*len(t.users) - h.failed; budget < len(res) {
+		if budget < 0 {
+			budget = 0
+		}
+		res = res[:budget]
+	}
+	return res
+}
+
+// Remember records that source is authenticated as u after failed
+// trials, or not authenticated at all if u is nil.
+func (t *UserTable) Remember(source string, u *ServerUser, failed int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.noHints {
+		return
+	}
+	h := t.hint(source, true)
+	if u != nil {
+		h.user = u
+	}
+	h.failed += failed
+}
+
+// OpenPacket decrypts a packet from source by trial decryption like
+// the connections, and returns the user it is sealed by.
+func (t *UserTable) OpenPacket(source string, pkt []byte) (plain []byte, u *ServerUser, err error) {
+	candidates := t.Candidates(source)
+	for i, u := range candidates {
+		if plain, err = u.factory.OpenPacket(nil, pkt); err == nil {
+			t.Remember(source, u, i)
+			return plain, u, nil
+		}
+	}
+	t.Remember(source, nil, len(candidates))
+	return nil, nil, ERR_AUTH_FAIL
+}
+
+// Users returns all the users.
+func (t *UserTable) Users() []*ServerUser {
+	return t.users // never changed after creation
+}
+
+// User returns the user named name, or nil.
+func (t *UserTable) User(name string) *ServerUser {
+	for _, u := range t.Users() {
+		if u.Name == name {
+			return u
+		}
+	}
+	return nil
+}
+
+// MultiUserCipherFactory implements CipherFactory for multi-user
+// servers. The wrapped connections identify their users on the
+// first read.
+type MultiUserCipherFactory struct {
+	users *UserTable
+}
+
+func (m *MultiUserCipherFactory) Wrap(c PlainConn) SSConn {
+	source := c.TCPConn.RemoteAddr().(*net.TCPAddr).IP.String()
+	return &AEADConn{
+		conn:    c,
+		factory: m.users.users[0].factory,
+		users:   m.users,
+		source:  source,
+	}
+}
+
+// UserConn is implemented by connections which are attributed
+// to a user of a multi-user server.
+type UserConn interface {
+	User() *ServerUser
+}
+
+// ConnUser returns the user of conn, or nil if conn is not
+// attributed to a user.
+func ConnUser(conn SSConn) *ServerUser {
+	if uc, ok := conn.(UserConn); ok {
+		return uc.User()
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMultiUser(t *testing.T) {
+	serverConfig := DefaultConfig()
+	serverConfig.ServerHost = "127.0.0.1"
+	serverConfig.ServerPort = 7020
+	for i := 0; i < 100; i++ {
+		serverConfig.Users = append(serverConfig.Users, User{
+			Name:       fmt.Sprintf("user%d", i),
+			KeyDeriver: NewKeyDeriver([]byte(fmt.Sprintf("pass%d", i))),
+		})
+	}
+	server, err := NewServerContext(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+	defer server.Wait()
+	defer server.Stop()
+
+	for i, pass := range []string{"pass0", "pass42", "pass99", "wrong"} {
+		clientConfig := DefaultConfig()
+		clientConfig.ServerHost = "127.0.0.1"
+		clientConfig.ServerPort = 7020
+		clientConfig.LocalPort = uint16(6020 + i)
+		clientConfig.KeyDeriver = NewKeyDeriver([]byte(pass))
+		client, err := NewClientContext(clientConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go client.Run()
+		socks, _ := proxy.SOCKS5("tcp", WrapAddr("127.0.0.1", clientConfig.LocalPort), nil, proxy.Direct)
+		requester := &http.Client{
+			Transport: &http.Transport{
+				Dial: socks.Dial,
+			},
+			Timeout: time.Second,
+		}
+		for j := 0; j < 3; j++ {
+			request, err := requester.Get("http://127.0.0.1:8000/hello")
+			if pass == "wrong" {
+				if err == nil {
+					t.Fatal("Unknown user is accepted")
+				}
+				break
+			}
+			if err != nil {
+				t.Fatal(pass, err)
+			}
+			content, err := ioutil.ReadAll(request.Body)
+			if err != nil {
+				t.Fatal(pass, err)
+			}
+			if string(content) != "Hello" {
+				t.Fatal(pass, "Wrong content:", string(content))
+			}
+		}
+		client.Stop()
+		client.Wait()
+	}
+
+	stats := map[string]TrafficSnapshot{}
+	for _, user := range server.Users() {
+		stats[user.Name] = user.Stats().Snapshot()
+	}
+	for _, name := range []string{"user0", "user42", "user99"} {
+		if stats[name].Connections == 0 || stats[name].Upload == 0 || stats[name].Download == 0 {
+			t.Fatal(name, "Wrong stats:", stats[name])
+		}
+	}
+	if stats["user1"] != (TrafficSnapshot{}) {
+		t.Fatal("Wrong stats of idle user:", stats["user1"])
+	}
+	total := server.Stats().Snapshot()
+	if total.Upload < stats["user0"].Upload+stats["user42"].Upload+stats["user99"].Upload {
+		t.Fatal("Wrong server stats:", total)
+	}
+	server.Stats().Reset()
+	if s := server.Stats().Snapshot(); s.Upload != 0 || s.Download != 0 || s.Connections != 0 {
+		t.Fatal("Stats not reset:", s)
+	}
+}
+
+func TestUserHints(t *testing.T) {
+	config := DefaultConfig()
+	for i := 0; i < 3; i++ {
+		config.Users = append(config.Users, User{
+			Name:       fmt.Sprintf("user%d", i),
+			KeyDeriver: NewKeyDeriver([]byte(fmt.Sprintf("pass%d", i))),
+		})
+	}
+	users, err := NewUserTable(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users.Remember("10.0.0.1", users.users[2], 2)
+	if c := users.Candidates("10.0.0.1"); len(c) != 3 || c[0] != users.users[2] {
+		t.Fatal("Wrong candidates of a remembered source:", c)
+	}
+	// failed trials use up the budget of the source only
+	for i := 0; i < USER_TRIAL_ROUNDS; i++ {
+		users.Remember("10.0.0.2", nil, len(users.Candidates("10.0.0.2")))
+	}
+	if c := users.Candidates("10.0.0.2"); len(c) != 0 {
+		t.Fatal("Trials are not limited:", c)
+	}
+	if c := users.Candidates("10.0.0.3"); len(c) != 3 {
+		t.Fatal("Wrong candidates of a new source:", c)
+	}
+	// the least recently seen sources are forgotten first
+	users.Candidates("10.0.0.1")
+	for i := 0; i < MAX_USER_HINTS-1; i++ {
+		users.Remember(fmt.Sprintf("10.1.%d.%d", i>>8, i&0xff), users.users[0], 0)
+	}
+	if c := users.Candidates("10.0.0.1"); c[0] != users.users[2] {
+		t.Fatal("Recently seen source is forgotten")
+	}
+	if c := users.Candidates("10.0.0.2"); len(c) != 3 {
+		t.Fatal("Least recently seen source is remembered")
+	}
+}
+
+func TestMultiUserUDP(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, MAX_UDP_PACKET_SIZE)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	serverConfig := DefaultConfig()
+	serverConfig.ServerHost = "127.0.0.1"
+	serverConfig.ServerPort = 7190
+	serverConfig.UDPRelay = true
+	for i := 0; i < 10; i++ {
+		serverConfig.Users = append(serverConfig.Users, User{
+			Name:       fmt.Sprintf("user%d", i),
+			KeyDeriver: NewKeyDeriver([]byte(fmt.Sprintf("pass%d", i))),
+		})
+	}
+	server, err := NewServerContext(serverConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+	defer server.Wait()
+	defer server.Stop()
+
+	info := Ciphers[serverConfig.Method]
+	key := make([]byte, info.keySize)
+	NewKeyDeriver([]byte("pass7")).Read(key)
+	cipher := info.newFactory(key).(PacketCipher)
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7190})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	header, _ := AppendAddress(nil, "127.0.0.1", uint16(echo.LocalAddr().(*net.UDPAddr).Port))
+	plain := append(header, "Hello"...)
+	buf := make([]byte, MAX_UDP_PACKET_SIZE)
+	for i := 0; i < 3; i++ {
+		pkt, err := cipher.SealPacket(nil, plain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Write(pkt); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := cipher.OpenPacket(nil, buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(res, plain) {
+			t.Fatal("Wrong content:", res)
+		}
+	}
+	if s := server.User("user7").Stats().Snapshot(); s.Upload != 15 || s.Download != 15 {
+		t.Fatal("Wrong stats:", s)
+	}
+}
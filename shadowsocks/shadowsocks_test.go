@@ -12,6 +12,10 @@ import (
 )
 
 func TestMain(m *testing.M) {
+	if opts, ok := os.LookupEnv("SS_PLUGIN_OPTIONS"); ok { // run as a plugin by TestPlugin
+		runTestPlugin(opts)
+		return
+	}
 	fmt.Println("prepare testing")
 	// start http server
 	http.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
@@ -105,3 +109,47 @@ func doTestSimple(t *testing.T, client *http.Client) {
 		}
 	}
 }
+
+// testConfigs returns the configs of a server on port and of a client
+// of it, both with aes-128-gcm and the key derived from password.
+func testConfigs(port uint16, password string) (serverConfig, clientConfig Config) {
+	serverConfig = DefaultConfig()
+	serverConfig.ServerHost = "127.0.0.1"
+	serverConfig.ServerPort = port
+	serverConfig.Method = "aes-128-gcm"
+	serverConfig.KeyDeriver = NewKeyDeriver([]byte(password))
+	clientConfig = DefaultConfig()
+	clientConfig.ServerHost = "127.0.0.1"
+	clientConfig.ServerPort = port
+	clientConfig.Method = "aes-128-gcm"
+	clientConfig.KeyDeriver = NewKeyDeriver([]byte(password))
+	return
+}
+
+// startServer runs a server of config, and returns it with a function
+// stopping it.
+func startServer(t *testing.T, config Config) (*ServerContext, func()) {
+	server, err := NewServerContext(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Run()
+	return &server, func() {
+		server.Stop()
+		server.Wait()
+	}
+}
+
+// startClient runs a client of config, and returns it with a function
+// stopping it.
+func startClient(t *testing.T, config Config) (*ClientContext, func()) {
+	client, err := NewClientContext(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.Run()
+	return &client, func() {
+		client.Stop()
+		client.Wait()
+	}
+}
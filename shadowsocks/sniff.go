@@ -0,0 +1,221 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+)
+
+// SNIFF_TIMEOUT is how long a transparently proxied connection waits
+// for the first bytes of the client to sniff the host name from.
+const SNIFF_TIMEOUT = 300 * time.Millisecond
+
+// MAX_SNIFF_SIZE is the maximum size of the data sniffed, which fits
+// in a buffer of the default size.
+const MAX_SNIFF_SIZE = DEFAULT_BUF_SIZE
+
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE "}
+
+// SniffTLSServerName extracts the server name (SNI) from a TLS
+// ClientHello. It returns ERR_SNIFF_INCOMPLETE if b is a part of a
+// ClientHello, or ERR_SNIFF_FAILED if no server name is found.
+func SniffTLSServerName(b []byte) (string, error) {
+	// record header: type, version, length
+	if len(b) < 5 {
+		if len(b) > 0 && b[0] != 0x16 || len(b) > 1 && b[1] != 0x03 {
+			return "", ERR_SNIFF_FAILED
+		}
+		return "", ERR_SNIFF_INCOMPLETE
+	}
+	if b[0] != 0x16 || b[1] != 0x03 {
+		return "", ERR_SNIFF_FAILED
+	}
+	record := b[5:]
+	if n := int(binary.BigEndian.Uint16(b[3:5])); len(record) >= n {
+		record = record[:n]
+	}
+	// handshake header: type, length
+	if len(record) < 4 {
+		return "", ERR_SNIFF_INCOMPLETE
+	}
+	if record[0] != 0x01 {
+		return "", ERR_SNIFF_FAILED
+	}
+	n := int(record[1])<<16 | int(record[2])<<8 | int(record[3])
+	if n+9 > MAX_SNIFF_SIZE {
+		return "", ERR_SNIFF_FAILED
+	}
+	if len(record)-4 < n {
+		if len(b) >= 5+int(binary.BigEndian.Uint16(b[3:5])) {
+			return "", ERR_SNIFF_FAILED // fragmented into several records
+		}
+		return "", ERR_SNIFF_INCOMPLETE
+	}
+	hello := record[4 : 4+n]
+	// version, random
+	p := 2 + 32
+	// session id, cipher suites, compression methods
+	for _, size := range []int{1, 2, 1} {
+		if len(hello) < p+size {
+			return "", ERR_SNIFF_FAILED
+		}
+		l := int(hello[p])
+		if size == 2 {
+			l = int(binary.BigEndian.Uint16(hello[p:]))
+		}
+		p += size + l
+	}
+	if len(hello) < p+2 {
+		return "", ERR_SNIFF_FAILED
+	}
+	exts := hello[p+2:]
+	if l := int(binary.BigEndian.Uint16(hello[p:])); len(exts) >= l {
+		exts = exts[:l]
+	}
+	for len(exts) >= 4 {
+		typ, l := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+l {
+			break
+		}
+		data := exts[4 : 4+l]
+		exts = exts[4+l:]
+		if typ != 0x0000 { // server_name
+			continue
+		}
+		if len(data) < 2 {
+			break
+		}
+		names := data[2:]
+		for len(names) >= 3 {
+			nameType, nl := names[0], int(binary.BigEndian.Uint16(names[1:]))
+			if len(names) < 3+nl {
+				break
+			}
+			if nameType == 0x00 { // host_name
+				return validHost(string(names[3 : 3+nl]))
+			}
+			names = names[3+nl:]
+		}
+		break
+	}
+	return "", ERR_SNIFF_FAILED
+}
+
+// SniffHTTPHost extracts the host from the Host header of an HTTP
+// request, without the port. It returns ERR_SNIFF_INCOMPLETE if b is a
+// part of the request header, or ERR_SNIFF_FAILED if no host is found.
+func SniffHTTPHost(b []byte) (string, error) {
+	isHTTP := false
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(b, []byte(method)) {
+			isHTTP = true
+			break
+		}
+		if len(b) < len(method) && bytes.HasPrefix([]byte(method), b) {
+			return "", ERR_SNIFF_INCOMPLETE
+		}
+	}
+	if !isHTTP {
+		return "", ERR_SNIFF_FAILED
+	}
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	header := b
+	if end != -1 {
+		header = b[:end+2]
+	}
+	// the request line is skipped, and the last line may be partial
+	lines := strings.Split(string(header), "\r\n")
+	if len(lines) < 2 {
+		if len(b) >= MAX_SNIFF_SIZE {
+			return "", ERR_SNIFF_FAILED
+		}
+		return "", ERR_SNIFF_INCOMPLETE
+	}
+	for _, line := range lines[1 : len(lines)-1] {
+		p := strings.Index(line, ":")
+		if p == -1 || !strings.EqualFold(line[:p], "Host") {
+			continue
+		}
+		host := strings.TrimSpace(line[p+1:])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+		return validHost(host)
+	}
+	if end != -1 || len(b) >= MAX_SNIFF_SIZE {
+		return "", ERR_SNIFF_FAILED
+	}
+	return "", ERR_SNIFF_INCOMPLETE
+}
+
+func validHost(host string) (string, error) {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 255 {
+		return "", ERR_SNIFF_FAILED
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_' || c == ':') {
+			return "", ERR_SNIFF_FAILED
+		}
+	}
+	return strings.ToLower(host), nil
+}
+
+// SniffHost extracts the host name of a connection from its first
+// bytes, either a TLS ClientHello or an HTTP request.
+func SniffHost(b []byte) (string, error) {
+	host, err := SniffTLSServerName(b)
+	if err != ERR_SNIFF_FAILED {
+		return host, err
+	}
+	return SniffHTTPHost(b)
+}
+
+// transparentTarget puts the address header of a transparently
+// proxied connection to addr in buf. It is the domain mapped to addr
+// if addr is a fake address, or the host name sniffed from the first
+// bytes of the connection, which are read into buf after the header,
+// or addr itself if nothing is sniffed within SNIFF_TIMEOUT.
+func (ctx *ClientContext) transparentTarget(tconn PlainConn, addr *net.TCPAddr, buf *SSBuffer) (err error) {
+	fake := ctx.fakeIP != nil && ctx.fakeIP.Contains(addr.IP)
+	if fake {
+		if domain := ctx.fakeIP.Domain(addr.IP); domain != "" {
+			buf.buf, err = AppendAddress(buf.buf[:0], domain, uint16(addr.Port))
+			return
+		}
+	}
+	data := NewBuffer()
+	host := ""
+	tconn.TCPConn.SetReadDeadline(time.Now().Add(SNIFF_TIMEOUT))
+	for len(data.buf) < MAX_SNIFF_SIZE {
+		if err = tconn.SSRead(data); err != nil {
+			break
+		}
+		var e error
+		if host, e = SniffHost(data.buf); e != ERR_SNIFF_INCOMPLETE {
+			break
+		}
+	}
+	tconn.TCPConn.SetReadDeadline(time.Time{})
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		err = nil
+	}
+	if err != nil && len(data.buf) == 0 {
+		return
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		if fake { // evicted, or mapped before a restart without persistence
+			return ERR_FAKE_IP_NOT_MAPPED
+		}
+		host = addr.IP.String()
+	}
+	if buf.buf, err = AppendAddress(buf.buf[:0], host, uint16(addr.Port)); err != nil {
+		return
+	}
+	buf.buf = append(buf.buf, data.buf...)
+	return nil
+}
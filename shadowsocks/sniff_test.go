@@ -0,0 +1,75 @@
+package shadowsocks
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientHello captures the ClientHello sent by a TLS client to
+// serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		conn.Handshake()
+		client.Close()
+	}()
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	hello := make([]byte, 0, MAX_SNIFF_SIZE)
+	for {
+		buf := make([]byte, MAX_SNIFF_SIZE)
+		n, err := server.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hello = append(hello, buf[:n]...)
+		if _, err = SniffTLSServerName(hello); err != ERR_SNIFF_INCOMPLETE {
+			return hello
+		}
+	}
+}
+
+func TestSniffTLSServerName(t *testing.T) {
+	hello := clientHello(t, "Example.COM")
+	host, err := SniffTLSServerName(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if host != "example.com" {
+		t.Fatal("Wrong server name:", host)
+	}
+	if _, err = SniffHost(hello[:len(hello)/2]); err != ERR_SNIFF_INCOMPLETE {
+		t.Fatal("Wrong error of a partial ClientHello:", err)
+	}
+	if _, err = SniffTLSServerName(clientHello(t, "")); err != ERR_SNIFF_FAILED {
+		t.Fatal("Wrong error of a ClientHello without SNI:", err)
+	}
+}
+
+func TestSniffHTTPHost(t *testing.T) {
+	cases := []struct {
+		data string
+		host string
+		err  error
+	}{
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com", nil},
+		{"POST /x HTTP/1.1\r\nUser-Agent: test\r\nhost: Example.com:8080\r\n", "example.com", nil},
+		{"GET / HTTP/1.1\r\nHost: [::1]:80\r\n\r\n", "::1", nil},
+		{"GET / HTTP/1.1\r\nHost: example.com", "", ERR_SNIFF_INCOMPLETE},
+		{"PO", "", ERR_SNIFF_INCOMPLETE},
+		{"GET / HTTP/1.1", "", ERR_SNIFF_INCOMPLETE},
+		{"GET /" + strings.Repeat("a", MAX_SNIFF_SIZE), "", ERR_SNIFF_FAILED},
+		{"GET / HTTP/1.0\r\n\r\n", "", ERR_SNIFF_FAILED},
+		{"SSH-2.0-OpenSSH\r\n", "", ERR_SNIFF_FAILED},
+	}
+	for _, c := range cases {
+		host, err := SniffHost([]byte(c.data))
+		if host != c.host || err != c.err {
+			t.Fatalf("Wrong result of %q: %q %v", c.data, host, err)
+		}
+	}
+}
@@ -99,9 +99,42 @@ func DPipe(conn1, conn2 SSConn, buf12, buf21 *SSBuffer, res chan error) {
 	res <- err
 }
 
-// PlainConn is a SSConn wrapped on TCPConn.
+// PlainConn is a SSConn wrapped on TCPConn. The data read is
+// recorded if Recorder is not nil.
 type PlainConn struct {
-	TCPConn *net.TCPConn
+	TCPConn  *net.TCPConn
+	Recorder *Recorder
+}
+
+// Recorder records the data read from a PlainConn until stopped,
+// so that it can be replayed elsewhere, e.g. to a decoy server
+// when the connection fails authentication.
+type Recorder struct {
+	data    []byte
+	stopped bool
+}
+
+func (r *Recorder) record(b []byte) {
+	if r.stopped {
+		return
+	}
+	if len(r.data)+len(b) > MAX_RECORD_SIZE {
+		r.Stop()
+		return
+	}
+	r.data = append(r.data, b...)
+}
+
+// Stop stops recording and discards the data recorded.
+func (r *Recorder) Stop() {
+	r.stopped = true
+	r.data = nil
+}
+
+// Data returns the data recorded, and false if the recorder has
+// been stopped, e.g. as too much data is read.
+func (r *Recorder) Data() ([]byte, bool) {
+	return r.data, !r.stopped
 }
 
 func (c PlainConn) SSRead(b *SSBuffer) (err error) {
@@ -116,13 +149,23 @@ func (c PlainConn) SSRead(b *SSBuffer) (err error) {
 	}
 	buf := b.buf[len(b.buf):lmax]
 	var n int
-	if n, err = c.TCPConn.Read(buf); err != nil {
+	if n, err = c.Read(buf); err != nil {
 		return
 	}
 	b.buf = b.buf[:len(b.buf)+n]
 	return nil
 }
 
+// Read reads from the connection like TCPConn.Read, and records
+// the data read if Recorder is not nil.
+func (c PlainConn) Read(b []byte) (n int, err error) {
+	n, err = c.TCPConn.Read(b)
+	if c.Recorder != nil && n > 0 {
+		c.Recorder.record(b[:n])
+	}
+	return
+}
+
 func (c PlainConn) SSReadTimeout(b *SSBuffer, millis int64) error {
 	c.TCPConn.SetReadDeadline(time.Now().Add(time.Duration(millis) * time.Millisecond))
 	defer c.TCPConn.SetReadDeadline(time.Time{})
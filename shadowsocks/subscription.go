@@ -0,0 +1,235 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_SUBSCRIPTION_INTERVAL = time.Hour
+	DEFAULT_SUBSCRIPTION_TIMEOUT  = 30 * time.Second
+)
+
+// MAX_ONLINE_CONFIG_SIZE is the maximum size of an online config
+// document.
+const MAX_ONLINE_CONFIG_SIZE = 1 << 20
+
+// OnlineServer is a server in an online config.
+type OnlineServer struct {
+	ID         string `json:"id"`
+	Remarks    string `json:"remarks"`
+	Server     string `json:"server"`
+	ServerPort uint16 `json:"server_port"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+	Plugin     string `json:"plugin"`
+	PluginOpts string `json:"plugin_opts"`
+}
+
+// OnlineConfig is a SIP008 online config document.
+// Specification: https://shadowsocks.org/doc/sip008.html
+type OnlineConfig struct {
+	Version        int            `json:"version"`
+	Servers        []OnlineServer `json:"servers"`
+	BytesUsed      *uint64        `json:"bytes_used,omitempty"`
+	BytesRemaining *uint64        `json:"bytes_remaining,omitempty"`
+}
+
+// ParseOnlineConfig parses and validates an online config document.
+func ParseOnlineConfig(data []byte) (config *OnlineConfig, err error) {
+	config = &OnlineConfig{}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("Invalid online config: %v", err)
+	}
+	if config.Version != 1 {
+		return nil, fmt.Errorf("Unsupported online config version: %d", config.Version)
+	}
+	for i, server := range config.Servers {
+		if server.Server == "" || server.ServerPort == 0 {
+			return nil, fmt.Errorf("Invalid online config: servers[%d]: missing server address", i)
+		}
+		if _, err = NewKeyReader(server.Method, server.Password); err != nil {
+			return nil, fmt.Errorf("Invalid online config: servers[%d]: %v", i, err)
+		}
+	}
+	if len(config.Servers) == 0 {
+		return nil, fmt.Errorf("Invalid online config: no server")
+	}
+	return
+}
+
+// FetchOnlineConfig fetches an online config from an HTTP(S) URL,
+// or reads it from a file. The specification requires HTTPS, while
+// HTTP is accepted for local deployments.
+func FetchOnlineConfig(source string, timeout time.Duration) (*OnlineConfig, error) {
+	var data []byte
+	var err error
+	if strings.HasPrefix(source, "https://") || strings.HasPrefix(source, "http://") {
+		client := &http.Client{Timeout: timeout}
+		var resp *http.Response
+		if resp, err = client.Get(source); err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Failed to fetch online config: %s", resp.Status)
+		}
+		data, err = ioutil.ReadAll(io.LimitReader(resp.Body, MAX_ONLINE_CONFIG_SIZE+1))
+		if len(data) > MAX_ONLINE_CONFIG_SIZE {
+			return nil, fmt.Errorf("Online config too large")
+		}
+	} else {
+		data, err = ioutil.ReadFile(strings.TrimPrefix(source, "file://"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseOnlineConfig(data)
+}
+
+func (server OnlineServer) name() string {
+	if server.Remarks != "" {
+		return server.Remarks
+	}
+	if server.ID != "" {
+		return server.ID
+	}
+	return WrapAddr(server.Server, server.ServerPort)
+}
+
+// Subscription keeps the servers of a pool up to date with an online
+// config, fetched periodically. The connections to the servers
+// removed are kept, and the state of the servers unchanged, e.g. the
+// latency, is kept across updates.
+type Subscription struct {
+	source    string
+	pool      *ServerPool
+	interval  time.Duration
+	timeout   time.Duration
+	udpRelay  bool
+	lock      sync.Mutex
+	config    *OnlineConfig
+	upstreams map[OnlineServer]*Upstream
+	stop      chan bool
+}
+
+// NewSubscription creates a subscription updating pool from source,
+// an HTTP(S) URL or a file path.
+func NewSubscription(source string, pool *ServerPool, interval, timeout time.Duration, udpRelay bool) *Subscription {
+	if interval <= 0 {
+		interval = DEFAULT_SUBSCRIPTION_INTERVAL
+	}
+	if timeout <= 0 {
+		timeout = DEFAULT_SUBSCRIPTION_TIMEOUT
+	}
+	return &Subscription{
+		source:    source,
+		pool:      pool,
+		interval:  interval,
+		timeout:   timeout,
+		udpRelay:  udpRelay,
+		upstreams: map[OnlineServer]*Upstream{},
+	}
+}
+
+// Update fetches the online config, and replaces the servers of the
+// pool. The pool is unchanged on errors. The plugins of the servers
+// removed are stopped once the connections through them are closed.
+func (s *Subscription) Update() error {
+	config, err := FetchOnlineConfig(s.source, s.timeout)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	upstreams := make(map[OnlineServer]*Upstream, len(config.Servers))
+	servers := make([]*Upstream, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		u, ok := upstreams[server]
+		if !ok {
+			u, ok = s.upstreams[server]
+		}
+		if !ok {
+			keyReader, _ := NewKeyReader(server.Method, server.Password) // validated
+			if u, err = NewUpstream(ServerConfig{
+				Name:       server.name(),
+				Host:       server.Server,
+				Port:       server.ServerPort,
+				Method:     server.Method,
+				KeyDeriver: keyReader,
+				Plugin:     server.Plugin,
+				PluginOpts: server.PluginOpts,
+			}, s.udpRelay); err != nil {
+				for server, u := range upstreams {
+					if s.upstreams[server] != u {
+						u.Close()
+					}
+				}
+				return err
+			}
+		}
+		upstreams[server] = u
+		servers = append(servers, u)
+	}
+	s.pool.SetServers(servers)
+	for server, u := range s.upstreams {
+		if upstreams[server] != u {
+			u.Release()
+		}
+	}
+	s.upstreams = upstreams
+	s.config = config
+	return nil
+}
+
+// Config returns the online config last fetched, or nil.
+func (s *Subscription) Config() *OnlineConfig {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.config
+}
+
+// Start starts updating periodically in a new goroutine.
+func (s *Subscription) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan bool)
+	go s.run(s.stop)
+}
+
+// Stop stops updating.
+func (s *Subscription) Stop() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+func (s *Subscription) run(stop chan bool) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if err := s.Update(); err != nil {
+			log.Printf("Failed to update servers from %s: %v", s.source, err)
+		} else {
+			log.Printf("Updated servers from %s", s.source)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubscription(t *testing.T) {
+	for _, port := range []uint16{7120, 7121} {
+		serverConfig, _ := testConfigs(port, "")
+		serverConfig.KeyDeriver, _ = NewKeyReader("aes-128-gcm", fmt.Sprint("sub", port))
+		_, stopServer := startServer(t, serverConfig)
+		defer stopServer()
+	}
+
+	var lock sync.Mutex
+	port := 7120
+	online := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		fmt.Fprintf(w, `{"version": 1, "servers": [{"id": "%d", "remarks": "server %d",
+			"server": "127.0.0.1", "server_port": %d, "method": "aes-128-gcm", "password": "sub%d"}]}`,
+			port, port, port, port)
+	}))
+	defer online.Close()
+
+	clientConfig := DefaultConfig()
+	clientConfig.LocalPort = 6120
+	clientConfig.Subscription = online.URL
+	client, stopClient := startClient(t, clientConfig)
+	defer stopClient()
+
+	socks, _ := proxy.SOCKS5("tcp", "127.0.0.1:6120", nil, proxy.Direct)
+	requester := &http.Client{
+		Transport: &http.Transport{Dial: socks.Dial},
+		Timeout:   time.Second,
+	}
+	get := func() {
+		request, err := requester.Get("http://127.0.0.1:8000/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(request.Body)
+		request.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != "Hello" {
+			t.Fatal("Wrong content:", string(content))
+		}
+	}
+	get()
+	servers := client.Servers().Servers()
+	if len(servers) != 1 || servers[0].Name != "server 7120" {
+		t.Fatal("Wrong servers:", servers)
+	}
+
+	// unchanged servers are kept
+	if err := client.Subscription().Update(); err != nil {
+		t.Fatal(err)
+	}
+	if client.Servers().Servers()[0] != servers[0] {
+		t.Fatal("Unchanged server is replaced")
+	}
+
+	lock.Lock()
+	port = 7121
+	lock.Unlock()
+	if err := client.Subscription().Update(); err != nil {
+		t.Fatal(err)
+	}
+	servers = client.Servers().Servers()
+	if len(servers) != 1 || servers[0].Name != "server 7121" {
+		t.Fatal("Servers are not updated:", servers)
+	}
+	if client.Subscription().Config().Servers[0].ServerPort != 7121 {
+		t.Fatal("Wrong online config:", client.Subscription().Config())
+	}
+	// the kept-alive connection through the old server is not dropped
+	get()
+	if servers[0].Latency() != 0 {
+		t.Fatal("New server is used by the old connection")
+	}
+	requester.Transport.(*http.Transport).CloseIdleConnections()
+	get()
+	if servers[0].Latency() == 0 {
+		t.Fatal("New server is not used")
+	}
+}
+
+func TestSubscriptionPlugin(t *testing.T) {
+	serverConfig, _ := testConfigs(7211, "subplugin")
+	serverConfig.Plugin = os.Args[0]
+	serverConfig.PluginOpts = "server"
+	_, stopServer := startServer(t, serverConfig)
+	defer stopServer()
+
+	var lock sync.Mutex
+	plugin := os.Args[0]
+	online := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		fmt.Fprintf(w, `{"version": 1, "servers": [{"server": "127.0.0.1", "server_port": 7211,
+			"method": "aes-128-gcm", "password": "subplugin", "plugin": %q, "plugin_opts": "client"}]}`, plugin)
+	}))
+	defer online.Close()
+
+	clientConfig := DefaultConfig()
+	clientConfig.LocalPort = 6211
+	clientConfig.Subscription = online.URL
+	client, stopClient := startClient(t, clientConfig)
+	defer stopClient()
+
+	// a connection is kept open through the plugin, which takes a while
+	// to start
+	socks, _ := proxy.SOCKS5("tcp", "127.0.0.1:6211", nil, proxy.Direct)
+	var held net.Conn
+	var reader *bufio.Reader
+	get := func() error {
+		if _, err := held.Write([]byte("GET /hello HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")); err != nil {
+			return err
+		}
+		response, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		content, err := ioutil.ReadAll(response.Body)
+		if err == nil && string(content) != "Hello" {
+			t.Fatal("Wrong content:", string(content))
+		}
+		return err
+	}
+	var err error
+	for i := 0; i < 50; i++ {
+		if held, err = socks.Dial("tcp", "127.0.0.1:8000"); err == nil {
+			held.SetDeadline(time.Now().Add(10 * time.Second))
+			reader = bufio.NewReader(held)
+			if err = get(); err == nil {
+				break
+			}
+			held.Close()
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	removed := client.Servers().Servers()[0]
+	stopped := func() bool {
+		removed.plugin.lock.Lock()
+		defer removed.plugin.lock.Unlock()
+		return removed.plugin.stop == nil
+	}
+
+	// the server is replaced by one without plugin
+	lock.Lock()
+	plugin = ""
+	lock.Unlock()
+	if err = client.Subscription().Update(); err != nil {
+		t.Fatal(err)
+	}
+	if client.Servers().Servers()[0] == removed {
+		t.Fatal("Server is not replaced")
+	}
+	if err = get(); err != nil {
+		t.Fatal("Connection through the plugin is dropped:", err)
+	}
+	if stopped() {
+		t.Fatal("Plugin is stopped with a connection alive")
+	}
+	held.Close()
+	for i := 0; i < 20 && !stopped(); i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !stopped() {
+		t.Fatal("Plugin is not stopped")
+	}
+}
+
+func TestParseOnlineConfig(t *testing.T) {
+	config, err := ParseOnlineConfig([]byte(`{"version": 1, "servers": [
+		{"server": "127.0.0.1", "server_port": 8388, "method": "aes-256-gcm", "password": "test"},
+		{"server": "127.0.0.1", "server_port": 8389, "method": "aes-256-gcm", "password": "test", "plugin": "obfs-local", "plugin_opts": "obfs=http"}
+	], "bytes_used": 100}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Servers) != 2 || config.Servers[1].PluginOpts != "obfs=http" || *config.BytesUsed != 100 {
+		t.Fatalf("Wrong online config: %+v", config)
+	}
+
+	for _, data := range []string{
+		`{"version": 1, "servers": [`,
+		`{"version": 2, "servers": [{"server": "127.0.0.1", "server_port": 8388, "method": "aes-256-gcm", "password": "test"}]}`,
+		`{"version": 1, "servers": []}`,
+		`{"version": 1, "servers": [{"server": "127.0.0.1", "method": "aes-256-gcm", "password": "test"}]}`,
+		`{"version": 1, "servers": [{"server": "127.0.0.1", "server_port": 8388, "method": "unknown", "password": "test"}]}`,
+	} {
+		if _, err := ParseOnlineConfig([]byte(data)); err == nil {
+			t.Fatal("Invalid online config is parsed:", data)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package shadowsocks
+
+import "sync/atomic"
+
+// TrafficStats holds the traffic counters of a server or a user.
+// The counters are updated atomically, so no lock is taken when
+// relaying data.
+type TrafficStats struct {
+	upload      int64 // bytes from clients to targets
+	download    int64 // bytes from targets to clients
+	connections int64 // connections accepted
+	active      int64 // connections alive
+	rejected    int64 // connections rejected by limits
+	denied      int64 // connections and packets to denied destinations
+	// bytes in both directions counted by the quota, which are not
+	// reset with the other counters but when the quota is renewed
+	used int64
+}
+
+// TrafficSnapshot is a copy of the counters of TrafficStats.
+type TrafficSnapshot struct {
+	Upload      int64 `json:"upload"`
+	Download    int64 `json:"download"`
+	Connections int64 `json:"connections"`
+	Active      int64 `json:"active"`
+	Rejected    int64 `json:"rejected"`
+	Denied      int64 `json:"denied"`
+}
+
+// Snapshot returns the current counters.
+func (s *TrafficStats) Snapshot() TrafficSnapshot {
+	return TrafficSnapshot{
+		Upload:      atomic.LoadInt64(&s.upload),
+		Download:    atomic.LoadInt64(&s.download),
+		Connections: atomic.LoadInt64(&s.connections),
+		Active:      atomic.LoadInt64(&s.active),
+		Rejected:    atomic.LoadInt64(&s.rejected),
+		Denied:      atomic.LoadInt64(&s.denied),
+	}
+}
+
+// Reset sets the counters to zero and returns their previous values.
+// Each counter is swapped atomically, so no traffic is lost or counted
+// twice between two resets. The number of alive connections is not
+// reset.
+func (s *TrafficStats) Reset() TrafficSnapshot {
+	return TrafficSnapshot{
+		Upload:      atomic.SwapInt64(&s.upload, 0),
+		Download:    atomic.SwapInt64(&s.download, 0),
+		Connections: atomic.SwapInt64(&s.connections, 0),
+		Active:      atomic.LoadInt64(&s.active),
+		Rejected:    atomic.SwapInt64(&s.rejected, 0),
+		Denied:      atomic.SwapInt64(&s.denied, 0),
+	}
+}
+
+// Total returns the bytes transferred in both directions.
+func (s *TrafficStats) Total() int64 {
+	return atomic.LoadInt64(&s.upload) + atomic.LoadInt64(&s.download)
+}
+
+func (s *TrafficStats) addUpload(n int64) {
+	atomic.AddInt64(&s.upload, n)
+	atomic.AddInt64(&s.used, n)
+}
+
+func (s *TrafficStats) addDownload(n int64) {
+	atomic.AddInt64(&s.download, n)
+	atomic.AddInt64(&s.used, n)
+}
+
+func (s *TrafficStats) open() {
+	atomic.AddInt64(&s.connections, 1)
+	atomic.AddInt64(&s.active, 1)
+}
+
+func (s *TrafficStats) close() {
+	atomic.AddInt64(&s.active, -1)
+}
+
+func (s *TrafficStats) reject() {
+	atomic.AddInt64(&s.rejected, 1)
+}
+
+// TrafficConn is a SSConn accepted by a server, which counts the
+// bytes it transfers in the stats of the server, and in the stats
+// of the user once the connection is attributed to a user. The
+// connection is closed once the quota of either is exceeded.
+type TrafficConn struct {
+	SSConn
+	stats *TrafficStats
+	quota *Quota
+	user  *ServerUser
+}
+
+// NewTrafficConn wraps conn and counts it as a new connection, or
+// returns an error if it is rejected by quota. Release must be
+// called when the connection is closed.
+func NewTrafficConn(conn SSConn, stats *TrafficStats, quota *Quota) (*TrafficConn, error) {
+	if err := quota.acquire(conn); err != nil {
+		return nil, err
+	}
+	stats.open()
+	return &TrafficConn{SSConn: conn, stats: stats, quota: quota}, nil
+}
+
+// Release counts the connection as closed.
+func (c *TrafficConn) Release() {
+	c.stats.close()
+	c.quota.release(c.SSConn)
+	if c.user != nil {
+		c.user.stats.close()
+		c.user.quota.release(c.SSConn)
+	}
+}
+
+func (c *TrafficConn) SSRead(b *SSBuffer) error {
+	n := len(b.buf)
+	err := c.SSConn.SSRead(b)
+	if c.user == nil {
+		if user := ConnUser(c.SSConn); user != nil {
+			if e := user.quota.acquire(c.SSConn); e != nil {
+				return e
+			}
+			c.user = user
+			c.user.stats.open()
+		}
+	}
+	n = len(b.buf) - n
+	c.stats.addUpload(int64(n))
+	if c.user != nil {
+		c.user.stats.addUpload(int64(n))
+	}
+	if err != nil {
+		return err
+	}
+	return c.check()
+}
+
+func (c *TrafficConn) SSWrite(b *SSBuffer) error {
+	n := len(b.buf)
+	err := c.SSConn.SSWrite(b)
+	n -= len(b.buf)
+	c.stats.addDownload(int64(n))
+	if c.user != nil {
+		c.user.stats.addDownload(int64(n))
+	}
+	if err != nil {
+		return err
+	}
+	return c.check()
+}
+
+func (c *TrafficConn) check() error {
+	if err := c.quota.check(); err != nil {
+		return err
+	}
+	if c.user != nil {
+		return c.user.quota.check()
+	}
+	return nil
+}
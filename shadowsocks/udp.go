@@ -0,0 +1,157 @@
+package shadowsocks
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DROP_LOG_INTERVAL is the minimum interval between the logs of the
+// packets dropped by a listener.
+const DROP_LOG_INTERVAL = 10 * time.Second
+
+// dropLog counts the packets dropped by a listener, logging them at
+// most once per DROP_LOG_INTERVAL. It is used by a single goroutine.
+type dropLog struct {
+	dropped int
+	last    time.Time
+}
+
+// Drop counts a packet dropped because of reason.
+func (d *dropLog) Drop(reason error) {
+	d.dropped++
+	if now := time.Now(); now.Sub(d.last) >= DROP_LOG_INTERVAL {
+		log.Printf("Dropped %d UDP packets: %v", d.dropped, reason)
+		d.dropped, d.last = 0, now
+	}
+}
+
+// UDPSession is an entry of NATTable. It owns an outbound socket
+// which relays all the packets of a single source.
+type UDPSession struct {
+	conn *net.UDPConn
+	last int64 // unix nano of last activity, accessed atomically
+	// cipher seals and opens the packets of the session
+	cipher PacketCipher
+	// closers are called once the session is closed
+	closers []func()
+	// upstream is the server relaying the session on clients
+	upstream *Upstream
+}
+
+// Cipher returns the cipher of the packets of the session.
+func (s *UDPSession) Cipher() PacketCipher {
+	return s.cipher
+}
+
+// OnClose registers f to be called once the session expires or is
+// closed. It must be called by the recv of the session.
+func (s *UDPSession) OnClose(f func()) {
+	s.closers = append(s.closers, f)
+}
+
+// WriteTo writes a packet to addr through the outbound socket.
+func (s *UDPSession) WriteTo(b []byte, addr *net.UDPAddr) (err error) {
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
+	_, err = s.conn.WriteToUDP(b, addr)
+	return
+}
+
+// NATTable maps sources of UDP packets to their sessions and
+// expires the sessions which are idle for longer than timeout.
+type NATTable struct {
+	sessions map[string]*UDPSession
+	lock     sync.Mutex
+	timeout  time.Duration
+}
+
+// NewNATTable creates an empty NATTable.
+func NewNATTable(timeout time.Duration) *NATTable {
+	return &NATTable{
+		sessions: map[string]*UDPSession{},
+		timeout:  timeout,
+	}
+}
+
+// Lookup returns the session of src, or nil if it does not exist.
+func (t *NATTable) Lookup(src string) *UDPSession {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.sessions[src]
+}
+
+// Get returns the session of src. If it does not exist, a new session is
+// created with a new packet session of cipher, and recv will be called
+// with the session and every packet it receives until it expires.
+func (t *NATTable) Get(src string, cipher PacketCipher, recv func(s *UDPSession, pkt []byte, from *net.UDPAddr)) (s *UDPSession, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if s = t.sessions[src]; s != nil {
+		return
+	}
+	if cipher, err = NewPacketSession(cipher); err != nil {
+		return
+	}
+	var conn *net.UDPConn
+	conn, err = net.ListenUDP("udp", nil)
+	if err != nil {
+		return
+	}
+	s = &UDPSession{conn: conn, last: time.Now().UnixNano(), cipher: cipher}
+	t.sessions[src] = s
+	go t.serve(src, s, recv)
+	return
+}
+
+func (t *NATTable) serve(src string, s *UDPSession, recv func(s *UDPSession, pkt []byte, from *net.UDPAddr)) {
+	defer func() {
+		t.lock.Lock()
+		if t.sessions[src] == s {
+			delete(t.sessions, src)
+		}
+		t.lock.Unlock()
+		s.conn.Close()
+		for _, f := range s.closers {
+			f()
+		}
+	}()
+	buf := make([]byte, MAX_UDP_PACKET_SIZE)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(t.timeout))
+		n, from, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				last := time.Unix(0, atomic.LoadInt64(&s.last))
+				if time.Since(last) < t.timeout {
+					continue
+				}
+			}
+			return
+		}
+		atomic.StoreInt64(&s.last, time.Now().UnixNano())
+		recv(s, buf[:n], from)
+	}
+}
+
+// Len returns the number of alive sessions.
+func (t *NATTable) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.sessions)
+}
+
+// Close closes all the sessions.
+func (t *NATTable) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, s := range t.sessions {
+		s.conn.Close()
+	}
+}
+
+func isClosedError(err error) bool {
+	return strings.Index(err.Error(), "use of closed network connection") != -1
+}
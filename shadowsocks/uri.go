@@ -0,0 +1,116 @@
+package shadowsocks
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// decodeBase64 decodes base64 in either the URL or the standard
+// alphabet, with or without padding.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	if strings.ContainsAny(s, "+/") {
+		return base64.RawStdEncoding.DecodeString(s)
+	}
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// ParseURI parses a SIP002 URI like
+// "ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888/?plugin=obfs-local%3Bobfs%3Dhttp#Example",
+// whose userinfo is either "method:password" in base64url, or
+// percent-encoded as required by 2022-blake3-* methods. The legacy
+// form "ss://" followed by "method:password@host:port" in base64 is
+// accepted as well. The config returned has DefaultConfig as the base.
+// Specification: https://shadowsocks.org/doc/sip002.html
+func ParseURI(uri string) (config Config, err error) {
+	config = DefaultConfig()
+	if !strings.HasPrefix(uri, "ss://") {
+		return config, fmt.Errorf("Invalid ss URI: %s", uri)
+	}
+	body := uri[len("ss://"):]
+	if p := strings.Index(body, "#"); p != -1 {
+		if config.Remarks, err = url.PathUnescape(body[p+1:]); err != nil {
+			return
+		}
+		body = body[:p]
+	}
+	var userinfo, hostport, query string
+	if p := strings.LastIndex(body, "@"); p == -1 { // legacy
+		var data []byte
+		if data, err = decodeBase64(strings.TrimSuffix(body, "/")); err != nil {
+			return config, fmt.Errorf("Invalid ss URI: %v", err)
+		}
+		p = strings.LastIndex(string(data), "@")
+		if p == -1 {
+			return config, fmt.Errorf("Invalid ss URI: missing server address")
+		}
+		userinfo, hostport = string(data[:p]), string(data[p+1:])
+	} else {
+		userinfo, hostport = body[:p], body[p+1:]
+		if p = strings.IndexAny(hostport, "/?"); p != -1 {
+			hostport, query = hostport[:p], hostport[p:]
+			query = strings.TrimPrefix(strings.TrimPrefix(query, "/"), "?")
+		}
+		if strings.Contains(userinfo, ":") {
+			if userinfo, err = url.PathUnescape(userinfo); err != nil {
+				return
+			}
+		} else {
+			var data []byte
+			if data, err = decodeBase64(userinfo); err != nil {
+				return config, fmt.Errorf("Invalid ss URI userinfo: %v", err)
+			}
+			userinfo = string(data)
+		}
+	}
+	p := strings.Index(userinfo, ":")
+	if p == -1 {
+		return config, fmt.Errorf("Invalid ss URI userinfo: missing password")
+	}
+	config.Method, config.Password = strings.ToLower(userinfo[:p]), userinfo[p+1:]
+	if config.ServerHost, config.ServerPort, err = UnwrapAddr(hostport); err != nil {
+		return config, fmt.Errorf("Invalid ss URI server address: %s", hostport)
+	}
+	var values url.Values
+	if values, err = url.ParseQuery(query); err != nil {
+		return
+	}
+	if plugin := values.Get("plugin"); plugin != "" {
+		config.Plugin, config.PluginOpts = plugin, ""
+		if p := strings.Index(plugin, ";"); p != -1 {
+			config.Plugin, config.PluginOpts = plugin[:p], plugin[p+1:]
+		}
+	}
+	config.KeyDeriver, err = NewKeyReader(config.Method, config.Password)
+	return
+}
+
+// FormatURI formats the server of config, identified by ServerHost,
+// ServerPort, Method and Password, as a SIP002 URI. The plugin and the
+// remarks are included if set.
+func FormatURI(config Config) (string, error) {
+	cipherInfo, ok := Ciphers[config.Method]
+	if !ok {
+		return "", fmt.Errorf("Unknown cipher: %s", config.Method)
+	}
+	var userinfo string
+	if cipherInfo.psk {
+		userinfo = url.UserPassword(config.Method, config.Password).String()
+	} else {
+		userinfo = base64.RawURLEncoding.EncodeToString([]byte(config.Method + ":" + config.Password))
+	}
+	uri := "ss://" + userinfo + "@" + WrapAddr(config.ServerHost, config.ServerPort)
+	if config.Plugin != "" {
+		plugin := config.Plugin
+		if config.PluginOpts != "" {
+			plugin += ";" + config.PluginOpts
+		}
+		uri += "/?plugin=" + url.QueryEscape(plugin)
+	}
+	if config.Remarks != "" {
+		uri += "#" + url.PathEscape(config.Remarks)
+	}
+	return uri, nil
+}
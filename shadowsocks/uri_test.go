@@ -0,0 +1,59 @@
+package shadowsocks
+
+import (
+	"testing"
+)
+
+func TestURI(t *testing.T) {
+	for _, c := range []struct {
+		uri                         string
+		host                        string
+		port                        uint16
+		method, password            string
+		plugin, pluginOpts, remarks string
+	}{
+		{"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888#Example1",
+			"192.168.100.1", 8888, "aes-128-gcm", "test", "", "", "Example1"},
+		{"ss://YWVzLTI1Ni1nY206dGVzdA@[::1]:8888/?plugin=obfs-local%3Bobfs%3Dhttp#Example%202",
+			"::1", 8888, "aes-256-gcm", "test", "obfs-local", "obfs=http", "Example 2"},
+		{"ss://2022-blake3-aes-256-gcm:YctPZ6U7xPPcU%2Bgp3u%2B0tx%2FtRizJN9K8y%2BuKlW2qjlI%3D@192.168.100.1:8888",
+			"192.168.100.1", 8888, "2022-blake3-aes-256-gcm", "YctPZ6U7xPPcU+gp3u+0tx/tRizJN9K8y+uKlW2qjlI=", "", "", ""},
+		{"ss://YWVzLTEyOC1nY206dGVzdEAxOTIuMTY4LjEwMC4xOjg4ODg=#Legacy",
+			"192.168.100.1", 8888, "aes-128-gcm", "test", "", "", "Legacy"},
+	} {
+		config, err := ParseURI(c.uri)
+		if err != nil {
+			t.Fatal(c.uri, err)
+		}
+		if config.ServerHost != c.host || config.ServerPort != c.port ||
+			config.Method != c.method || config.Password != c.password ||
+			config.Plugin != c.plugin || config.PluginOpts != c.pluginOpts ||
+			config.Remarks != c.remarks || config.KeyDeriver == nil {
+			t.Fatalf("Wrong config of %s: %+v", c.uri, config)
+		}
+		uri, err := FormatURI(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again, err := ParseURI(uri)
+		if err != nil {
+			t.Fatal(uri, err)
+		}
+		if again.ServerHost != c.host || again.ServerPort != c.port || again.Password != c.password ||
+			again.Plugin != c.plugin || again.PluginOpts != c.pluginOpts || again.Remarks != c.remarks {
+			t.Fatal("Wrong config formatted:", uri)
+		}
+	}
+
+	for _, uri := range []string{
+		"http://YWVzLTEyOC1nY206dGVzdA@192.168.100.1:8888",
+		"ss://YWVzLTEyOC1nY206dGVzdA@192.168.100.1",
+		"ss://YWVzLTEyOC1nY20@192.168.100.1:8888",
+		"ss://dW5rbm93bjp0ZXN0@192.168.100.1:8888",
+		"ss://2022-blake3-aes-256-gcm:short@192.168.100.1:8888",
+	} {
+		if _, err := ParseURI(uri); err == nil {
+			t.Fatal("Invalid URI is parsed:", uri)
+		}
+	}
+}
@@ -110,3 +110,25 @@ func ParseAddress(buf []byte) (addr string, n int, err error) {
 	}
 	return
 }
+
+// AppendAddress appends the shadowsocks address header of host
+// and port to dst. IP addresses are encoded as IPv4 or IPv6 address,
+// otherwise host is encoded as a host name.
+func AppendAddress(dst []byte, host string, port uint16) ([]byte, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			dst = append(dst, 0x01)
+			dst = append(dst, ip4...)
+		} else {
+			dst = append(dst, 0x04)
+			dst = append(dst, ip...)
+		}
+	} else {
+		if len(host) > 255 {
+			return dst, ERR_INVALID_ADDR
+		}
+		dst = append(dst, 0x03, byte(len(host)))
+		dst = append(dst, host...)
+	}
+	return append(dst, byte(port>>8), byte(port)), nil
+}